@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// adapterName returns the name of the adapter type generated for an adapted type.
+func adapterName(gType *Type) string {
+	return gType.Name + "Adapter"
+}
+
+// mappedTypeExpr returns the type expression of a concrete type,
+// as it's referred to in the generated file.
+func mappedTypeExpr(gType *Type) ast.Expr {
+	var expr ast.Expr
+	if gType.PkgName != "" {
+		expr = &ast.SelectorExpr{
+			X: &ast.Ident{
+				Name: gType.PkgName,
+			},
+			Sel: &ast.Ident{
+				Name: gType.Name,
+			},
+		}
+	} else {
+		expr = &ast.Ident{
+			Name: gType.Name,
+		}
+	}
+	if gType.Pointer {
+		expr = &ast.StarExpr{
+			X: expr,
+		}
+	}
+	return expr
+}
+
+// adapters returns the declarations of the adapter types of the adapted types,
+// e.g. for Type=adapt:models.Store{Get:Fetch}:
+//
+//	// StoreAdapter adapts models.Store to the methods of Type.
+//	type StoreAdapter struct {
+//		models.Store
+//	}
+//
+//	func (a StoreAdapter) Get(id int64) (*models.User, error) {
+//		return a.Store.Fetch(id)
+//	}
+//
+// The adapter embeds the concrete type, so its other methods are promoted,
+// and the generic type is replaced with the adapter.
+// It returns the packages the methods' signatures refer to, by path.
+func (gctx *genericContext) adapters() ([]ast.Decl, map[string]string, error) {
+	names := make([]string, 0, len(gctx.genericTypes))
+	for name, gType := range gctx.genericTypes {
+		if gType.Adapter {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	imports := make(map[string]string)
+	var decls []ast.Decl
+	for _, name := range names {
+		adapterDecls, err := gctx.adapter(name, imports)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, fmt.Sprintf("generating adapter of %v failed", name))
+		}
+		decls = append(decls, adapterDecls...)
+	}
+	return decls, imports, nil
+}
+
+// adapter returns the adapter type of a generic type and its methods.
+func (gctx *genericContext) adapter(generic string, imports map[string]string) ([]ast.Decl, error) {
+	gType := gctx.genericTypes[generic]
+	t, err := gctx.loader.lookup(gType)
+	if err != nil {
+		return nil, err
+	}
+	named := t
+	if ptr, ok := named.(*types.Pointer); ok {
+		named = ptr.Elem()
+	}
+	var pkg *types.Package
+	if n, ok := named.(*types.Named); ok {
+		pkg = n.Obj().Pkg()
+	}
+
+	name := adapterName(gType)
+	decls := []ast.Decl{
+		&ast.GenDecl{
+			Doc: &ast.CommentGroup{
+				List: []*ast.Comment{{
+					Text: fmt.Sprintf("// %v adapts %v to the methods of %v.", name, types.ExprString(mappedTypeExpr(gType)), generic),
+				}},
+			},
+			Tok: token.TYPE,
+			Specs: []ast.Spec{
+				&ast.TypeSpec{
+					Name: &ast.Ident{Name: name},
+					Type: &ast.StructType{
+						Fields: &ast.FieldList{
+							List: []*ast.Field{{Type: mappedTypeExpr(gType)}},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	methods := make([]string, 0, len(gType.Fields))
+	for method := range gType.Fields {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	for _, method := range methods {
+		target := gType.Fields[method]
+		obj, _, _ := types.LookupFieldOrMethod(t, true, pkg, target)
+		fn, ok := obj.(*types.Func)
+		if !ok {
+			return nil, &mappingError{
+				msg: fmt.Sprintf("%v has no method %v", types.ExprString(mappedTypeExpr(gType)), target),
+			}
+		}
+		sig := fn.Type().(*types.Signature)
+		funcType, params, err := gctx.funcType(sig, map[string]bool{"a": true}, imports)
+		if err != nil {
+			return nil, errors.Wrap(err, target)
+		}
+		call := &ast.CallExpr{
+			Fun: &ast.SelectorExpr{
+				X: &ast.SelectorExpr{
+					X:   &ast.Ident{Name: "a"},
+					Sel: &ast.Ident{Name: gType.Name},
+				},
+				Sel: &ast.Ident{Name: target},
+			},
+		}
+		for _, param := range params {
+			call.Args = append(call.Args, &ast.Ident{Name: param})
+		}
+		if sig.Variadic() {
+			call.Ellipsis = 1
+		}
+		var stmt ast.Stmt = &ast.ReturnStmt{Results: []ast.Expr{call}}
+		if sig.Results().Len() == 0 {
+			stmt = &ast.ExprStmt{X: call}
+		}
+		decls = append(decls, &ast.FuncDecl{
+			Recv: &ast.FieldList{
+				List: []*ast.Field{{
+					Names: []*ast.Ident{{Name: "a"}},
+					Type:  &ast.Ident{Name: name},
+				}},
+			},
+			Name: &ast.Ident{Name: method},
+			Type: funcType,
+			Body: &ast.BlockStmt{List: []ast.Stmt{stmt}},
+		})
+	}
+	return decls, nil
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+
+	"github.com/pkg/errors"
+)
+
+// namedTemplate is a template the //rei:gen annotations refer to by name,
+// given with -t name=path[:Param].
+// Param is the parameter the annotated type is mapped to.
+type namedTemplate struct {
+	name  string
+	path  string
+	param string
+}
+
+func parseNamedTemplate(s string) (*namedTemplate, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("invalid template %v, expected name=path[:Param]", s)
+	}
+	t := &namedTemplate{
+		name: parts[0],
+		path: parts[1],
+	}
+	if ok, _ := isIdentifier(t.name); !ok {
+		return nil, fmt.Errorf("invalid template %v, %v is not a valid name", s, t.name)
+	}
+	if idx := strings.LastIndex(t.path, ":"); idx != -1 {
+		t.path, t.param = t.path[:idx], t.path[idx+1:]
+		if ok, _ := isIdentifier(t.param); !ok {
+			return nil, fmt.Errorf("invalid template %v, %v is not a valid parameter name", s, t.param)
+		}
+	}
+	return t, nil
+}
+
+// templateFlags collects the -t flags.
+type templateFlags map[string]*namedTemplate
+
+func (f templateFlags) String() string {
+	names := make([]string, 0, len(f))
+	for name := range f {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func (f templateFlags) Set(s string) error {
+	t, err := parseNamedTemplate(s)
+	if err != nil {
+		return err
+	}
+	if _, ok := f[t.name]; ok {
+		return fmt.Errorf("duplicate template %v", t.name)
+	}
+	f[t.name] = t
+	return nil
+}
+
+// parameter returns the parameter of the template the annotated types are mapped to.
+// It's the template's only declared parameter if it's not given explicitly,
+// or Type if the template doesn't declare its parameters.
+func (t *namedTemplate) parameter() (string, error) {
+	if t.param != "" {
+		return t.param, nil
+	}
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, t.path, nil, parser.ParseComments)
+	if err != nil {
+		return "", errors.Wrap(err, "parsing file failed")
+	}
+	params, err := parseParams(fset, file)
+	if err != nil {
+		return "", errors.Wrap(err, "parsing parameters failed")
+	}
+	switch len(params) {
+	case 0:
+		return "Type", nil
+	case 1:
+		return params[0].Name, nil
+	}
+	return "", fmt.Errorf("template %v has several parameters, set it with -t %v=%v:Param", t.name, t.name, t.path)
+}
+
+// annotatedType is a type annotated with a //rei:gen directive:
+//
+//	//rei:gen dao,cache
+//	type User struct {
+//
+// The arguments are the names of the templates to generate for the type.
+type annotatedType struct {
+	name      string
+	templates []string
+	pos       token.Position
+}
+
+// genAnnotation returns the template names of the //rei:gen directives in a doc comment.
+func genAnnotation(doc *ast.CommentGroup) []string {
+	if doc == nil {
+		return nil
+	}
+	var names []string
+	for _, c := range doc.List {
+		if !strings.HasPrefix(c.Text, directivePrefix+"gen ") {
+			continue
+		}
+		for _, name := range strings.Split(strings.TrimPrefix(c.Text, directivePrefix+"gen "), ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// annotatedTypes parses the package in dir and returns its name
+// and its annotated types in source order.
+func annotatedTypes(dir string) (string, []*annotatedType, error) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go")
+	}, parser.ParseComments)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "parsing package failed")
+	}
+	if len(pkgs) != 1 {
+		return "", nil, fmt.Errorf("expected one package in %v, found %v", dir, len(pkgs))
+	}
+	var pkg *ast.Package
+	for _, p := range pkgs {
+		pkg = p
+	}
+	filenames := make([]string, 0, len(pkg.Files))
+	for filename := range pkg.Files {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+
+	var annotated []*annotatedType
+	for _, filename := range filenames {
+		for _, decl := range pkg.Files[filename].Decls {
+			d, ok := decl.(*ast.GenDecl)
+			if !ok || d.Tok != token.TYPE {
+				continue
+			}
+			// Annotations on a grouped declaration apply to every type in the group.
+			groupTemplates := genAnnotation(d.Doc)
+			for _, spec := range d.Specs {
+				ts := spec.(*ast.TypeSpec)
+				templates := append(append([]string(nil), groupTemplates...), genAnnotation(ts.Doc)...)
+				if len(templates) == 0 {
+					continue
+				}
+				annotated = append(annotated, &annotatedType{
+					name:      ts.Name.Name,
+					templates: templates,
+					pos:       fset.Position(ts.Pos()),
+				})
+			}
+		}
+	}
+	return pkg.Name, annotated, nil
+}
+
+// importPath returns the import path of the package in dir.
+func importPath(dir string) (string, error) {
+	pkgs, err := packages.Load(&packages.Config{Mode: packages.NeedName, Dir: dir}, ".")
+	if err != nil {
+		return "", errors.Wrap(err, fmt.Sprintf("loading %v failed", dir))
+	}
+	if len(pkgs) != 1 || pkgs[0].PkgPath == "" {
+		return "", fmt.Errorf("package in %v not found", dir)
+	}
+	return pkgs[0].PkgPath, nil
+}
+
+// genAnnotated generates the templates named by the //rei:gen annotations
+// of the types of the package in dir into the directory outDir.
+// The names of the generated files are written to out.
+func genAnnotated(dir, outDir string, templates map[string]*namedTemplate, out io.Writer, opts genOptions) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	outDir, err = filepath.Abs(outDir)
+	if err != nil {
+		return err
+	}
+	pkgName, annotated, err := annotatedTypes(dir)
+	if err != nil {
+		return err
+	}
+	if len(annotated) == 0 {
+		return nil
+	}
+	// Types of the package generated into are referred to without a package.
+	var pkgPath string
+	if dir != outDir {
+		pkgPath, err = importPath(dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	opts.Dir = outDir
+	seen := make(map[string]string)
+	for _, at := range annotated {
+		for _, name := range at.templates {
+			t, ok := templates[name]
+			if !ok {
+				return fmt.Errorf("%v: unknown template %v, set it with -t %v=path", at.pos, name, name)
+			}
+			param, err := t.parameter()
+			if err != nil {
+				return err
+			}
+			template, err := filepath.Abs(t.path)
+			if err != nil {
+				return err
+			}
+			gType := &Type{Name: at.name}
+			if pkgPath != "" {
+				gType.Pkg = pkgPath
+				gType.PkgName = pkgName
+				gType.Aliased = path.Base(pkgPath) != pkgName
+			}
+			typeMapping := map[string]*Type{param: gType}
+
+			filename := filepath.Join(outDir, "rei_"+name+"_"+strings.ToLower(at.name)+".go")
+			targetPackageName := targetPackage(template, outDir)
+			if targetPackageName == "" {
+				targetPackageName, err = packageName(template)
+				if err != nil {
+					return err
+				}
+			}
+			src, err := os.Open(template)
+			if err != nil {
+				return err
+			}
+			buffer := &bytes.Buffer{}
+			err = gen(src, template, targetPackageName, typeMapping, buffer, filename, opts)
+			src.Close()
+			if err != nil {
+				return errors.Wrap(err, fmt.Sprintf("%v: generating %v failed", at.pos, name))
+			}
+			if err := ioutil.WriteFile(filename, buffer.Bytes(), 0644); err != nil {
+				return err
+			}
+			fmt.Fprintln(out, filename)
+			if err := generateUses(template, typeMapping, outDir, targetPackageName, opts, seen); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func genMain(args []string) {
+	templates := make(templateFlags)
+	flags := flag.NewFlagSet(myName+" gen", flag.ExitOnError)
+	flags.Var(templates, "t", "template the annotations refer to, as name=path[:Param], can be repeated")
+	outDir := flags.String("out", ".", "directory to generate into")
+	sourceOrder := flags.Bool("sourceorder", true, "keep the declaration order and grouping of the source file")
+	flags.Usage = usage
+	flags.Parse(args)
+	if flags.NArg() == 0 || len(templates) == 0 {
+		usage()
+		os.Exit(exitcodeInvalidArgs)
+	}
+
+	opts := genOptions{
+		SourceOrder: *sourceOrder,
+		Warnings:    os.Stderr,
+	}
+	for _, dir := range flags.Args() {
+		err := genAnnotated(dir, *outDir, templates, os.Stdout, opts)
+		if _, ok := errors.Cause(err).(*mappingError); ok {
+			fatal(exitcodeMappingMismatch, err)
+		}
+		if err != nil {
+			fatal(exitcodeGenFailed, err)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseNamedTemplate(t *testing.T) {
+	assert := assert.New(t)
+	testCases := []struct {
+		input    string
+		ok       bool
+		expected *namedTemplate
+	}{
+		{"dao=templates/dao.go", true, &namedTemplate{name: "dao", path: "templates/dao.go"}},
+		{"cache=../cache.go:Value", true, &namedTemplate{name: "cache", path: "../cache.go", param: "Value"}},
+		{"dao", false, nil},
+		{"dao=", false, nil},
+		{"1dao=dao.go", false, nil},
+		{"dao=dao.go:1Type", false, nil},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.input, func(t *testing.T) {
+			tmpl, err := parseNamedTemplate(tc.input)
+			assert.Equal(tc.ok, err == nil, fmt.Sprintf("%v: %v", tc.input, err))
+			if tc.ok {
+				assert.Equal(tc.expected, tmpl, tc.input)
+			}
+		})
+	}
+}
+
+func TestGenAnnotated(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "rei")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"dao.go": `package models
+
+type Type struct{}
+
+type TypeDAO struct {
+	m Type
+}
+`,
+		"cache.go": `//rei:param Value
+
+package models
+
+type Value struct{}
+
+type ValueCache map[int64]*Value
+`,
+		"models.go": `package models
+
+//rei:gen dao,cache
+type User struct{}
+
+type Order struct{}
+
+//rei:gen cache
+type (
+	Item struct{}
+
+	//rei:gen dao
+	Stock struct{}
+)
+`,
+	}
+	for name, src := range files {
+		if !assert.NoError(ioutil.WriteFile(filepath.Join(dir, name), []byte(src), 0644)) {
+			return
+		}
+	}
+
+	templates := map[string]*namedTemplate{
+		"dao":   {name: "dao", path: filepath.Join(dir, "dao.go")},
+		"cache": {name: "cache", path: filepath.Join(dir, "cache.go")},
+	}
+	out := &bytes.Buffer{}
+	err = genAnnotated(dir, dir, templates, out, genOptions{SourceOrder: true})
+	if !assert.NoError(err) {
+		return
+	}
+	var expectedOut string
+	for _, name := range []string{"rei_dao_user.go", "rei_cache_user.go", "rei_cache_item.go", "rei_cache_stock.go", "rei_dao_stock.go"} {
+		expectedOut += filepath.Join(dir, name) + "\n"
+	}
+	assert.Equal(expectedOut, out.String())
+
+	generated, err := ioutil.ReadFile(filepath.Join(dir, "rei_cache_user.go"))
+	if assert.NoError(err) {
+		assert.Equal(`// Code generated by rei. DO NOT EDIT.
+
+package models
+
+type UserCache map[int64]*User
+`, string(generated))
+	}
+
+	delete(templates, "cache")
+	err = genAnnotated(dir, dir, templates, out, genOptions{SourceOrder: true})
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "unknown template cache")
+	}
+}
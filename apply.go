@@ -148,6 +148,10 @@ func (a *application) apply(parent ast.Node, name string, index int, n ast.Node)
 		a.apply(n, "X", -1, n.X)
 		a.apply(n, "Index", -1, n.Index)
 
+	case *ast.IndexListExpr:
+		a.apply(n, "X", -1, n.X)
+		a.applyExprList(n, "Indices", n.Indices)
+
 	case *ast.SliceExpr:
 		a.apply(n, "X", -1, n.X)
 		a.apply(n, "Low", -1, n.Low)
@@ -185,6 +189,7 @@ func (a *application) apply(parent ast.Node, name string, index int, n ast.Node)
 		a.apply(n, "Fields", -1, n.Fields)
 
 	case *ast.FuncType:
+		a.apply(n, "TypeParams", -1, n.TypeParams)
 		a.apply(n, "Params", -1, n.Params)
 		a.apply(n, "Results", -1, n.Results)
 
@@ -297,6 +302,7 @@ func (a *application) apply(parent ast.Node, name string, index int, n ast.Node)
 	case *ast.TypeSpec:
 		a.apply(n, "Doc", -1, n.Doc)
 		a.apply(n, "Name", -1, n.Name)
+		a.apply(n, "TypeParams", -1, n.TypeParams)
 		a.apply(n, "Type", -1, n.Type)
 		a.apply(n, "Comment", -1, n.Comment)
 
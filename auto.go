@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+
+	"github.com/pkg/errors"
+)
+
+// maxAutoRounds limits how many times the packages are reloaded
+// to find names used by the generated instantiations.
+const maxAutoRounds = 10
+
+// namePart is a fragment of a declaration name of a template:
+// either a literal or a parameter.
+type namePart struct {
+	literal string
+	param   string
+	// lower is set if the parameter appears with a lowercase first letter.
+	lower bool
+}
+
+// namePattern is a declaration name of a template split into
+// literals and parameters, e.g. NewTypeSet is New, Type, Set.
+type namePattern []namePart
+
+// autoTemplate is a template registered for demand-driven instantiation
+// with a //rei:template directive in the consumer package:
+//
+//	//rei:template ../templates/set.go
+//
+// The path is relative to the directory of the file containing the directive.
+type autoTemplate struct {
+	path     string
+	params   []*Param
+	patterns []namePattern
+}
+
+// splitName splits a declaration name into a pattern.
+// Names that don't contain a parameter, or only consist of one, have no pattern.
+func splitName(name string, params []*Param) namePattern {
+	names := make([]string, 0, len(params))
+	for _, p := range params {
+		names = append(names, p.Name)
+	}
+	// Longer names first, so that a parameter that's a prefix
+	// of another one doesn't match first.
+	sort.Slice(names, func(i, j int) bool {
+		return len(names[i]) > len(names[j])
+	})
+
+	var pattern namePattern
+	hasParam, hasLiteral := false, false
+	literal := ""
+	for i := 0; i < len(name); {
+		matched := false
+		for _, p := range names {
+			lower := strings.HasPrefix(name[i:], lowerFirst(p))
+			if !lower && !strings.HasPrefix(name[i:], upperFirst(p)) {
+				continue
+			}
+			if literal != "" {
+				pattern = append(pattern, namePart{literal: literal})
+				literal = ""
+			}
+			pattern = append(pattern, namePart{param: p, lower: lower && lowerFirst(p) != upperFirst(p)})
+			i += len(p)
+			matched, hasParam = true, true
+			break
+		}
+		if !matched {
+			literal += name[i : i+1]
+			hasLiteral = true
+			i++
+		}
+	}
+	if literal != "" {
+		pattern = append(pattern, namePart{literal: literal})
+	}
+	if !hasParam || !hasLiteral {
+		return nil
+	}
+	return pattern
+}
+
+// match returns the possible parameter fragments of a name matching the pattern.
+func (pattern namePattern) match(name string) []map[string]string {
+	var matches []map[string]string
+	var walk func(parts namePattern, name string, fragments map[string]string)
+	walk = func(parts namePattern, name string, fragments map[string]string) {
+		if len(parts) == 0 {
+			if name == "" {
+				m := make(map[string]string, len(fragments))
+				for k, v := range fragments {
+					m[k] = v
+				}
+				matches = append(matches, m)
+			}
+			return
+		}
+		part := parts[0]
+		if part.param == "" {
+			if strings.HasPrefix(name, part.literal) {
+				walk(parts[1:], name[len(part.literal):], fragments)
+			}
+			return
+		}
+		for end := 1; end <= len(name); end++ {
+			fragment := name[:end]
+			if part.lower != (lowerFirst(fragment) == fragment) {
+				continue
+			}
+			fragment = upperFirst(fragment)
+			if prev, ok := fragments[part.param]; ok {
+				if prev == fragment {
+					walk(parts[1:], name[end:], fragments)
+				}
+				continue
+			}
+			fragments[part.param] = fragment
+			walk(parts[1:], name[end:], fragments)
+			delete(fragments, part.param)
+		}
+	}
+	walk(pattern, name, make(map[string]string))
+	return matches
+}
+
+// loadAutoTemplate parses a template and the name patterns of its declarations.
+func loadAutoTemplate(path string) (*autoTemplate, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, path, nil, parser.ParseComments)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing file failed")
+	}
+	params, err := parseParams(fset, file)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing parameters failed")
+	}
+	if len(params) == 0 {
+		return nil, fmt.Errorf("%v does not declare parameters", path)
+	}
+	t := &autoTemplate{
+		path:   path,
+		params: params,
+	}
+	for _, decl := range file.Decls {
+		var nodes []ast.Node
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			nodes = append(nodes, d)
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				nodes = append(nodes, spec)
+			}
+		}
+		for _, n := range nodes {
+			for _, ident := range declNames(n) {
+				if pattern := splitName(ident.Name, params); pattern != nil {
+					t.patterns = append(t.patterns, pattern)
+				}
+			}
+		}
+	}
+	return t, nil
+}
+
+// resolveFragment returns the concrete type a fragment of a name refers to,
+// looked up in the universe, in the consumer package, and in the packages
+// it imports. Exported types of imported packages are referred to either
+// by their name, e.g. User for models.User, or qualified with the package's
+// name, e.g. ModelsUser. A fragment matching several imported types is not resolved.
+func resolveFragment(pkg *types.Package, fragment string) *Type {
+	for lit := range literalTypes {
+		if upperFirst(valueName(lit)) == fragment {
+			return &Type{Name: lit}
+		}
+	}
+	for _, name := range []string{lowerFirst(fragment), fragment} {
+		if _, ok := types.Universe.Lookup(name).(*types.TypeName); ok {
+			return &Type{Name: name}
+		}
+		if pkg == nil {
+			continue
+		}
+		if _, ok := pkg.Scope().Lookup(name).(*types.TypeName); ok {
+			return &Type{Name: name}
+		}
+	}
+	if pkg == nil {
+		return nil
+	}
+	var found []*Type
+	for _, imp := range pkg.Imports() {
+		names := []string{fragment}
+		if prefix := upperFirst(imp.Name()); strings.HasPrefix(fragment, prefix) {
+			names = append(names, strings.TrimPrefix(fragment, prefix))
+		}
+		for i, name := range names {
+			if obj, ok := imp.Scope().Lookup(name).(*types.TypeName); !ok || !obj.Exported() {
+				continue
+			}
+			found = append(found, &Type{
+				Pkg:       imp.Path(),
+				PkgName:   imp.Name(),
+				Name:      name,
+				Aliased:   imp.Name() != path.Base(imp.Path()),
+				Qualified: i > 0,
+			})
+		}
+	}
+	if len(found) != 1 {
+		return nil
+	}
+	return found[0]
+}
+
+// instantiations returns the type mappings of the template
+// whose instantiation would declare name.
+func (t *autoTemplate) instantiations(pkg *types.Package, name string) []map[string]*Type {
+	var mappings []map[string]*Type
+	seen := make(map[string]bool)
+	for _, pattern := range t.patterns {
+	matches:
+		for _, fragments := range pattern.match(name) {
+			mapping := make(map[string]*Type, len(fragments))
+			for param, fragment := range fragments {
+				gType := resolveFragment(pkg, fragment)
+				if gType == nil {
+					continue matches
+				}
+				mapping[param] = gType
+			}
+			// Parameters that are not part of the name need a default.
+			if err := applyParams(t.params, mapping); err != nil {
+				continue
+			}
+			key := instanceKey(t.path, mapping)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			mappings = append(mappings, mapping)
+		}
+	}
+	return mappings
+}
+
+// registeredTemplates returns the templates registered with
+// //rei:template directives in the files of the package.
+func registeredTemplates(pkg *packages.Package) ([]*autoTemplate, error) {
+	var templates []*autoTemplate
+	seen := make(map[string]bool)
+	for _, file := range pkg.Syntax {
+		dir := filepath.Dir(pkg.Fset.Position(file.Pos()).Filename)
+		for _, cg := range file.Comments {
+			for _, c := range cg.List {
+				if !strings.HasPrefix(c.Text, directivePrefix+"template ") {
+					continue
+				}
+				path := strings.TrimSpace(strings.TrimPrefix(c.Text, directivePrefix+"template "))
+				if !filepath.IsAbs(path) {
+					path = filepath.Join(dir, path)
+				}
+				if seen[path] {
+					continue
+				}
+				seen[path] = true
+				t, err := loadAutoTemplate(path)
+				if err != nil {
+					return nil, errors.Wrap(err, pkg.Fset.Position(c.Pos()).String())
+				}
+				templates = append(templates, t)
+			}
+		}
+	}
+	return templates, nil
+}
+
+// undefinedNames returns the undefined names the package refers to:
+// the identifiers that type checking reported an error at,
+// and that don't refer to an object.
+// Selected fields, methods and names of other packages,
+// and the field names of struct literals are not names of the package.
+func undefinedNames(pkg *packages.Package) []string {
+	errs := make(map[token.Pos]bool)
+	for _, err := range pkg.TypeErrors {
+		errs[err.Pos] = true
+	}
+	seen := make(map[string]bool)
+	var names []string
+	var inspect func(n ast.Node) bool
+	inspect = func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.SelectorExpr:
+			ast.Inspect(n.X, inspect)
+			return false
+		case *ast.CompositeLit:
+			if tv, ok := pkg.TypesInfo.Types[n]; !ok || tv.Type == nil {
+				return true
+			} else if _, ok := tv.Type.Underlying().(*types.Struct); !ok {
+				return true
+			}
+			if n.Type != nil {
+				ast.Inspect(n.Type, inspect)
+			}
+			for _, elt := range n.Elts {
+				if kv, ok := elt.(*ast.KeyValueExpr); ok {
+					elt = kv.Value
+				}
+				ast.Inspect(elt, inspect)
+			}
+			return false
+		case *ast.Ident:
+			if !errs[n.Pos()] || seen[n.Name] || n.Name == "_" {
+				return true
+			}
+			if pkg.TypesInfo.Uses[n] != nil || pkg.TypesInfo.Defs[n] != nil {
+				return true
+			}
+			seen[n.Name] = true
+			names = append(names, n.Name)
+		}
+		return true
+	}
+	for _, file := range pkg.Syntax {
+		ast.Inspect(file, inspect)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// auto generates the instantiations of the registered templates
+// that the packages matching the patterns refer to but don't declare yet.
+// The names of the generated files are written to out.
+func auto(patterns []string, out io.Writer, opts genOptions) error {
+	seen := make(map[string]string)
+	for round := 0; round < maxAutoRounds; round++ {
+		pkgs, err := loadPackages(opts.Dir, patterns...)
+		if err != nil {
+			return err
+		}
+		generated := 0
+		for _, pkg := range pkgs {
+			n, err := autoPackage(pkg, out, opts, seen)
+			if err != nil {
+				return err
+			}
+			generated += n
+		}
+		if generated == 0 {
+			return nil
+		}
+	}
+	return fmt.Errorf("instantiations still missing after %v rounds", maxAutoRounds)
+}
+
+// autoPackage generates the missing instantiations of a package,
+// and returns how many were generated.
+func autoPackage(pkg *packages.Package, out io.Writer, opts genOptions, seen map[string]string) (int, error) {
+	if len(pkg.GoFiles) == 0 {
+		return 0, nil
+	}
+	templates, err := registeredTemplates(pkg)
+	if err != nil || len(templates) == 0 {
+		return 0, err
+	}
+	dir := filepath.Dir(pkg.GoFiles[0])
+	opts.Dir = dir
+
+	generated := 0
+	for _, name := range undefinedNames(pkg) {
+		var candidates []*autoTemplate
+		var mappings []map[string]*Type
+		for _, t := range templates {
+			for _, m := range t.instantiations(pkg.Types, name) {
+				candidates = append(candidates, t)
+				mappings = append(mappings, m)
+			}
+		}
+		if len(candidates) == 0 {
+			continue
+		}
+		if len(candidates) > 1 {
+			if opts.Warnings != nil {
+				fmt.Fprintf(opts.Warnings, "%v: %v matches both %v and %v, not generated\n",
+					pkg.PkgPath, name, instanceKey(candidates[0].path, mappings[0]), instanceKey(candidates[1].path, mappings[1]))
+			}
+			continue
+		}
+		template, mapping := candidates[0], mappings[0]
+		filename := filepath.Join(dir, instanceFilename(template.path, mapping))
+		if _, ok := seen[filename]; ok {
+			continue
+		}
+		seen[filename] = instanceKey(template.path, mapping)
+
+		src, err := os.Open(template.path)
+		if err != nil {
+			return generated, err
+		}
+		buffer := &bytes.Buffer{}
+		err = gen(src, template.path, pkg.Name, mapping, buffer, filename, opts)
+		src.Close()
+		if err != nil {
+			return generated, errors.Wrap(err, fmt.Sprintf("generating %v for %v failed", filename, name))
+		}
+		if err := ioutil.WriteFile(filename, buffer.Bytes(), 0644); err != nil {
+			return generated, err
+		}
+		fmt.Fprintln(out, filename)
+		generated++
+		if err := generateUses(template.path, mapping, dir, pkg.Name, opts, seen); err != nil {
+			return generated, err
+		}
+	}
+	return generated, nil
+}
+
+func autoMain(args []string) {
+	if len(args) == 0 {
+		args = []string{"."}
+	}
+	opts := genOptions{
+		SourceOrder: true,
+		Warnings:    os.Stderr,
+	}
+	err := auto(args, os.Stdout, opts)
+	if _, ok := errors.Cause(err).(*mappingError); ok {
+		fatal(exitcodeMappingMismatch, err)
+	}
+	if err != nil {
+		fatal(exitcodeGenFailed, err)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNamePattern(t *testing.T) {
+	assert := assert.New(t)
+	params := []*Param{{Name: "Key"}, {Name: "Value"}, {Name: "Type"}}
+	testCases := []struct {
+		pattern  string
+		name     string
+		expected []map[string]string
+	}{
+		{"NewTypeSet", "NewUserSet", []map[string]string{{"Type": "User"}}},
+		{"NewTypeSet", "NewSet", nil},
+		{"NewTypeSet", "NewUserList", nil},
+		{"typeSet", "int64Set", []map[string]string{{"Type": "Int64"}}},
+		{"typeSet", "Int64Set", nil},
+		{"KeyValueMap", "UserIntMap", []map[string]string{{"Key": "User", "Value": "Int"}}},
+		{"KeyValueMap", "HTTPIntMap", []map[string]string{
+			{"Key": "H", "Value": "TTPInt"},
+			{"Key": "HT", "Value": "TPInt"},
+			{"Key": "HTT", "Value": "PInt"},
+			{"Key": "HTTP", "Value": "Int"},
+		}},
+		{"TypeToType", "IntToInt", []map[string]string{{"Type": "Int"}}},
+		{"TypeToType", "IntToString", nil},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.pattern+" "+tc.name, func(t *testing.T) {
+			pattern := splitName(tc.pattern, params)
+			if !assert.NotNil(pattern, tc.pattern) {
+				return
+			}
+			assert.Equal(tc.expected, pattern.match(tc.name), tc.name)
+		})
+	}
+
+	assert.Nil(splitName("Type", params))
+	assert.Nil(splitName("helper", params))
+}
+
+func TestAuto(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "rei")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"go.mod": "module example.com/auto\n",
+		"templates/map.go": `//rei:param Key
+//rei:param Value
+
+package templates
+
+type Key int
+type Value int
+
+type KeyValueMap map[Key]Value
+`,
+		"models/models.go": `package models
+
+type User struct{}
+type Group struct{}
+`,
+		"app/main.go": `package main
+
+import "example.com/auto/models"
+
+//rei:template ../templates/map.go
+
+type User struct{}
+
+type A int
+type AB int
+type B int
+type BB int
+
+var users StringUserMap
+var ambiguous ABBMap
+var unknown FooBarMap
+var groups StringGroupMap
+var modelUsers StringModelsUserMap
+var _ models.User
+var _ = User{IntIntMap: 1}
+var _ = users.StringIntMap
+
+func main() {
+}
+`,
+	}
+	for name, src := range files {
+		filename := filepath.Join(dir, name)
+		if !assert.NoError(os.MkdirAll(filepath.Dir(filename), 0755)) {
+			return
+		}
+		if !assert.NoError(ioutil.WriteFile(filename, []byte(src), 0644)) {
+			return
+		}
+	}
+
+	out := &bytes.Buffer{}
+	warnings := &bytes.Buffer{}
+	err = auto([]string{"./..."}, out, genOptions{Dir: dir, SourceOrder: true, Warnings: warnings})
+	if !assert.NoError(err) {
+		return
+	}
+	expected := map[string]string{
+		"rei_templates_map_string_group.go": `// Code generated by rei. DO NOT EDIT.
+
+package main
+
+import "example.com/auto/models"
+
+type StringGroupMap map[string]models.Group
+`,
+		"rei_templates_map_string_modelsuser.go": `// Code generated by rei. DO NOT EDIT.
+
+package main
+
+import "example.com/auto/models"
+
+type StringModelsUserMap map[string]models.User
+`,
+		"rei_templates_map_string_user.go": `// Code generated by rei. DO NOT EDIT.
+
+package main
+
+type StringUserMap map[string]User
+`,
+	}
+	assert.Equal(filepath.Join(dir, "app", "rei_templates_map_string_group.go")+"\n"+
+		filepath.Join(dir, "app", "rei_templates_map_string_modelsuser.go")+"\n"+
+		filepath.Join(dir, "app", "rei_templates_map_string_user.go")+"\n", out.String())
+	assert.Contains(warnings.String(), "ABBMap matches both")
+
+	for name, src := range expected {
+		generated, err := ioutil.ReadFile(filepath.Join(dir, "app", name))
+		if assert.NoError(err) {
+			assert.Equal(src, string(generated), name)
+		}
+	}
+
+	// The instantiation exists now, running again doesn't generate anything.
+	out.Reset()
+	err = auto([]string{"./..."}, out, genOptions{Dir: dir, SourceOrder: true})
+	if assert.NoError(err) {
+		assert.Equal("", out.String())
+	}
+}
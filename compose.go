@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Use is a template used by another template, declared in the template's header
+// with a //rei:uses directive:
+//
+//	//rei:uses ../orderedmap/map.go Key=Type Value=struct{}
+//
+// The path is relative to the directory of the using template.
+// The mapping can refer to the parameters of the using template.
+type Use struct {
+	Path    string
+	Mapping map[string]string
+}
+
+// parseUse parses the arguments of a //rei:uses directive.
+func parseUse(s string) (*Use, error) {
+	args, err := splitArgs(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) < 2 {
+		return nil, fmt.Errorf("invalid use %v, expected template path and type mapping", s)
+	}
+	u := &Use{
+		Path:    args[0],
+		Mapping: make(map[string]string),
+	}
+	for _, arg := range args[1:] {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid mapping %v, expected Type=ConcreteType", arg)
+		}
+		if _, ok := u.Mapping[parts[0]]; ok {
+			return nil, fmt.Errorf("duplicate mapping for template type %v", parts[0])
+		}
+		u.Mapping[parts[0]] = parts[1]
+	}
+	return u, nil
+}
+
+// parseUses returns the templates used by the template.
+func parseUses(fset *token.FileSet, file *ast.File) ([]*Use, error) {
+	var uses []*Use
+	err := headerDirective(fset, file, "uses", func(args string) error {
+		u, err := parseUse(args)
+		if err != nil {
+			return err
+		}
+		uses = append(uses, u)
+		return nil
+	})
+	return uses, err
+}
+
+// resolve returns the type mapping of the used template.
+// Values naming a parameter of the using template, optionally as a pointer,
+// are replaced with the parameter's concrete type.
+func (u *Use) resolve(typeMapping map[string]*Type) (map[string]*Type, error) {
+	mapping := make(map[string]*Type, len(u.Mapping))
+	for name, value := range u.Mapping {
+		pointer := strings.HasPrefix(value, "*")
+		if gType, ok := typeMapping[strings.TrimPrefix(value, "*")]; ok {
+			t := *gType
+			if pointer {
+				if t.Pointer {
+					return nil, fmt.Errorf("%v=%v is a pointer to a pointer", name, value)
+				}
+				t.Pointer = true
+			}
+			mapping[name] = &t
+			continue
+		}
+		t, err := ParseType(value)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("in mapping %v=%v", name, value))
+		}
+		mapping[name] = &t
+	}
+	return mapping, nil
+}
+
+// instanceFilename returns the name of the file an instantiation of the
+// template is generated into, e.g. rei_orderedmap_map_string_struct.go
+// for orderedmap/map.go. The template's directory is part of the name,
+// so that templates with the same name in different directories don't collide.
+// Instantiations of the same template with the same types
+// are generated into the same file.
+func instanceFilename(template string, typeMapping map[string]*Type) string {
+	names := make([]string, 0, len(typeMapping))
+	for name := range typeMapping {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := []string{"rei"}
+	if abs, err := filepath.Abs(template); err == nil {
+		parts = append(parts, strings.ToLower(filepath.Base(filepath.Dir(abs))))
+	}
+	parts = append(parts, strings.TrimSuffix(filepath.Base(template), ".go"))
+	for _, name := range names {
+		t := typeMapping[name]
+		part := strings.ToLower(valueName(t.Name))
+		if t.Qualified {
+			part = strings.ToLower(t.PkgName) + part
+		}
+		if t.Pointer {
+			part = "ptr" + part
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, "_") + ".go"
+}
+
+// instanceKey identifies an instantiation of a template.
+func instanceKey(template string, typeMapping map[string]*Type) string {
+	names := make([]string, 0, len(typeMapping))
+	for name := range typeMapping {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	key := filepath.Clean(template)
+	for _, name := range names {
+		key += " " + name + "=" + typeMapping[name].String()
+	}
+	return key
+}
+
+// packageName returns the name of the package the file belongs to.
+func packageName(filename string) (string, error) {
+	file, err := parser.ParseFile(token.NewFileSet(), filename, nil, parser.PackageClauseOnly)
+	if err != nil {
+		return "", err
+	}
+	return file.Name.Name, nil
+}
+
+// templateUses returns the templates used by the template file in.
+func templateUses(in string) ([]*Use, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, in, nil, parser.ParseComments)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing file failed")
+	}
+	uses, err := parseUses(fset, file)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing used templates failed")
+	}
+	return uses, nil
+}
+
+// generateUses generates the instantiations of the templates used by the
+// template in into the directory dir, whose package is packageName,
+// and then the templates used by those, recursively.
+// typeMapping is the type mapping the template was instantiated with.
+// seen holds the instantiations already generated by their filenames,
+// each is only generated once.
+// Instantiations already present in dir, e.g. generated by a previous run
+// or for another template, are reused. Delete them to regenerate them.
+func generateUses(in string, typeMapping map[string]*Type, dir, packageName string, opts genOptions, seen map[string]string) error {
+	uses, err := templateUses(in)
+	if err != nil {
+		return err
+	}
+	for _, u := range uses {
+		template := filepath.Join(filepath.Dir(in), u.Path)
+		mapping, err := u.resolve(typeMapping)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("%v: resolving use of %v failed", in, u.Path))
+		}
+		key := instanceKey(template, mapping)
+		out := filepath.Join(dir, instanceFilename(template, mapping))
+		if prev, ok := seen[out]; ok {
+			if prev != key {
+				return fmt.Errorf("%v: %v and %v are both generated into %v", in, prev, key, out)
+			}
+			continue
+		}
+		seen[out] = key
+
+		if _, err := os.Stat(out); err != nil {
+			if !os.IsNotExist(err) {
+				return err
+			}
+			src, err := os.Open(template)
+			if err != nil {
+				return err
+			}
+			buffer := &bytes.Buffer{}
+			err = gen(src, template, packageName, mapping, buffer, out, opts)
+			src.Close()
+			if err != nil {
+				return errors.Wrap(err, fmt.Sprintf("generating %v failed", out))
+			}
+			if err := ioutil.WriteFile(out, buffer.Bytes(), 0644); err != nil {
+				return err
+			}
+		}
+		if err := generateUses(template, mapping, dir, packageName, opts, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
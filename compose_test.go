@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseUse(t *testing.T) {
+	assert := assert.New(t)
+	testCases := []struct {
+		input    string
+		ok       bool
+		expected *Use
+	}{
+		{"../orderedmap/map.go Key=Type Value=struct{}", true, &Use{
+			Path:    "../orderedmap/map.go",
+			Mapping: map[string]string{"Key": "Type", "Value": "struct{}"},
+		}},
+		{`"my maps/map.go" Key=*Type`, true, &Use{
+			Path:    "my maps/map.go",
+			Mapping: map[string]string{"Key": "*Type"},
+		}},
+		{"../orderedmap/map.go", false, nil},
+		{"../orderedmap/map.go Key", false, nil},
+		{"../orderedmap/map.go Key=Type Key=int", false, nil},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.input, func(t *testing.T) {
+			u, err := parseUse(tc.input)
+			assert.Equal(tc.ok, err == nil, fmt.Sprintf("%v: %v", tc.input, err))
+			if tc.ok {
+				assert.Equal(tc.expected, u, tc.input)
+			}
+		})
+	}
+}
+
+func TestResolveUse(t *testing.T) {
+	assert := assert.New(t)
+	typeMapping := map[string]*Type{
+		"Type":    {Pkg: "time", PkgName: "time", Name: "Time"},
+		"Pointer": {Name: "User", Pointer: true},
+	}
+	testCases := []struct {
+		mapping  map[string]string
+		ok       bool
+		expected map[string]*Type
+	}{
+		{map[string]string{"Key": "Type", "Value": "struct{}"}, true, map[string]*Type{
+			"Key":   {Pkg: "time", PkgName: "time", Name: "Time"},
+			"Value": {Name: "struct{}"},
+		}},
+		{map[string]string{"Key": "*Type", "Value": "int"}, true, map[string]*Type{
+			"Key":   {Pkg: "time", PkgName: "time", Name: "Time", Pointer: true},
+			"Value": {Name: "int"},
+		}},
+		{map[string]string{"Key": "*Pointer"}, false, nil},
+		{map[string]string{"Key": "1Type"}, false, nil},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		name := fmt.Sprint(tc.mapping)
+		t.Run(name, func(t *testing.T) {
+			u := &Use{Path: "map.go", Mapping: tc.mapping}
+			mapping, err := u.resolve(typeMapping)
+			assert.Equal(tc.ok, err == nil, fmt.Sprintf("%v: %v", name, err))
+			if tc.ok {
+				assert.Equal(tc.expected, mapping, name)
+			}
+		})
+	}
+}
+
+func TestInstanceFilename(t *testing.T) {
+	assert := assert.New(t)
+	testCases := []struct {
+		template string
+		mapping  map[string]*Type
+		expected string
+	}{
+		{"../orderedmap/map.go", map[string]*Type{
+			"Value": {Name: "struct{}"},
+			"Key":   {Name: "string"},
+		}, "rei_orderedmap_map_string_struct.go"},
+		{"../hashmap/map.go", map[string]*Type{
+			"Value": {Name: "struct{}"},
+			"Key":   {Name: "string"},
+		}, "rei_hashmap_map_string_struct.go"},
+		{"templates/list.go", map[string]*Type{
+			"Type": {Pkg: "time", PkgName: "time", Name: "Time", Pointer: true},
+		}, "rei_templates_list_ptrtime.go"},
+	}
+	for _, tc := range testCases {
+		assert.Equal(tc.expected, instanceFilename(tc.template, tc.mapping), tc.template)
+	}
+}
+
+func TestGenerateUses(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "rei")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	templates := map[string]string{
+		"orderedmap/map.go": `//rei:param Key
+//rei:param Value
+
+package orderedmap
+
+type Key int
+type Value int
+
+type KeyValueOrderedMap struct {
+	keys   []Key
+	values map[Key]Value
+}
+`,
+		"orderedset/set.go": `//rei:param Type
+//rei:uses ../orderedmap/map.go Key=Type Value=struct{}
+
+package orderedset
+
+type Type int
+
+type TypeOrderedSet struct {
+	m TypeStructOrderedMap
+}
+`,
+		"orderedset/bag.go": `//rei:param Type
+//rei:uses set.go Type=Type
+//rei:uses ../orderedmap/map.go Key=Type Value=struct{}
+
+package orderedset
+
+type Type int
+
+type TypeBag struct {
+	set TypeOrderedSet
+}
+`,
+	}
+	for name, src := range templates {
+		filename := filepath.Join(dir, name)
+		if !assert.NoError(os.MkdirAll(filepath.Dir(filename), 0755)) {
+			return
+		}
+		if !assert.NoError(ioutil.WriteFile(filename, []byte(src), 0644)) {
+			return
+		}
+	}
+	out := filepath.Join(dir, "out")
+	if !assert.NoError(os.MkdirAll(out, 0755)) {
+		return
+	}
+
+	// Existing instantiations are reused.
+	existing := filepath.Join(out, "rei_orderedmap_map_int_struct.go")
+	if !assert.NoError(ioutil.WriteFile(existing, []byte("package out\n"), 0644)) {
+		return
+	}
+	err = generateUses(filepath.Join(dir, "orderedset/set.go"), map[string]*Type{
+		"Type": {Name: "int"},
+	}, out, "out", genOptions{Dir: out}, make(map[string]string))
+	if !assert.NoError(err) {
+		return
+	}
+	reused, err := ioutil.ReadFile(existing)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal("package out\n", string(reused))
+	if !assert.NoError(os.Remove(existing)) {
+		return
+	}
+
+	typeMapping := map[string]*Type{
+		"Type": {Name: "string"},
+	}
+	err = generateUses(filepath.Join(dir, "orderedset/bag.go"), typeMapping, out, "out", genOptions{Dir: out}, make(map[string]string))
+	if !assert.NoError(err) {
+		return
+	}
+
+	files, err := ioutil.ReadDir(out)
+	if !assert.NoError(err) {
+		return
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	assert.Equal([]string{"rei_orderedmap_map_string_struct.go", "rei_orderedset_set_string.go"}, names)
+
+	set, err := ioutil.ReadFile(filepath.Join(out, "rei_orderedset_set_string.go"))
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal(`// Code generated by rei. DO NOT EDIT.
+
+package out
+
+type StringOrderedSet struct {
+	m StringStructOrderedMap
+}
+`, string(set))
+	m, err := ioutil.ReadFile(filepath.Join(out, "rei_orderedmap_map_string_struct.go"))
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal(`// Code generated by rei. DO NOT EDIT.
+
+package out
+
+type StringStructOrderedMap struct {
+	keys   []string
+	values map[string]struct{}
+}
+`, string(m))
+}
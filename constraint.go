@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/types"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// constraint is a requirement on the concrete type of a generic type.
+// The following constraints are supported:
+//
+//	comparable
+//	ordered
+//	numeric
+//	implements {type}
+//	struct with field {name} {type}
+type constraint struct {
+	text string
+	// where is the position the constraint is declared at.
+	where string
+
+	kind      string
+	typ       *Type  // implements
+	fieldName string // struct with field
+	fieldType string // struct with field
+}
+
+func parseConstraint(text string) (*constraint, error) {
+	c := &constraint{
+		text: text,
+	}
+	fields := strings.Fields(text)
+	switch {
+	case len(fields) == 1 && (fields[0] == "comparable" || fields[0] == "ordered" || fields[0] == "numeric"):
+		c.kind = fields[0]
+	case len(fields) == 2 && fields[0] == "implements":
+		c.kind = fields[0]
+		tp, err := ParseType(fields[1])
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("invalid constraint %q", text))
+		}
+		c.typ = &tp
+	case len(fields) >= 5 && fields[0] == "struct" && fields[1] == "with" && fields[2] == "field":
+		c.kind = "field"
+		c.fieldName = fields[3]
+		if ok, _ := isIdentifier(c.fieldName); !ok {
+			return nil, fmt.Errorf("invalid constraint %q: %v is not a valid field name", text, c.fieldName)
+		}
+		// Normalize the field's type, e.g. "[] byte" and "[]byte" are the same.
+		fieldType := strings.Join(fields[4:], " ")
+		expr, err := parser.ParseExpr(fieldType)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("invalid constraint %q", text))
+		}
+		c.fieldType = types.ExprString(expr)
+	default:
+		return nil, fmt.Errorf("invalid constraint %q", text)
+	}
+	return c, nil
+}
+
+// satisfiedBy reports whether the concrete type t satisfies the constraint.
+func (c *constraint) satisfiedBy(l *typeLoader, t types.Type) (bool, error) {
+	switch c.kind {
+	case "comparable":
+		return types.Comparable(t), nil
+	case "ordered":
+		basic, ok := t.Underlying().(*types.Basic)
+		return ok && basic.Info()&types.IsOrdered != 0, nil
+	case "numeric":
+		basic, ok := t.Underlying().(*types.Basic)
+		return ok && basic.Info()&types.IsNumeric != 0, nil
+	case "implements":
+		it, err := l.lookup(c.typ)
+		if err != nil {
+			return false, err
+		}
+		iface, ok := it.Underlying().(*types.Interface)
+		if !ok {
+			return false, fmt.Errorf("%v is not an interface", c.typ)
+		}
+		return types.Implements(t, iface), nil
+	case "field":
+		st := t
+		if ptr, ok := st.(*types.Pointer); ok {
+			st = ptr.Elem()
+		}
+		if _, ok := st.Underlying().(*types.Struct); !ok {
+			return false, nil
+		}
+		obj, _, _ := types.LookupFieldOrMethod(st, false, nil, c.fieldName)
+		field, ok := obj.(*types.Var)
+		if !ok || !field.IsField() {
+			return false, nil
+		}
+		return types.TypeString(field.Type(), qualifyByName) == c.fieldType, nil
+	}
+	panic("invalid constraint kind " + c.kind)
+}
+
+// genericTypeSpecs returns the declarations of the generic types by name.
+func (gctx *genericContext) genericTypeSpecs() map[string]*ast.TypeSpec {
+	specs := make(map[string]*ast.TypeSpec)
+	for pos, spec := range gctx.types {
+		if !gctx.isGeneric[pos] {
+			continue
+		}
+		ts := spec.(*ast.TypeSpec)
+		specs[ts.Name.Name] = ts
+	}
+	return specs
+}
+
+// checkConstraints checks that the concrete types satisfy the constraints
+// declared in the template, either as a parameter's constraint,
+// or with //rei:constraint directives on the generic type's declaration.
+func (gctx *genericContext) checkConstraints(params []*Param) error {
+	constraints := make(map[string][]*constraint)
+	for _, p := range params {
+		if p.Constraint == "" {
+			continue
+		}
+		c, err := parseConstraint(p.Constraint)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("parameter %v", p.Name))
+		}
+		c.where = "parameter " + p.Name
+		constraints[p.Name] = append(constraints[p.Name], c)
+	}
+	for name, spec := range gctx.genericTypeSpecs() {
+		dirs := gctx.directives[spec]
+		if dirs == nil {
+			continue
+		}
+		for _, text := range dirs.constraints {
+			c, err := parseConstraint(text)
+			if err != nil {
+				return errors.Wrap(err, gctx.fset.Position(spec.Pos()).String())
+			}
+			c.where = gctx.fset.Position(spec.Pos()).String()
+			constraints[name] = append(constraints[name], c)
+		}
+	}
+
+	names := make([]string, 0, len(constraints))
+	for name := range constraints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		gType := gctx.genericTypes[name]
+		if gType == nil {
+			continue
+		}
+		if gType.Value != "" || gType.Package || gType.Ident || gctx.isFuncArg(name) {
+			return fmt.Errorf("only type parameters can have constraints, %v is not a type", name)
+		}
+		t, err := gctx.loader.lookup(gType)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("checking constraints of %v=%v failed", name, gType))
+		}
+		for _, c := range constraints[name] {
+			ok, err := c.satisfiedBy(gctx.loader, t)
+			if err != nil {
+				return errors.Wrap(err, fmt.Sprintf("checking constraint %q of %v failed", c.text, name))
+			}
+			if !ok {
+				return fmt.Errorf("%v=%v does not satisfy constraint %q (%v)", name, gType, c.text, c.where)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConstraints(t *testing.T) {
+	assert := assert.New(t)
+	l := newTypeLoader("")
+	testCases := []struct {
+		constraint string
+		concrete   string
+		ok         bool
+		satisfied  bool
+	}{
+		{"comparable", "string", true, true},
+		{"comparable", "error", true, true},
+		{"ordered", "float64", true, true},
+		{"ordered", "bool", true, false},
+		{"numeric", "complex128", true, true},
+		{"numeric", "string", true, false},
+		{"implements io.Reader", "*os.File", true, true},
+		{"implements io.Reader", "os.File", true, false},
+		{"implements fmt.Stringer", "time.Duration", true, true},
+		{"struct with field Name string", "*os.ProcAttr", true, false},
+		{"struct with field Dir string", "os.ProcAttr", true, true},
+		{"struct with field Files []*os.File", "*os.ProcAttr", true, true},
+		{"struct with field Dir int", "os.ProcAttr", true, false},
+		{"struct with field Dir string", "string", true, false},
+		{"implements", "string", false, false},
+		{"frobnicated", "string", false, false},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(fmt.Sprintf("%v %v", tc.concrete, tc.constraint), func(t *testing.T) {
+			c, err := parseConstraint(tc.constraint)
+			if err == nil {
+				var tp Type
+				tp, err = ParseType(tc.concrete)
+				assert.NoError(err)
+				typ, err := l.lookup(&tp)
+				assert.NoError(err)
+				var satisfied bool
+				satisfied, err = c.satisfiedBy(l, typ)
+				assert.Equal(tc.satisfied, satisfied, tc.constraint)
+			}
+			assert.Equal(tc.ok, err == nil, fmt.Sprintf("%v: %v", tc.constraint, err))
+		})
+	}
+}
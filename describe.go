@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// describe prints the parameters declared in the template file.
+func describe(filename string, out io.Writer) error {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, filename, nil, parser.ParseComments)
+	if err != nil {
+		return errors.Wrap(err, "parsing file failed")
+	}
+	params, err := parseParams(fset, file)
+	if err != nil {
+		return errors.Wrap(err, "parsing parameters failed")
+	}
+	if len(params) == 0 {
+		fmt.Fprintf(out, "%v does not declare parameters\n", filename)
+		return nil
+	}
+	fmt.Fprintf(out, "Parameters of %v:\n", filename)
+	for _, p := range params {
+		fmt.Fprintf(out, "  %v", p.Name)
+		if p.Doc != "" {
+			fmt.Fprintf(out, " - %v", p.Doc)
+		}
+		fmt.Fprintln(out)
+		if p.Constraint != "" {
+			fmt.Fprintf(out, "    constraint: %v\n", p.Constraint)
+		}
+		if p.Default != "" {
+			fmt.Fprintf(out, "    default:    %v\n", p.Default)
+		} else {
+			fmt.Fprintf(out, "    required\n")
+		}
+	}
+	return nil
+}
+
+func describeMain(args []string) {
+	if len(args) != 1 {
+		usage()
+		os.Exit(exitcodeInvalidArgs)
+	}
+	if err := describe(args[0], os.Stdout); err != nil {
+		fatal(exitcodeSourceFileInvalid, err)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+const directivePrefix = "//rei:"
+
+// directives holds the rei directives of a declaration.
+type directives struct {
+	// skip excludes the declaration from the output, even if it's dependant.
+	skip bool
+	// include adds the declaration to the output, even if it's not dependant.
+	include bool
+	// keep leaves the declaration's name unchanged.
+	keep bool
+	// name is the template of the declaration's generated name.
+	name *template.Template
+	// constraints are the constraints of a generic type.
+	constraints []string
+	// overrideTarget is the function the declaration overrides
+	// when the generic types are mapped to overrideMapping.
+	overrideTarget  string
+	overrideMapping map[string]*Type
+	// shims are the //rei:builtin directives of a generic type.
+	shims []*ast.Comment
+	// methods is the generic type the method is repeated for
+	// each interface method of, see methodLoop.
+	methods string
+}
+
+var directiveFuncs = template.FuncMap{
+	"lower": lowerFirst,
+	"upper": upperFirst,
+}
+
+// isDirective reports whether the comment is a rei directive.
+func isDirective(c *ast.Comment) bool {
+	return strings.HasPrefix(c.Text, directivePrefix)
+}
+
+// splitDirective splits a rei directive into its name and arguments.
+func splitDirective(c *ast.Comment) (name string, args string) {
+	text := strings.TrimPrefix(c.Text, directivePrefix)
+	parts := strings.SplitN(text, " ", 2)
+	name = parts[0]
+	if len(parts) > 1 {
+		args = strings.TrimSpace(parts[1])
+	}
+	return name, args
+}
+
+// parseDirectives parses the rei directives in the comment groups into d.
+func parseDirectives(d *directives, cgs ...*ast.CommentGroup) error {
+	for _, cg := range cgs {
+		if cg == nil {
+			continue
+		}
+		for _, c := range cg.List {
+			if !isDirective(c) {
+				continue
+			}
+			name, args := splitDirective(c)
+			if headerDirectives[name] || blockDirectives[name] {
+				continue
+			}
+			switch name {
+			case "skip":
+				d.skip = true
+			case "include":
+				d.include = true
+			case "keep":
+				d.keep = true
+			case "name":
+				if args == "" {
+					return fmt.Errorf("missing name in %v", c.Text)
+				}
+				tmpl, err := template.New(args).Funcs(directiveFuncs).Option("missingkey=error").Parse(args)
+				if err != nil {
+					return errors.Wrap(err, fmt.Sprintf("invalid name in %v", c.Text))
+				}
+				d.name = tmpl
+			case "constraint":
+				if args == "" {
+					return fmt.Errorf("missing constraint in %v", c.Text)
+				}
+				d.constraints = append(d.constraints, args)
+			case "builtin":
+				if args == "" {
+					return fmt.Errorf("missing shim in %v", c.Text)
+				}
+				d.shims = append(d.shims, c)
+			case "override":
+				target, mapping, err := parseOverride(args)
+				if err != nil {
+					return err
+				}
+				d.overrideTarget = target
+				d.overrideMapping = mapping
+			case "methods":
+				if args == "" {
+					return fmt.Errorf("missing type in %v", c.Text)
+				}
+				d.methods = args
+			default:
+				return fmt.Errorf("unknown directive %v", c.Text)
+			}
+		}
+	}
+	if d.skip && d.include {
+		return fmt.Errorf("%vskip and %vinclude are mutually exclusive", directivePrefix, directivePrefix)
+	}
+	if d.keep && d.name != nil {
+		return fmt.Errorf("%vkeep and %vname are mutually exclusive", directivePrefix, directivePrefix)
+	}
+	return nil
+}
+
+// collectDirectives parses the directives of every declaration in the file.
+func (gctx *genericContext) collectDirectives(file *ast.File) error {
+	for _, decl := range file.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			dirs := &directives{}
+			if err := parseDirectives(dirs, d.Doc); err != nil {
+				return errors.Wrap(err, gctx.fset.Position(d.Pos()).String())
+			}
+			if dirs.name != nil && d.Recv != nil {
+				return fmt.Errorf("%v: methods cannot be renamed", gctx.fset.Position(d.Pos()))
+			}
+			gctx.directives[d] = dirs
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				dirs := &directives{}
+				var err error
+				switch s := spec.(type) {
+				case *ast.TypeSpec:
+					err = parseDirectives(dirs, d.Doc, s.Doc)
+				case *ast.ValueSpec:
+					err = parseDirectives(dirs, d.Doc, s.Doc)
+					if err == nil && dirs.name != nil && len(s.Names) != 1 {
+						err = fmt.Errorf("%vname requires a single name", directivePrefix)
+					}
+				default:
+					continue
+				}
+				if err != nil {
+					return errors.Wrap(err, gctx.fset.Position(spec.Pos()).String())
+				}
+				gctx.directives[spec] = dirs
+			}
+		}
+	}
+	return nil
+}
+
+// newName returns the generated name of a dependant declaration,
+// or an empty string if it must not be renamed.
+func (gctx *genericContext) newName(n ast.Node, name string) (string, error) {
+	dirs := gctx.directives[n]
+	if dirs == nil || dirs.name == nil {
+		if dirs != nil && dirs.keep {
+			return "", nil
+		}
+		newName := gctx.renamer.Replace(name)
+		if ok, _ := isIdentifier(newName); !ok {
+			return "", fmt.Errorf("generated name %q of %v is not a valid identifier, set it with %vname", newName, name, directivePrefix)
+		}
+		return newName, nil
+	}
+	data := make(map[string]string, len(gctx.genericTypes))
+	for generic, gType := range gctx.genericTypes {
+		data[generic] = gType.Name
+	}
+	buff := &bytes.Buffer{}
+	if err := dirs.name.Execute(buff, data); err != nil {
+		return "", errors.Wrap(err, fmt.Sprintf("generating name of %v failed", name))
+	}
+	newName := buff.String()
+	if ok, _ := isIdentifier(newName); !ok {
+		return "", fmt.Errorf("generated name %q of %v is not a valid identifier", newName, name)
+	}
+	return newName, nil
+}
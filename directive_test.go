@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"go/ast"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDirectives(t *testing.T) {
+	assert := assert.New(t)
+	testCases := []struct {
+		comments []string
+		ok       bool
+		expected directives
+		// name is the name generated by the name directive for Type=User.
+		name string
+	}{
+		{[]string{"// Foo is a foo."}, true, directives{}, ""},
+		{[]string{"//rei:skip"}, true, directives{skip: true}, ""},
+		{[]string{"// Foo is a foo.", "//rei:include", "//rei:keep"}, true, directives{include: true, keep: true}, ""},
+		{[]string{"//rei:name {{.Type}}Index"}, true, directives{}, "UserIndex"},
+		{[]string{"//rei:name {{lower .Type}}Helper"}, true, directives{}, "userHelper"},
+		{[]string{"//rei:skip", "//rei:include"}, false, directives{}, ""},
+		{[]string{"//rei:keep", "//rei:name Foo"}, false, directives{}, ""},
+		{[]string{"//rei:name"}, false, directives{}, ""},
+		{[]string{"//rei:name {{.Type"}, false, directives{}, ""},
+		{[]string{"//rei:frobnicate"}, false, directives{}, ""},
+		{[]string{"//rei:override sumType Type=string"}, true, directives{overrideTarget: "sumType"}, ""},
+		{[]string{"//rei:override sumType"}, false, directives{}, ""},
+		{[]string{"//rei:override sumType Type"}, false, directives{}, ""},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.comments[len(tc.comments)-1], func(t *testing.T) {
+			cg := &ast.CommentGroup{}
+			for _, c := range tc.comments {
+				cg.List = append(cg.List, &ast.Comment{Text: c})
+			}
+			dirs := &directives{}
+			err := parseDirectives(dirs, cg)
+			assert.Equal(tc.ok, err == nil, "%v: %v", tc.comments, err)
+			if tc.ok {
+				assert.Equal(tc.expected.skip, dirs.skip)
+				assert.Equal(tc.expected.include, dirs.include)
+				assert.Equal(tc.expected.keep, dirs.keep)
+				assert.Equal(tc.expected.overrideTarget, dirs.overrideTarget)
+				if tc.name == "" {
+					assert.Nil(dirs.name)
+				} else if assert.NotNil(dirs.name) {
+					buff := &bytes.Buffer{}
+					if assert.NoError(dirs.name.Execute(buff, map[string]string{"Type": "User"})) {
+						assert.Equal(tc.name, buff.String())
+					}
+				}
+			}
+		})
+	}
+}
@@ -5,8 +5,7 @@ package main
 import "fmt"
 
 // Concrete2DAO is a data access object for Concrete2
-type Concrete2DAO struct {
-}
+type Concrete2DAO struct{}
 
 // NewConcrete2DAO creates a new Concrete2DAO
 func NewConcrete2DAO() *Concrete2DAO {
@@ -2,7 +2,7 @@ package main
 
 import "fmt"
 
-//go:generate rei -in=type.go -out=concrete.go "Type=github.com/nkovacs/rei/examples/dao/models.Concrete"
+//go:generate rei gen -t dao=type.go ./models
 //go:generate rei -in=type.go -out=concrete2gen.go "Type=Concrete2"
 
 func main() {
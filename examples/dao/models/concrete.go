@@ -1,5 +1,6 @@
 package models
 
+//rei:gen dao
 type Concrete struct {
 	ID   int64
 	Name string
@@ -9,8 +9,7 @@ import (
 )
 
 // ConcreteDAO is a data access object for Concrete
-type ConcreteDAO struct {
-}
+type ConcreteDAO struct{}
 
 // NewConcreteDAO creates a new ConcreteDAO
 func NewConcreteDAO() *ConcreteDAO {
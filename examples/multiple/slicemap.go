@@ -1,3 +1,6 @@
+//rei:param KeyType doc="key type of the map"
+//rei:param ValueType doc="element type of the map's slices"
+
 package main
 
 type KeyType interface{}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/types"
+	"sort"
+)
+
+// genericNamed returns the generic type t or *t refers to,
+// or nil if t is not a generic type.
+func (gctx *genericContext) genericNamed(t types.Type) *types.Named {
+	if ptr, ok := t.(*types.Pointer); ok {
+		t = ptr.Elem()
+	}
+	named, ok := t.(*types.Named)
+	if !ok || gctx.genericTypeName(named) == "" {
+		return nil
+	}
+	return named
+}
+
+// checkFields returns a mappingError if a field mapping
+// names a field or method the generic type does not have.
+func (gctx *genericContext) checkFields() error {
+	info := gctx.templateInfo()
+	specs := gctx.genericTypeSpecs()
+	names := make([]string, 0, len(gctx.genericTypes))
+	for name := range gctx.genericTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		gType := gctx.genericTypes[name]
+		if len(gType.Fields) == 0 {
+			continue
+		}
+		obj := info.Defs[specs[name].Name]
+		if obj == nil {
+			continue
+		}
+		fields := make([]string, 0, len(gType.Fields))
+		for field := range gType.Fields {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			if found, _, _ := types.LookupFieldOrMethod(obj.Type(), true, obj.Pkg(), field); found == nil {
+				return &mappingError{
+					msg: fmt.Sprintf("generic type %v has no field or method %v", name, field),
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// applyFields renames the fields and methods of the generic types
+// in selector expressions and composite literals
+// according to the field mappings of the concrete types.
+// The methods of adapted types are implemented by their adapters instead.
+func (gctx *genericContext) applyFields(file *ast.File) error {
+	hasFields := false
+	for _, gType := range gctx.genericTypes {
+		if len(gType.Fields) > 0 {
+			hasFields = true
+		}
+	}
+	if !hasFields {
+		return nil
+	}
+	if err := gctx.checkFields(); err != nil {
+		return err
+	}
+
+	info := gctx.templateInfo()
+	fieldName := func(t types.Type, name string) string {
+		named := gctx.genericNamed(t)
+		if named == nil {
+			return ""
+		}
+		gType := gctx.genericTypes[named.Obj().Name()]
+		if gType.Adapter {
+			return ""
+		}
+		return gType.Fields[name]
+	}
+	ast.Inspect(file, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.SelectorExpr:
+			selection, ok := info.Selections[n]
+			if !ok {
+				return true
+			}
+			if name := fieldName(selectionOwner(selection), n.Sel.Name); name != "" {
+				n.Sel = &ast.Ident{
+					NamePos: n.Sel.NamePos,
+					Name:    name,
+				}
+			}
+		case *ast.CompositeLit:
+			tv, ok := info.Types[n]
+			if !ok {
+				return true
+			}
+			for _, elt := range n.Elts {
+				kv, ok := elt.(*ast.KeyValueExpr)
+				if !ok {
+					continue
+				}
+				key, ok := kv.Key.(*ast.Ident)
+				if !ok {
+					continue
+				}
+				if name := fieldName(tv.Type, key.Name); name != "" {
+					kv.Key = &ast.Ident{
+						NamePos: key.NamePos,
+						Name:    name,
+					}
+				}
+			}
+		}
+		return true
+	})
+	return nil
+}
+
+// selectionOwner returns the type that declares the field or method of a selection.
+// It's the receiver's type, or the type of an embedded field if the field or method is promoted.
+func selectionOwner(selection *types.Selection) types.Type {
+	t := selection.Recv()
+	index := selection.Index()
+	for _, i := range index[:len(index)-1] {
+		if ptr, ok := t.Underlying().(*types.Pointer); ok {
+			t = ptr.Elem()
+		}
+		st, ok := t.Underlying().(*types.Struct)
+		if !ok {
+			break
+		}
+		t = st.Field(i).Type()
+	}
+	return t
+}
+
+// embeddedFieldName returns the name of the field of a generic type embedded in a struct,
+// which is the name of the concrete type, or of its adapter.
+// It returns a mappingError if the concrete type cannot be embedded.
+func embeddedFieldName(generic string, gType *Type, pointer bool) (string, error) {
+	if literalTypes[gType.Name] || (pointer && gType.Pointer) {
+		return "", &mappingError{
+			msg: fmt.Sprintf("generic type %v is embedded, it cannot be mapped to %v", generic, gType),
+		}
+	}
+	if gType.Adapter {
+		return adapterName(gType), nil
+	}
+	return gType.Name, nil
+}
+
+// applyEmbedded renames the fields of embedded generic types
+// in selector expressions and composite literal keys to the concrete types' names,
+// e.g. w.Type.ID is generated as w.User.ID if Type is mapped to models.User.
+func (gctx *genericContext) applyEmbedded(file *ast.File) error {
+	specs := gctx.genericTypeSpecs()
+	embedded := false
+	var err error
+	ast.Inspect(file, func(n ast.Node) bool {
+		st, ok := n.(*ast.StructType)
+		if !ok || err != nil {
+			return err == nil
+		}
+		for _, field := range st.Fields.List {
+			if len(field.Names) > 0 {
+				continue
+			}
+			typ, pointer := field.Type, false
+			if star, ok := typ.(*ast.StarExpr); ok {
+				typ, pointer = star.X, true
+			}
+			id, ok := typ.(*ast.Ident)
+			if !ok || id.Obj == nil || specs[id.Name] == nil || id.Obj.Decl != specs[id.Name] {
+				continue
+			}
+			embedded = true
+			if _, err = embeddedFieldName(id.Name, gctx.genericTypes[id.Name], pointer); err != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil || !embedded {
+		return err
+	}
+
+	info := gctx.templateInfo()
+	// embeddedName returns the new name of an embedded generic field,
+	// or an empty string if obj is not one.
+	embeddedName := func(obj types.Object) string {
+		v, ok := obj.(*types.Var)
+		if !ok || !v.Embedded() {
+			return ""
+		}
+		t, pointer := v.Type(), false
+		if ptr, ok := t.(*types.Pointer); ok {
+			t, pointer = ptr.Elem(), true
+		}
+		generic := gctx.genericTypeName(t)
+		if generic == "" {
+			return ""
+		}
+		name, _ := embeddedFieldName(generic, gctx.genericTypes[generic], pointer)
+		return name
+	}
+	ast.Inspect(file, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.SelectorExpr:
+			selection, ok := info.Selections[n]
+			if !ok {
+				return true
+			}
+			if name := embeddedName(selection.Obj()); name != "" {
+				n.Sel = &ast.Ident{
+					NamePos: n.Sel.NamePos,
+					Name:    name,
+				}
+			}
+		case *ast.KeyValueExpr:
+			key, ok := n.Key.(*ast.Ident)
+			if !ok {
+				return true
+			}
+			if name := embeddedName(info.Uses[key]); name != "" {
+				// The key resolves to the generic type, the new key is not renamed.
+				n.Key = &ast.Ident{
+					Name: name,
+				}
+			}
+		}
+		return true
+	})
+	return nil
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// fieldLoop is a statement or composite literal element
+// repeated for each exported field of a generic type's concrete struct type.
+// It's declared with a //rei:fields directive before the statement or element:
+//
+//	//rei:fields Type
+//	dst.Field = src.Field
+//
+//	//rei:fields Type Name Kind
+//	"Name": Kind(m.Name),
+//
+// The field and fieldType identifiers, Field and FieldType by default,
+// are replaced with the name and the type of the field.
+// The field's name also replaces string literals that are exactly field,
+// and {field} in other string literals, e.g. "{Field}Count" becomes "NameCount",
+// while "FieldCount" is left alone.
+type fieldLoop struct {
+	c         *ast.Comment
+	generic   string
+	field     string
+	fieldType string
+	// node is the repeated statement or element.
+	node ast.Node
+}
+
+func parseFieldLoop(c *ast.Comment, args string) (*fieldLoop, error) {
+	fields := strings.Fields(args)
+	if len(fields) == 0 || len(fields) > 3 {
+		return nil, fmt.Errorf("invalid %v, expected Type [Field [FieldType]]", c.Text)
+	}
+	l := &fieldLoop{
+		c:         c,
+		generic:   fields[0],
+		field:     "Field",
+		fieldType: "FieldType",
+	}
+	if len(fields) > 1 {
+		l.field = fields[1]
+	}
+	if len(fields) > 2 {
+		l.fieldType = fields[2]
+	}
+	for _, name := range fields[1:] {
+		if ok, _ := isIdentifier(name); !ok {
+			return nil, fmt.Errorf("invalid %v, %v is not a valid identifier", c.Text, name)
+		}
+	}
+	return l, nil
+}
+
+// listNodes returns the statements or elements of n that can be repeated.
+func listNodes(n ast.Node) []ast.Node {
+	var nodes []ast.Node
+	switch n := n.(type) {
+	case *ast.BlockStmt:
+		for _, stmt := range n.List {
+			nodes = append(nodes, stmt)
+		}
+	case *ast.CaseClause:
+		for _, stmt := range n.Body {
+			nodes = append(nodes, stmt)
+		}
+	case *ast.CommClause:
+		for _, stmt := range n.Body {
+			nodes = append(nodes, stmt)
+		}
+	case *ast.CompositeLit:
+		for _, elt := range n.Elts {
+			nodes = append(nodes, elt)
+		}
+	}
+	return nodes
+}
+
+// replaceListNode replaces node in the statements or elements of n with nodes,
+// and reports whether n contains node.
+func replaceListNode(n ast.Node, node ast.Node, nodes []ast.Node) bool {
+	list := listNodes(n)
+	idx := -1
+	for i, elt := range list {
+		if elt == node {
+			idx = i
+		}
+	}
+	if idx == -1 {
+		return false
+	}
+	list = append(list[:idx:idx], append(nodes, list[idx+1:]...)...)
+	switch n := n.(type) {
+	case *ast.BlockStmt:
+		n.List = make([]ast.Stmt, len(list))
+		for i, elt := range list {
+			n.List[i] = elt.(ast.Stmt)
+		}
+	case *ast.CaseClause:
+		n.Body = make([]ast.Stmt, len(list))
+		for i, elt := range list {
+			n.Body[i] = elt.(ast.Stmt)
+		}
+	case *ast.CommClause:
+		n.Body = make([]ast.Stmt, len(list))
+		for i, elt := range list {
+			n.Body[i] = elt.(ast.Stmt)
+		}
+	case *ast.CompositeLit:
+		n.Elts = make([]ast.Expr, len(list))
+		for i, elt := range list {
+			n.Elts[i] = elt.(ast.Expr)
+		}
+	}
+	return true
+}
+
+// collectFieldLoops finds the nodes the //rei:fields directives apply to.
+// It must be called while the file still has its original positions.
+func (gctx *genericContext) collectFieldLoops(file *ast.File) error {
+	var loops []*fieldLoop
+	for _, cg := range file.Comments {
+		for _, c := range cg.List {
+			if !isDirective(c) {
+				continue
+			}
+			name, args := splitDirective(c)
+			if name != "fields" {
+				continue
+			}
+			l, err := parseFieldLoop(c, args)
+			if err != nil {
+				return errors.Wrap(err, gctx.fset.Position(c.Pos()).String())
+			}
+			loops = append(loops, l)
+		}
+	}
+	if len(loops) == 0 {
+		return nil
+	}
+
+	ast.Inspect(file, func(n ast.Node) bool {
+		nodes := listNodes(n)
+		for i, node := range nodes {
+			for _, l := range loops {
+				if l.node != nil || l.c.Pos() < n.Pos() || l.c.End() > n.End() || node.Pos() < l.c.End() {
+					continue
+				}
+				if i > 0 && nodes[i-1].End() > l.c.Pos() {
+					continue
+				}
+				l.node = node
+			}
+		}
+		return true
+	})
+	for _, l := range loops {
+		if l.node == nil {
+			return fmt.Errorf("%v: %v must precede a statement or a composite literal element", gctx.fset.Position(l.c.Pos()), l.c.Text)
+		}
+		if gctx.genericTypes[l.generic] == nil {
+			return fmt.Errorf("%v: %v is not a generic type", gctx.fset.Position(l.c.Pos()), l.generic)
+		}
+	}
+	gctx.fieldLoops = loops
+	return nil
+}
+
+// copyNode returns a deep copy of an AST node.
+// The objects identifiers resolve to are shared with the original,
+// so the copy is renamed like the original.
+func copyNode(n ast.Node) ast.Node {
+	return copyValue(reflect.ValueOf(n), nil).Interface().(ast.Node)
+}
+
+// copyNodeWith returns a deep copy of an AST node like copyNode,
+// except that nodes of interface fields, like expressions and statements,
+// for which replace returns a node are replaced with it.
+// replace is called with the nodes of the original,
+// so their type information can be looked up.
+func copyNodeWith(n ast.Node, replace func(ast.Node) ast.Node) ast.Node {
+	return copyValue(reflect.ValueOf(n), replace).Interface().(ast.Node)
+}
+
+var (
+	objectType = reflect.TypeOf((*ast.Object)(nil))
+	scopeType  = reflect.TypeOf((*ast.Scope)(nil))
+	nodeType   = reflect.TypeOf((*ast.Node)(nil)).Elem()
+)
+
+func copyValue(v reflect.Value, replace func(ast.Node) ast.Node) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() || v.Type() == objectType || v.Type() == scopeType {
+			return v
+		}
+		c := reflect.New(v.Type().Elem())
+		c.Elem().Set(copyValue(v.Elem(), replace))
+		return c
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type()).Elem()
+		// Only nodes in interface fields can be replaced with a node of another type.
+		if replace != nil && v.Type().Implements(nodeType) {
+			if r := replace(v.Elem().Interface().(ast.Node)); r != nil {
+				c.Set(reflect.ValueOf(r))
+				return c
+			}
+		}
+		c.Set(copyValue(v.Elem(), replace))
+		return c
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(copyValue(v.Index(i), replace))
+		}
+		return c
+	case reflect.Struct:
+		c := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.NumField(); i++ {
+			c.Field(i).Set(copyValue(v.Field(i), replace))
+		}
+		return c
+	}
+	return v
+}
+
+// structFields returns the exported fields of the concrete struct type
+// of a generic type, and the type expressions of their types.
+// The packages the types refer to are added to imports.
+func (gctx *genericContext) structFields(generic string, imports map[string]string) ([]*types.Var, []ast.Expr, error) {
+	gType := gctx.genericTypes[generic]
+	t, err := gctx.loader.lookup(gType)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ptr, ok := t.(*types.Pointer); ok {
+		t = ptr.Elem()
+	}
+	st, ok := t.Underlying().(*types.Struct)
+	if !ok {
+		return nil, nil, &mappingError{
+			msg: fmt.Sprintf("%v=%v is not a struct type", generic, gType),
+		}
+	}
+	var fields []*types.Var
+	var exprs []ast.Expr
+	for i := 0; i < st.NumFields(); i++ {
+		f := st.Field(i)
+		if !f.Exported() {
+			continue
+		}
+		expr, err := gctx.typeExpr(f.Type(), imports)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, fmt.Sprintf("field %v", f.Name()))
+		}
+		fields = append(fields, f)
+		exprs = append(exprs, expr)
+	}
+	return fields, exprs, nil
+}
+
+// typeExpr returns the type expression of t in the destination package.
+// The packages it refers to are added to imports.
+func (gctx *genericContext) typeExpr(t types.Type, imports map[string]string) (ast.Expr, error) {
+	// Types of the destination package are not qualified.
+	var local *types.Package
+	if pkg, err := gctx.loader.load(""); err == nil {
+		local = pkg
+	}
+	qualifier := func(pkg *types.Package) string {
+		if local != nil && pkg.Path() == local.Path() {
+			return ""
+		}
+		imports[pkg.Path()] = pkg.Name()
+		return pkg.Name()
+	}
+	return parser.ParseExpr(types.TypeString(t, qualifier))
+}
+
+// expand returns a copy of the loop's node for each field.
+func (l *fieldLoop) expand(node ast.Node, fields []*types.Var, typeExprs []ast.Expr) []ast.Node {
+	var nodes []ast.Node
+	for i, f := range fields {
+		c := Apply(copyNode(node), nil, func(parent ast.Node, name string, index int, n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.Ident:
+				switch n.Name {
+				case l.field:
+					SetField(parent, name, index, &ast.Ident{NamePos: n.NamePos, Name: f.Name()})
+				case l.fieldType:
+					SetField(parent, name, index, copyNode(typeExprs[i]))
+				}
+			case *ast.BasicLit:
+				if n.Kind != token.STRING {
+					return true
+				}
+				value, err := strconv.Unquote(n.Value)
+				if err != nil {
+					return true
+				}
+				newValue := strings.Replace(value, "{"+l.field+"}", f.Name(), -1)
+				if value == l.field {
+					newValue = f.Name()
+				}
+				if newValue == value {
+					return true
+				}
+				SetField(parent, name, index, &ast.BasicLit{
+					ValuePos: n.ValuePos,
+					Kind:     token.STRING,
+					Value:    strconv.Quote(newValue),
+				})
+			}
+			return true
+		})
+		nodes = append(nodes, c)
+	}
+	return nodes
+}
+
+// expandFieldLoops repeats the nodes of the //rei:fields directives
+// for each exported field of the concrete struct types.
+// Nodes removed by specialization are skipped.
+// It returns the packages the fields' types refer to, by path.
+// It must be called after the dependants are collected
+// and before renaming, so the copies are renamed as well.
+func (gctx *genericContext) expandFieldLoops(file *ast.File) (map[string]string, error) {
+	imports := make(map[string]string)
+	for _, l := range gctx.fieldLoops {
+		var owner ast.Node
+		ast.Inspect(file, func(n ast.Node) bool {
+			for _, node := range listNodes(n) {
+				if node == l.node {
+					owner = n
+				}
+			}
+			return owner == nil
+		})
+		if owner == nil {
+			continue
+		}
+		fields, typeExprs, err := gctx.structFields(l.generic, imports)
+		if err != nil {
+			return nil, errors.Wrap(err, gctx.fset.Position(l.c.Pos()).String())
+		}
+		replaceListNode(owner, l.node, l.expand(l.node, fields, typeExprs))
+	}
+	return imports, nil
+}
+
+// addImports adds the packages, by path, to the import specs
+// if they are not imported yet.
+func addImports(specs []*ast.ImportSpec, pkgs map[string]string) []*ast.ImportSpec {
+	paths := make([]string, 0, len(pkgs))
+	for pkgPath := range pkgs {
+		paths = append(paths, pkgPath)
+	}
+	sort.Strings(paths)
+	for _, pkgPath := range paths {
+		found := false
+		for _, spec := range specs {
+			if spec.Path.Value == strconv.Quote(pkgPath) {
+				found = true
+			}
+		}
+		if found {
+			continue
+		}
+		var name *ast.Ident
+		if path.Base(pkgPath) != pkgs[pkgPath] {
+			name = &ast.Ident{Name: pkgs[pkgPath]}
+		}
+		specs = append(specs, &ast.ImportSpec{
+			Name: name,
+			Path: &ast.BasicLit{
+				Kind:  token.STRING,
+				Value: strconv.Quote(pkgPath),
+			},
+		})
+	}
+	return specs
+}
@@ -2,11 +2,15 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"go/ast"
 	"go/parser"
 	"go/printer"
 	"go/token"
+	"go/types"
 	"io"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"unicode"
@@ -19,20 +23,76 @@ import (
 
 type empty struct{}
 
+// mappingError is returned when the type mapping does not match the template.
+type mappingError struct {
+	msg string
+}
+
+func (e *mappingError) Error() string {
+	return e.msg
+}
+
+// genOptions controls the layout of the generated code.
+type genOptions struct {
+	// SourceOrder keeps the declaration order and grouping of the source file.
+	// Otherwise declarations are grouped by kind:
+	// types, constants, variables, then functions.
+	SourceOrder bool
+	// Dir is the directory of the package the code is generated into.
+	// Concrete types without a package are looked up there.
+	Dir string
+	// Warnings receives warnings about the template, if not nil.
+	Warnings io.Writer
+	// Methods generates the methods of generic types onto concrete types
+	// declared in the destination package.
+	Methods bool
+	// Partial allows leaving template parameters unbound.
+	// The output is a template with the unbound parameters.
+	Partial bool
+}
+
 type genericContext struct {
 	fset         *token.FileSet
 	genericTypes map[string]*Type
 
 	types     map[token.Pos]ast.Spec
 	isGeneric map[token.Pos]bool
+	values    map[token.Pos]*ast.ValueSpec // placeholder constants of value parameters
+	constants map[*ast.ValueSpec]constSpec // constant specs by their place in their group
+	funcArgs  map[string]*ast.FuncDecl     // placeholder functions of function parameters
+	packages  map[string]*Type             // substituted packages by the name they're imported as
 	funcs     map[token.Pos]ast.Decl
 	vars      map[token.Pos]ast.Spec
 	consts    map[token.Pos]ast.Spec
 
-	renamer     *strings.Replacer
+	renamer     renamer
 	renamePairs []string
+	identPairs  []string               // fragments of identifier mappings, replaced as words
+	namePairs   []string               // explicitly named declarations
 	renames     map[token.Pos]ast.Expr //*ast.SelectorExpr or *ast.Ident or *ast.StarExpr
 
+	directives map[ast.Node]*directives
+
+	loader   *typeLoader
+	warnings io.Writer
+	methods  bool
+	partial  bool
+	unbound  map[string]bool // parameters left unbound by a partial instantiation
+
+	// fieldLoops are the nodes repeated for each field of a struct.
+	fieldLoops []*fieldLoop
+	// methodLoops are the methods repeated for each method of an interface,
+	// expandedMethods their copies.
+	methodLoops     []*methodLoop
+	expandedMethods map[*ast.FuncDecl][]*ast.FuncDecl
+
+	// renameUndefined renames the identifiers the template uses, but does not declare.
+	// These are declared by the instantiations of the templates it uses.
+	renameUndefined bool
+
+	file *ast.File
+	info *types.Info // type information of the template, see templateInfo
+
 	visited map[token.Pos]bool
 }
 
@@ -52,11 +112,14 @@ func upperFirst(s string) string {
 	return string(unicode.ToUpper(r)) + s[n:]
 }
 
-func (gctx *genericContext) registerGenericType(node ast.Decl) bool {
+// registerGenericType registers the generic types declared in node,
+// and returns their names.
+func (gctx *genericContext) registerGenericType(node ast.Decl) []string {
 	decl, ok := node.(*ast.GenDecl)
 	if !ok {
-		return false
+		return nil
 	}
+	var registered []string
 	for _, spec := range decl.Specs {
 		ts, ok := spec.(*ast.TypeSpec)
 		if !ok {
@@ -66,67 +129,427 @@ func (gctx *genericContext) registerGenericType(node ast.Decl) bool {
 			continue
 		}
 		gType, ok := gctx.genericTypes[ts.Name.String()]
-		if !ok {
+		if !ok || gType.Value != "" || gType.Package || gType.Ident {
 			continue
 		}
 		gctx.types[ts.Pos()] = ts
 		gctx.isGeneric[ts.Pos()] = true
 		gctx.visited[ts.Pos()] = true
-		if gType.PkgName != "" {
-			gctx.renames[ts.Pos()] = &ast.SelectorExpr{
-				X: &ast.Ident{
-					Name: gType.PkgName,
-				},
-				Sel: &ast.Ident{
-					Name: gType.Name,
-				},
-			}
-		} else {
+		gctx.renames[ts.Pos()] = mappedTypeExpr(gType)
+		if gType.Adapter {
+			// The generic type is replaced with the adapter type wrapping the concrete type.
 			gctx.renames[ts.Pos()] = &ast.Ident{
-				Name: gType.Name,
+				Name: adapterName(gType),
 			}
 		}
-		if gType.Pointer {
-			gctx.renames[ts.Pos()] = &ast.StarExpr{
-				X: gctx.renames[ts.Pos()],
-			}
+		// Type literals like struct{} are renamed to their letters.
+		name := valueName(gType.Name)
+		if gType.Qualified {
+			name = upperFirst(gType.PkgName) + upperFirst(name)
 		}
 		gctx.renamePairs = append(gctx.renamePairs,
-			lowerFirst(ts.Name.String()), lowerFirst(gType.Name),
-			upperFirst(ts.Name.String()), upperFirst(gType.Name),
+			lowerFirst(ts.Name.String()), lowerFirst(name),
+			upperFirst(ts.Name.String()), upperFirst(name),
 		)
-		return true
+		registered = append(registered, ts.Name.String())
+	}
+	return registered
+}
+
+// registerGenericValue registers the placeholder constants of value parameters
+// declared in node, and returns their names.
+// References to a placeholder constant are replaced with the parameter's value.
+func (gctx *genericContext) registerGenericValue(node ast.Decl) ([]string, error) {
+	decl, ok := node.(*ast.GenDecl)
+	if !ok || decl.Tok != token.CONST {
+		return nil, nil
+	}
+	var registered []string
+	for _, spec := range decl.Specs {
+		vs, ok := spec.(*ast.ValueSpec)
+		if !ok {
+			continue
+		}
+		for _, name := range vs.Names {
+			gType, ok := gctx.genericTypes[name.Name]
+			if !ok || gType.Value == "" {
+				continue
+			}
+			if len(vs.Names) != 1 {
+				return nil, fmt.Errorf("%v: value parameter %v must be declared alone", gctx.fset.Position(name.Pos()), name.Name)
+			}
+			value, err := parser.ParseExpr(gType.Value)
+			if err != nil {
+				return nil, errors.Wrap(err, fmt.Sprintf("invalid value of %v", name.Name))
+			}
+			if vs.Type != nil {
+				// Keep the type of typed constants.
+				value = &ast.CallExpr{
+					Fun:  vs.Type,
+					Args: []ast.Expr{value},
+				}
+			} else if _, ok := value.(*ast.BasicLit); !ok {
+				value = &ast.ParenExpr{
+					X: value,
+				}
+			}
+			gctx.values[vs.Pos()] = vs
+			gctx.visited[vs.Pos()] = true
+			gctx.renames[name.Pos()] = value
+			if gType.Name != "" {
+				gctx.renamePairs = append(gctx.renamePairs,
+					lowerFirst(name.Name), lowerFirst(gType.Name),
+					upperFirst(name.Name), upperFirst(gType.Name),
+				)
+			}
+			registered = append(registered, name.Name)
+		}
+	}
+	return registered, nil
+}
+
+// registerGenericFunc registers the placeholder function of a function parameter
+// declared in node, and returns its name.
+// References to a placeholder function are replaced with the mapped function.
+func (gctx *genericContext) registerGenericFunc(node ast.Decl) (string, error) {
+	decl, ok := node.(*ast.FuncDecl)
+	if !ok || decl.Recv != nil {
+		return "", nil
+	}
+	gType, ok := gctx.genericTypes[decl.Name.Name]
+	if !ok || gType.Package || gType.Ident {
+		return "", nil
+	}
+	if gType.Value != "" || gType.Pointer || len(gType.Fields) > 0 {
+		return "", fmt.Errorf("%v: function parameter %v must be mapped to a function, not %v",
+			gctx.fset.Position(decl.Pos()), decl.Name.Name, gType)
+	}
+	gctx.funcArgs[decl.Name.Name] = decl
+	gctx.visited[decl.Pos()] = true
+	if gType.PkgName != "" {
+		gctx.renames[decl.Pos()] = &ast.SelectorExpr{
+			X: &ast.Ident{
+				Name: gType.PkgName,
+			},
+			Sel: &ast.Ident{
+				Name: gType.Name,
+			},
+		}
+	} else {
+		gctx.renames[decl.Pos()] = &ast.Ident{
+			Name: gType.Name,
+		}
+	}
+	return decl.Name.Name, nil
+}
+
+// isFuncArg reports whether the generic name is a function parameter.
+func (gctx *genericContext) isFuncArg(name string) bool {
+	_, ok := gctx.funcArgs[name]
+	return ok
+}
+
+// importName returns the name a package is imported as.
+// If the import is not named, the last element of the path is assumed
+// to be the package's name.
+func importName(spec *ast.ImportSpec) string {
+	if spec.Name != nil {
+		return spec.Name.Name
+	}
+	unquoted, err := strconv.Unquote(spec.Path.Value)
+	if err != nil {
+		return ""
+	}
+	return path.Base(unquoted)
+}
+
+// registerPackages registers the substituted packages imported by the file
+// by the names they are imported as, and returns the names of their mappings.
+// A pkg: mapping matches the import with the same name, or else the import
+// whose path contains the mapping's name as path elements, e.g. storage
+// matches github.com/acme/storage/sql.
+// It returns a mappingError if a mapping matches several imports.
+func (gctx *genericContext) registerPackages(file *ast.File) ([]string, error) {
+	var keys []string
+	for name, gType := range gctx.genericTypes {
+		if gType.Package {
+			keys = append(keys, name)
+		}
+	}
+	sort.Strings(keys)
+
+	var registered []string
+	for _, key := range keys {
+		var matches []*ast.ImportSpec
+		for _, spec := range file.Imports {
+			if importName(spec) == key {
+				matches = []*ast.ImportSpec{spec}
+				break
+			}
+			unquoted, err := strconv.Unquote(spec.Path.Value)
+			if err != nil {
+				continue
+			}
+			if strings.Contains("/"+unquoted+"/", "/"+key+"/") {
+				matches = append(matches, spec)
+			}
+		}
+		if len(matches) == 0 {
+			continue
+		}
+		if len(matches) > 1 {
+			return nil, &mappingError{
+				msg: fmt.Sprintf("pkg:%v matches both %v and %v", key, matches[0].Path.Value, matches[1].Path.Value),
+			}
+		}
+		name := importName(matches[0])
+		if prev, ok := gctx.packages[name]; ok {
+			return nil, &mappingError{
+				msg: fmt.Sprintf("%v is substituted by both %v and %v", matches[0].Path.Value, prev, gctx.genericTypes[key]),
+			}
+		}
+		gctx.packages[name] = gctx.genericTypes[key]
+		registered = append(registered, key)
+	}
+	return registered, nil
+}
+
+// packageSelector returns the substituted package of a selector expression,
+// or nil if the selector does not refer to a substituted package.
+func (gctx *genericContext) packageSelector(n ast.Node) *Type {
+	sel, ok := n.(*ast.SelectorExpr)
+	if !ok {
+		return nil
+	}
+	x, ok := sel.X.(*ast.Ident)
+	if !ok || x.Obj != nil {
+		// Local names shadowing the package are resolved.
+		return nil
+	}
+	return gctx.packages[x.Name]
+}
+
+// declNames returns the names declared by a top level declaration or spec.
+// Methods don't declare top level names.
+func declNames(n ast.Node) []*ast.Ident {
+	switch d := n.(type) {
+	case *ast.FuncDecl:
+		if d.Recv == nil {
+			return []*ast.Ident{d.Name}
+		}
+	case *ast.TypeSpec:
+		return []*ast.Ident{d.Name}
+	case *ast.ValueSpec:
+		return d.Names
+	}
+	return nil
+}
+
+// hasIdentFragment reports whether a name contains the fragment
+// of an identifier mapping.
+func (gctx *genericContext) hasIdentFragment(name string) bool {
+	for fragment, gType := range gctx.genericTypes {
+		if !gType.Ident {
+			continue
+		}
+		if containsWord(name, lowerFirst(fragment)) || containsWord(name, upperFirst(fragment)) {
+			return true
+		}
 	}
 	return false
 }
 
-func (gctx *genericContext) registerGenericTypes(file *ast.File) {
+// registerIdents registers the identifier mappings whose fragment
+// is part of a top level name of the file, and returns their fragments.
+func (gctx *genericContext) registerIdents(file *ast.File) []string {
+	var fragments []string
+	for fragment, gType := range gctx.genericTypes {
+		if gType.Ident {
+			fragments = append(fragments, fragment)
+		}
+	}
+	sort.Strings(fragments)
+	var registered []string
+	for _, fragment := range fragments {
+		gType := gctx.genericTypes[fragment]
+		gctx.identPairs = append(gctx.identPairs,
+			lowerFirst(fragment), lowerFirst(gType.Name),
+			upperFirst(fragment), upperFirst(gType.Name),
+		)
+		for name := range file.Scope.Objects {
+			if containsWord(name, lowerFirst(fragment)) || containsWord(name, upperFirst(fragment)) {
+				registered = append(registered, fragment)
+				break
+			}
+		}
+	}
+	return registered
+}
+
+// registerGenericTypes registers the generic types and values declared in the file.
+// It returns a mappingError if a generic type in the mapping is not declared.
+func (gctx *genericContext) registerGenericTypes(file *ast.File) error {
 	gctx.renamePairs = make([]string, 0)
+	gctx.identPairs = make([]string, 0)
+	registered := make(map[string]bool)
+	names, err := gctx.registerPackages(file)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		registered[name] = true
+	}
+	for _, name := range gctx.registerIdents(file) {
+		registered[name] = true
+	}
 	for _, decl := range file.Decls {
-		gctx.registerGenericType(decl)
+		for _, name := range gctx.registerGenericType(decl) {
+			registered[name] = true
+		}
+		names, err := gctx.registerGenericValue(decl)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			registered[name] = true
+		}
+		name, err := gctx.registerGenericFunc(decl)
+		if err != nil {
+			return err
+		}
+		if name != "" {
+			registered[name] = true
+		}
+	}
+	gctx.renamer = append(newRenamer(gctx.identPairs, true), newRenamer(gctx.renamePairs, false)...)
+
+	var unmatched []string
+	for name := range gctx.genericTypes {
+		if !registered[name] {
+			unmatched = append(unmatched, name)
+		}
+	}
+	if len(unmatched) > 0 {
+		sort.Strings(unmatched)
+		return &mappingError{
+			msg: fmt.Sprintf("generic types not declared in the source file: %v", strings.Join(unmatched, ", ")),
+		}
 	}
-	gctx.renamer = strings.NewReplacer(gctx.renamePairs...)
+	return nil
+}
+
+// warnUnused warns about generic types that are declared,
+// but not used by any of the generated declarations.
+func (gctx *genericContext) warnUnused() {
+	if gctx.warnings == nil {
+		return
+	}
+	used := make(map[token.Pos]bool)
+	inspect := func(n ast.Node) {
+		ast.Inspect(n, func(n ast.Node) bool {
+			if n, ok := n.(*ast.Ident); ok && n.Obj != nil {
+				if spec, ok := n.Obj.Decl.(*ast.TypeSpec); ok && gctx.isGeneric[spec.Pos()] && n.Pos() != spec.Pos() {
+					used[spec.Pos()] = true
+				}
+			}
+			return true
+		})
+	}
+	for pos, spec := range gctx.types {
+		if !gctx.isGeneric[pos] {
+			inspect(spec)
+		}
+	}
+	for _, spec := range gctx.consts {
+		inspect(spec)
+	}
+	for _, spec := range gctx.vars {
+		inspect(spec)
+	}
+	for _, decl := range gctx.funcs {
+		inspect(decl)
+	}
+	for _, pos := range sortedPositions(gctx.isGeneric) {
+		if !used[pos] {
+			fmt.Fprintf(gctx.warnings, "warning: %v: generic type %v is declared but not used\n",
+				gctx.fset.Position(pos), gctx.types[pos].(*ast.TypeSpec).Name.Name)
+		}
+	}
+}
+
+// hasDependants reports whether any declaration depends on the generic types.
+func (gctx *genericContext) hasDependants() bool {
+	for pos := range gctx.types {
+		if !gctx.isGeneric[pos] {
+			return true
+		}
+	}
+	return len(gctx.funcs) > 0 || len(gctx.vars) > 0 || len(gctx.consts) > 0
+}
+
+// receiverIdent returns the type name of a method's receiver.
+func receiverIdent(field *ast.Field) *ast.Ident {
+	// Ident or StarExpr
+	var i *ast.Ident
+	switch x := field.Type.(type) {
+	case *ast.StarExpr:
+		i = x.X.(*ast.Ident)
+	case *ast.Ident:
+		i = x
+	}
+	return i
+}
+
+// hasLocalMethod reports whether the method name with the receiver field
+// on the generic type spec is generated onto the concrete type.
+// This requires the Methods option, and a concrete type that is declared
+// in the destination package, which is loaded to check it. Pointer receivers
+// are not generated for pointer concrete types, and the concrete type's own
+// fields and methods take precedence over the template's methods.
+func (gctx *genericContext) hasLocalMethod(spec *ast.TypeSpec, field *ast.Field, name string) bool {
+	if !gctx.methods {
+		return false
+	}
+	gType := gctx.genericTypes[spec.Name.Name]
+	if gType.Pkg != "" || gType.Value != "" || gType.Package || gType.Ident {
+		return false
+	}
+	if _, ok := field.Type.(*ast.StarExpr); ok && gType.Pointer {
+		return false
+	}
+	// Builtin types and type literals have no package.
+	t, err := gctx.loader.lookup(&Type{Name: gType.Name})
+	if err != nil {
+		return false
+	}
+	named, ok := t.(*types.Named)
+	if !ok || named.Obj().Pkg() == nil {
+		return false
+	}
+	obj, _, _ := types.LookupFieldOrMethod(named, true, named.Obj().Pkg(), name)
+	return obj == nil
 }
 
 func (gctx *genericContext) isDependant(node ast.Node) bool {
 	found := false
 
+	// Constants without values repeat the type and values of the previous spec.
+	if vs, ok := node.(*ast.ValueSpec); ok {
+		if c, ok := gctx.constants[vs]; ok && c.values != nil && c.values != vs &&
+			gctx.isDependant(&ast.ValueSpec{Type: c.values.Type, Values: c.values.Values}) {
+			return true
+		}
+	}
+
 	// Methods on the generic types are like interfaces,
-	// they should not be reified.
+	// they should not be reified, unless they are generated
+	// onto a concrete type in the destination package.
 	if funcDecl, ok := node.(*ast.FuncDecl); ok {
 		if funcDecl.Recv != nil {
 			for _, field := range funcDecl.Recv.List {
-				// Ident or StarExpr
-				var i *ast.Ident
-				switch x := field.Type.(type) {
-				case *ast.StarExpr:
-					i = x.X.(*ast.Ident)
-				case *ast.Ident:
-					i = x
-				}
-				if spec, ok := i.Obj.Decl.(*ast.TypeSpec); ok {
+				if spec, ok := receiverIdent(field).Obj.Decl.(*ast.TypeSpec); ok {
 					if gctx.isGeneric[spec.Pos()] {
-						return false
+						return gctx.hasLocalMethod(spec, field, funcDecl.Name.Name)
 					}
 				}
 			}
@@ -134,6 +557,31 @@ func (gctx *genericContext) isDependant(node ast.Node) bool {
 	}
 
 	ast.Inspect(node, func(n ast.Node) bool {
+		// check substituted packages
+		if gctx.packageSelector(n) != nil {
+			found = true
+			return false
+		}
+		// check nodes repeated for each field of a generic type
+		for _, l := range gctx.fieldLoops {
+			if n == l.node {
+				found = true
+				return false
+			}
+		}
+		// check methods repeated for each method of a generic type
+		for _, l := range gctx.methodLoops {
+			if n == l.decl {
+				found = true
+				return false
+			}
+		}
+		// check identifiers declared by used templates
+		if n, ok := n.(*ast.Ident); ok && n.Obj == nil && gctx.isUndefined(nil, "", n) &&
+			gctx.renamer.Replace(n.Name) != n.Name {
+			found = true
+			return false
+		}
 		if n, ok := n.(*ast.Ident); ok && n.Obj != nil {
 			// check types
 			if spec, ok := n.Obj.Decl.(*ast.TypeSpec); ok {
@@ -146,6 +594,10 @@ func (gctx *genericContext) isDependant(node ast.Node) bool {
 			}
 			// check functions
 			if fdecl, ok := n.Obj.Decl.(*ast.FuncDecl); ok {
+				if gctx.funcArgs[fdecl.Name.Name] == fdecl {
+					found = true
+					return false
+				}
 				for pos := range gctx.funcs {
 					if fdecl.Pos() == pos {
 						found = true
@@ -155,6 +607,10 @@ func (gctx *genericContext) isDependant(node ast.Node) bool {
 			}
 			// check variables
 			if spec, ok := n.Obj.Decl.(*ast.ValueSpec); ok {
+				if _, ok := gctx.values[spec.Pos()]; ok {
+					found = true
+					return false
+				}
 				for pos := range gctx.vars {
 					if spec.Pos() == pos {
 						found = true
@@ -174,7 +630,7 @@ func (gctx *genericContext) isDependant(node ast.Node) bool {
 	return found
 }
 
-func (gctx *genericContext) addDependant(n ast.Node, isConst bool) {
+func (gctx *genericContext) addDependant(n ast.Node, isConst bool) error {
 	switch d := n.(type) {
 	case *ast.FuncDecl:
 		gctx.funcs[d.Pos()] = d
@@ -183,29 +639,28 @@ func (gctx *genericContext) addDependant(n ast.Node, isConst bool) {
 			// the entire struct and all methods must be
 			// specialized.
 			for _, field := range d.Recv.List {
-				// Ident or StarExpr
-				var i *ast.Ident
-				switch x := field.Type.(type) {
-				case *ast.StarExpr:
-					i = x.X.(*ast.Ident)
-				case *ast.Ident:
-					i = x
+				spec := receiverIdent(field).Obj.Decl.(ast.Node)
+				if gctx.isGeneric[spec.Pos()] {
+					// A method generated onto the concrete type.
+					continue
+				}
+				if err := gctx.addDependant(spec, false); err != nil {
+					return err
 				}
-				gctx.addDependant(i.Obj.Decl.(ast.Node), false)
 			}
 		} else {
 			// If it's not a method, it must be renamed.
 			if d.Name != nil {
-				gctx.renames[d.Pos()] = &ast.Ident{
-					Name: gctx.renamer.Replace(d.Name.Name),
+				if err := gctx.addRename(d, d.Pos(), d.Name.Name); err != nil {
+					return err
 				}
 			}
 		}
 	case *ast.TypeSpec:
 		gctx.types[d.Pos()] = d
 		if d.Name != nil {
-			gctx.renames[d.Pos()] = &ast.Ident{
-				Name: gctx.renamer.Replace(d.Name.Name),
+			if err := gctx.addRename(d, d.Pos(), d.Name.Name); err != nil {
+				return err
 			}
 		}
 	case *ast.ValueSpec:
@@ -216,8 +671,8 @@ func (gctx *genericContext) addDependant(n ast.Node, isConst bool) {
 		}
 		for _, name := range d.Names {
 			if name != nil {
-				gctx.renames[name.Pos()] = &ast.Ident{
-					Name: gctx.renamer.Replace(name.Name),
+				if err := gctx.addRename(d, name.Pos(), name.Name); err != nil {
+					return err
 				}
 			}
 		}
@@ -225,9 +680,28 @@ func (gctx *genericContext) addDependant(n ast.Node, isConst bool) {
 		panic("invalid decl")
 	}
 	gctx.visited[n.Pos()] = true
+	return nil
 }
 
-func (gctx *genericContext) collectDependants(file *ast.File) {
+// addRename registers the new name of the dependant declaration n.
+func (gctx *genericContext) addRename(n ast.Node, pos token.Pos, name string) error {
+	newName, err := gctx.newName(n, name)
+	if err != nil {
+		return errors.Wrap(err, gctx.fset.Position(pos).String())
+	}
+	if newName == "" {
+		return nil
+	}
+	if dirs := gctx.directives[n]; dirs != nil && dirs.name != nil {
+		gctx.namePairs = append(gctx.namePairs, name, newName)
+	}
+	gctx.renames[pos] = &ast.Ident{
+		Name: newName,
+	}
+	return nil
+}
+
+func (gctx *genericContext) collectDependants(file *ast.File) error {
 	changed := true
 
 	type nodeData struct {
@@ -247,7 +721,17 @@ func (gctx *genericContext) collectDependants(file *ast.File) {
 			if d.Tok == token.CONST {
 				isConst = true
 			}
-			for _, s := range d.Specs {
+			var values *ast.ValueSpec
+			for i, s := range d.Specs {
+				if vs, ok := s.(*ast.ValueSpec); ok && isConst {
+					if vs.Values != nil {
+						values = vs
+					}
+					gctx.constants[vs] = constSpec{
+						index:  i,
+						values: values,
+					}
+				}
 				switch s := s.(type) {
 				case *ast.ImportSpec:
 					if s.Doc == nil {
@@ -269,6 +753,57 @@ func (gctx *genericContext) collectDependants(file *ast.File) {
 			}
 		}
 	}
+	for _, node := range nodes {
+		dirs := gctx.directives[node.n]
+		if dirs == nil {
+			continue
+		}
+		if dirs.skip {
+			gctx.visited[node.n.Pos()] = true
+		}
+		if dirs.include && !gctx.visited[node.n.Pos()] {
+			if err := gctx.addDependant(node.n, node.isConst); err != nil {
+				return err
+			}
+		}
+	}
+	// The declarations of unbound parameters are kept unchanged in partial instantiations,
+	// along with the declarations depending on them.
+	for _, node := range nodes {
+		if gctx.visited[node.n.Pos()] {
+			continue
+		}
+		for _, name := range declNames(node.n) {
+			if !gctx.unbound[name.Name] {
+				continue
+			}
+			dirs := gctx.directives[node.n]
+			if dirs == nil {
+				dirs = &directives{}
+				gctx.directives[node.n] = dirs
+			}
+			dirs.keep, dirs.name = true, nil
+			if err := gctx.addDependant(node.n, node.isConst); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	// Declarations whose names contain the fragment of an identifier mapping
+	// are renamed, so they are generated even if they don't depend on a generic type.
+	for _, node := range nodes {
+		if gctx.visited[node.n.Pos()] {
+			continue
+		}
+		for _, name := range declNames(node.n) {
+			if gctx.hasIdentFragment(name.Name) {
+				if err := gctx.addDependant(node.n, node.isConst); err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
 	for changed {
 		changed = false
 		for _, node := range nodes {
@@ -277,10 +812,17 @@ func (gctx *genericContext) collectDependants(file *ast.File) {
 			}
 			if gctx.isDependant(node.n) {
 				changed = true
-				gctx.addDependant(node.n, node.isConst)
+				if err := gctx.addDependant(node.n, node.isConst); err != nil {
+					return err
+				}
 			}
 		}
 	}
+	if len(gctx.namePairs) > 0 {
+		// Explicit names take precedence when renaming comments.
+		gctx.renamer = append(newRenamer(gctx.namePairs, false), gctx.renamer...)
+	}
+	return nil
 }
 
 func (gctx *genericContext) doRenames(n ast.Node) {
@@ -303,11 +845,61 @@ func (gctx *genericContext) doRenames(n ast.Node) {
 	}
 	renames := make([]*renameJob, 0)
 	Apply(n, func(parent ast.Node, name string, index int, n ast.Node) bool {
+		if d, ok := n.(*ast.FuncDecl); ok && gctx.funcArgs[d.Name.Name] == d {
+			// Skip the placeholder function, it's not generated.
+			return false
+		}
+		if pkg := gctx.packageSelector(n); pkg != nil {
+			sel := n.(*ast.SelectorExpr)
+			var replacement ast.Node = &ast.SelectorExpr{
+				X: &ast.Ident{
+					Name: pkg.PkgName,
+				},
+				Sel: sel.Sel,
+			}
+			if pkg.PkgName == "" {
+				// dot import
+				replacement = sel.Sel
+			}
+			renames = append(renames, &renameJob{
+				parent:      parent,
+				name:        name,
+				index:       index,
+				replacement: replacement,
+			})
+			return false
+		}
+		if n, ok := n.(*ast.Ident); ok && n != nil && gctx.isDependantField(n) {
+			if newName := newRenamer(gctx.identPairs, true).Replace(n.Name); newName != n.Name {
+				renames = append(renames, &renameJob{
+					parent:      parent,
+					name:        name,
+					index:       index,
+					replacement: &ast.Ident{Name: newName},
+				})
+			}
+			return false
+		}
+		if n, ok := n.(*ast.Ident); ok && n != nil && n.Obj == nil && gctx.isUndefined(parent, name, n) {
+			if newName := gctx.renamer.Replace(n.Name); newName != n.Name {
+				renames = append(renames, &renameJob{
+					parent:      parent,
+					name:        name,
+					index:       index,
+					replacement: &ast.Ident{Name: newName},
+				})
+			}
+			return true
+		}
 		if n, ok := n.(*ast.Ident); ok && n != nil && n.Obj != nil {
 			if gctx.isGeneric[n.Pos()] {
 				// Skip the generic type declaration.
 				return false
 			}
+			if _, ok := gctx.values[n.Pos()]; ok {
+				// Skip the placeholder constant's declaration.
+				return false
+			}
 			// check types
 			if spec, ok := n.Obj.Decl.(*ast.TypeSpec); ok {
 				if renameTo, ok := gctx.renames[spec.Pos()]; ok {
@@ -362,28 +954,332 @@ func (gctx *genericContext) doRenames(n ast.Node) {
 	}
 }
 
+// isUndefined reports whether the identifier n, the child of parent
+// with the given field name, is used but not declared by the template,
+// if the template uses other templates.
+// isDependantField reports whether n declares or refers to a field
+// of a struct type that is generated, whose name is renamed with the identifier mappings.
+func (gctx *genericContext) isDependantField(n *ast.Ident) bool {
+	if len(gctx.identPairs) == 0 {
+		return false
+	}
+	info := gctx.templateInfo()
+	obj := info.Defs[n]
+	if obj == nil {
+		obj = info.Uses[n]
+	}
+	v, ok := obj.(*types.Var)
+	if !ok || !v.IsField() || v.Embedded() {
+		return false
+	}
+	for pos, spec := range gctx.types {
+		if !gctx.isGeneric[pos] && spec.Pos() <= v.Pos() && v.Pos() < spec.End() {
+			return true
+		}
+	}
+	return false
+}
+
+func (gctx *genericContext) isUndefined(parent ast.Node, name string, n *ast.Ident) bool {
+	if !gctx.renameUndefined {
+		return false
+	}
+	if _, ok := parent.(*ast.SelectorExpr); ok && name == "Sel" {
+		return false
+	}
+	info := gctx.templateInfo()
+	if _, ok := info.Uses[n]; ok {
+		return false
+	}
+	if _, ok := info.Defs[n]; ok {
+		return false
+	}
+	// Identifiers created during generation are not in the type information.
+	return n.Pos().IsValid()
+}
+
 func (gctx *genericContext) renameComments(cg *ast.CommentGroup) *ast.CommentGroup {
 	if cg == nil {
 		return cg
 	}
+	// rei directives are not copied to the output,
+	// except to the template produced by a partial instantiation.
+	// Names have already been generated, so those directives are never copied.
+	list := make([]*ast.Comment, 0, len(cg.List))
 	for _, c := range cg.List {
+		if isDirective(c) {
+			if name, _ := splitDirective(c); gctx.partial && name != "name" {
+				list = append(list, c)
+			}
+			continue
+		}
 		c.Text = gctx.renamer.Replace(c.Text)
+		list = append(list, c)
+	}
+	if len(list) == 0 {
+		return nil
 	}
+	cg.List = list
 	return cg
 }
 
-func gen(in io.Reader, inFilename string, targetPackageName string, typeMapping map[string]*Type, out io.Writer, outFilename string) error {
+// kindOrderDecls returns the output declarations grouped by kind:
+// types, constants, variables and functions, each sorted by position.
+func (gctx *genericContext) kindOrderDecls() []ast.Decl {
+	var decls []ast.Decl
+
+	sortedTypes := sortSpecs(gctx.types)
+	for _, spec := range sortedTypes {
+		ts, ok := spec.(*ast.TypeSpec)
+		if !ok {
+			continue
+		}
+		newTs := &ast.TypeSpec{
+			Name: ts.Name,
+			Type: ts.Type,
+		}
+		decl := &ast.GenDecl{
+			Tok: token.TYPE,
+			Doc: gctx.renameComments(ts.Doc),
+			Specs: []ast.Spec{
+				newTs,
+			},
+		}
+		decls = append(decls, decl)
+	}
+
+	sortedConsts := sortSpecs(gctx.consts)
+	for _, spec := range sortedConsts {
+		vs, ok := spec.(*ast.ValueSpec)
+		if !ok {
+			continue
+		}
+		newVs := gctx.explicitConst(vs)
+		decl := &ast.GenDecl{
+			Tok: token.CONST,
+			Doc: gctx.renameComments(vs.Doc),
+			Specs: []ast.Spec{
+				newVs,
+			},
+		}
+		decls = append(decls, decl)
+	}
+
+	sortedVars := sortSpecs(gctx.vars)
+	for _, spec := range sortedVars {
+		vs, ok := spec.(*ast.ValueSpec)
+		if !ok {
+			continue
+		}
+		newVs := &ast.ValueSpec{
+			Names:  vs.Names,
+			Type:   vs.Type,
+			Values: vs.Values,
+		}
+		decl := &ast.GenDecl{
+			Tok: token.VAR,
+			Doc: gctx.renameComments(vs.Doc),
+			Specs: []ast.Spec{
+				newVs,
+			},
+		}
+		decls = append(decls, decl)
+	}
+
+	funcDecls := sortDecls(gctx.funcs)
+	for _, decl := range funcDecls {
+		fdecl, ok := decl.(*ast.FuncDecl)
+		if !ok {
+			continue
+		}
+		for _, fdecl := range gctx.outputFuncs(fdecl) {
+			newFdecl := &ast.FuncDecl{
+				Doc:  gctx.renameComments(fdecl.Doc),
+				Recv: fdecl.Recv,
+				Name: fdecl.Name,
+				Type: fdecl.Type,
+				Body: fdecl.Body,
+			}
+			decls = append(decls, newFdecl)
+		}
+	}
+
+	return decls
+}
+
+// constSpec is the place of a constant spec in its group.
+type constSpec struct {
+	// index is the value of iota in the spec.
+	index int
+	// values is the spec whose type and values the spec repeats,
+	// the spec itself if it has values.
+	values *ast.ValueSpec
+}
+
+// explicitConst returns a copy of a constant spec that doesn't depend on
+// the rest of its group: with the type and values it repeats,
+// and iota replaced with its value.
+func (gctx *genericContext) explicitConst(vs *ast.ValueSpec) *ast.ValueSpec {
+	c, ok := gctx.constants[vs]
+	if !ok || c.values == nil || (c.values == vs && c.index == 0) {
+		return &ast.ValueSpec{
+			Names:  vs.Names,
+			Type:   vs.Type,
+			Values: vs.Values,
+		}
+	}
+	explicit := copyNodeWith(&ast.ValueSpec{
+		Type:   c.values.Type,
+		Values: c.values.Values,
+	}, func(n ast.Node) ast.Node {
+		if id, ok := n.(*ast.Ident); ok && id.Name == "iota" && id.Obj == nil {
+			return &ast.BasicLit{
+				Kind:  token.INT,
+				Value: strconv.Itoa(c.index),
+			}
+		}
+		return nil
+	}).(*ast.ValueSpec)
+	explicit.Names = vs.Names
+	return explicit
+}
+
+// sourceOrderDecls returns the output declarations in the order
+// they appear in the source file, keeping grouped declarations grouped.
+func (gctx *genericContext) sourceOrderDecls(file *ast.File) []ast.Decl {
+	output := make(map[ast.Node]bool)
+	for _, spec := range gctx.types {
+		output[spec] = true
+	}
+	for _, spec := range gctx.consts {
+		output[spec] = true
+	}
+	for _, spec := range gctx.vars {
+		output[spec] = true
+	}
+	for _, decl := range gctx.funcs {
+		output[decl] = true
+	}
+
+	var decls []ast.Decl
+	for _, decl := range file.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if !output[d] {
+				continue
+			}
+			for _, d := range gctx.outputFuncs(d) {
+				decls = append(decls, &ast.FuncDecl{
+					Doc:  gctx.renameComments(d.Doc),
+					Recv: d.Recv,
+					Name: d.Name,
+					Type: d.Type,
+					Body: d.Body,
+				})
+			}
+		case *ast.GenDecl:
+			if d.Tok == token.IMPORT {
+				continue
+			}
+			var specs []ast.Spec
+			// The constants following a constant that is not generated
+			// lose the values they repeat and their iota.
+			complete := true
+			for _, spec := range d.Specs {
+				if !output[spec] {
+					complete = false
+					continue
+				}
+				var doc *ast.CommentGroup
+				switch s := spec.(type) {
+				case *ast.TypeSpec:
+					// collectDependants copies the group's doc to its specs.
+					if s.Doc != d.Doc {
+						doc = s.Doc
+					}
+					specs = append(specs, &ast.TypeSpec{
+						Doc:  doc,
+						Name: s.Name,
+						Type: s.Type,
+					})
+				case *ast.ValueSpec:
+					if s.Doc != d.Doc {
+						doc = s.Doc
+					}
+					newVs := &ast.ValueSpec{
+						Names:  s.Names,
+						Type:   s.Type,
+						Values: s.Values,
+					}
+					if d.Tok == token.CONST && !complete {
+						newVs = gctx.explicitConst(s)
+					}
+					newVs.Doc = doc
+					specs = append(specs, newVs)
+				}
+			}
+			if len(specs) == 0 {
+				continue
+			}
+			newDecl := &ast.GenDecl{
+				Tok:   d.Tok,
+				Doc:   gctx.renameComments(d.Doc),
+				Specs: specs,
+			}
+			if len(specs) == 1 {
+				// A single spec is printed without parentheses,
+				// its doc becomes the declaration's doc.
+				switch s := specs[0].(type) {
+				case *ast.TypeSpec:
+					if s.Doc != nil {
+						newDecl.Doc = s.Doc
+						s.Doc = nil
+					}
+				case *ast.ValueSpec:
+					if s.Doc != nil {
+						newDecl.Doc = s.Doc
+						s.Doc = nil
+					}
+				}
+			}
+			for _, spec := range specs {
+				switch s := spec.(type) {
+				case *ast.TypeSpec:
+					s.Doc = gctx.renameComments(s.Doc)
+				case *ast.ValueSpec:
+					s.Doc = gctx.renameComments(s.Doc)
+				}
+			}
+			decls = append(decls, newDecl)
+		}
+	}
+	return decls
+}
+
+func gen(in io.Reader, inFilename string, targetPackageName string, typeMapping map[string]*Type, out io.Writer, outFilename string, opts genOptions) error {
 
 	gctx := &genericContext{
 		fset:         token.NewFileSet(),
 		genericTypes: typeMapping,
 		types:        make(map[token.Pos]ast.Spec),
 		isGeneric:    make(map[token.Pos]bool),
+		values:       make(map[token.Pos]*ast.ValueSpec),
+		constants:    make(map[*ast.ValueSpec]constSpec),
+		funcArgs:     make(map[string]*ast.FuncDecl),
+		packages:     make(map[string]*Type),
 		funcs:        make(map[token.Pos]ast.Decl),
 		vars:         make(map[token.Pos]ast.Spec),
 		consts:       make(map[token.Pos]ast.Spec),
 		visited:      make(map[token.Pos]bool),
 		renames:      make(map[token.Pos]ast.Expr),
+		directives:   make(map[ast.Node]*directives),
+		loader:       newTypeLoader(opts.Dir),
+		warnings:     opts.Warnings,
+		methods:      opts.Methods,
+		partial:      opts.Partial,
+		unbound:      make(map[string]bool),
+
+		expandedMethods: make(map[*ast.FuncDecl][]*ast.FuncDecl),
 	}
 	file, err := parser.ParseFile(gctx.fset, inFilename, in, parser.ParseComments)
 	if err != nil {
@@ -392,6 +1288,34 @@ func gen(in io.Reader, inFilename string, targetPackageName string, typeMapping
 
 	// ast.Print(gctx.fset, file)
 
+	params, err := parseParams(gctx.fset, file)
+	if err != nil {
+		return errors.Wrap(err, "parsing parameters failed")
+	}
+	uses, err := parseUses(gctx.fset, file)
+	if err != nil {
+		return errors.Wrap(err, "parsing used templates failed")
+	}
+	gctx.renameUndefined = len(uses) > 0
+
+	var unbound []*Param
+	if opts.Partial {
+		if len(params) == 0 {
+			return errors.New("partial instantiation requires a template that declares its parameters")
+		}
+		params, unbound = splitParams(params, typeMapping)
+		for _, p := range unbound {
+			gctx.unbound[p.Name] = true
+		}
+	}
+	err = applyParams(params, typeMapping)
+	if err != nil {
+		return err
+	}
+	if len(typeMapping) == 0 {
+		return errors.New("empty type mapping")
+	}
+
 	// TODO: multiple files
 
 	outImports := make([]*ast.ImportSpec, 0)
@@ -441,10 +1365,81 @@ func gen(in io.Reader, inFilename string, targetPackageName string, typeMapping
 		}
 	}
 
-	outImports = append(outImports, file.Imports...)
+	gctx.file = file
+	err = gctx.registerGenericTypes(file)
+	if err != nil {
+		return err
+	}
+
+	for _, importSpec := range file.Imports {
+		if gType := gctx.packages[importName(importSpec)]; gType != nil && importSpec.Path.Value != strconv.Quote(gType.Pkg) {
+			// The package is substituted.
+			continue
+		}
+		outImports = append(outImports, importSpec)
+	}
+	err = gctx.collectFieldLoops(file)
+	if err != nil {
+		return err
+	}
+	err = gctx.specialize(file)
+	if err != nil {
+		return errors.Wrap(err, "specializing failed")
+	}
+	err = gctx.collectDirectives(file)
+	if err != nil {
+		return errors.Wrap(err, "parsing directives failed")
+	}
+	err = gctx.collectMethodLoops(file)
+	if err != nil {
+		return err
+	}
+	err = gctx.applyShims(file)
+	if err != nil {
+		return errors.Wrap(err, "applying shims failed")
+	}
+	err = gctx.applyFields(file)
+	if err != nil {
+		return errors.Wrap(err, "renaming fields failed")
+	}
+	err = gctx.applyEmbedded(file)
+	if err != nil {
+		return errors.Wrap(err, "renaming embedded fields failed")
+	}
+	err = gctx.checkConstraints(params)
+	if err != nil {
+		return err
+	}
+	err = gctx.collectDependants(file)
+	if err != nil {
+		return errors.Wrap(err, "collecting dependants failed")
+	}
+	err = gctx.applyOverrides(file)
+	if err != nil {
+		return errors.Wrap(err, "applying overrides failed")
+	}
+	if !gctx.hasDependants() {
+		return &mappingError{
+			msg: "no declarations depend on the generic types",
+		}
+	}
+	gctx.warnUnused()
 
-	gctx.registerGenericTypes(file)
-	gctx.collectDependants(file)
+	fieldImports, err := gctx.expandFieldLoops(file)
+	if err != nil {
+		return errors.Wrap(err, "expanding fields failed")
+	}
+	outImports = addImports(outImports, fieldImports)
+	methodImports, err := gctx.expandMethodLoops()
+	if err != nil {
+		return errors.Wrap(err, "expanding methods failed")
+	}
+	outImports = addImports(outImports, methodImports)
+	adapterDecls, adapterImports, err := gctx.adapters()
+	if err != nil {
+		return err
+	}
+	outImports = addImports(outImports, adapterImports)
 
 	/*
 		fmt.Println("Dependants")
@@ -485,86 +1480,20 @@ func gen(in io.Reader, inFilename string, targetPackageName string, typeMapping
 		outFile.Decls = append(outFile.Decls, importDecl)
 	}
 
-	sortedTypes := sortSpecs(gctx.types)
-	for _, spec := range sortedTypes {
-		ts, ok := spec.(*ast.TypeSpec)
-		if !ok {
-			continue
-		}
-		newTs := &ast.TypeSpec{
-			Name: ts.Name,
-			Type: ts.Type,
-		}
-		decl := &ast.GenDecl{
-			Tok: token.TYPE,
-			Doc: gctx.renameComments(ts.Doc),
-			Specs: []ast.Spec{
-				newTs,
-			},
-		}
-		outFile.Decls = append(outFile.Decls, decl)
-	}
-
-	sortedConsts := sortSpecs(gctx.consts)
-	for _, spec := range sortedConsts {
-		vs, ok := spec.(*ast.ValueSpec)
-		if !ok {
-			continue
-		}
-		newVs := &ast.ValueSpec{
-			Names:  vs.Names,
-			Type:   vs.Type,
-			Values: vs.Values,
-		}
-		decl := &ast.GenDecl{
-			Tok: token.CONST,
-			Doc: gctx.renameComments(vs.Doc),
-			Specs: []ast.Spec{
-				newVs,
-			},
-		}
-		outFile.Decls = append(outFile.Decls, decl)
-	}
-
-	sortedVars := sortSpecs(gctx.vars)
-	for _, spec := range sortedVars {
-		vs, ok := spec.(*ast.ValueSpec)
-		if !ok {
-			continue
-		}
-		newVs := &ast.ValueSpec{
-			Names:  vs.Names,
-			Type:   vs.Type,
-			Values: vs.Values,
-		}
-		decl := &ast.GenDecl{
-			Tok: token.VAR,
-			Doc: gctx.renameComments(vs.Doc),
-			Specs: []ast.Spec{
-				newVs,
-			},
-		}
-		outFile.Decls = append(outFile.Decls, decl)
-	}
-
-	funcDecls := sortDecls(gctx.funcs)
-	for _, decl := range funcDecls {
-		fdecl, ok := decl.(*ast.FuncDecl)
-		if !ok {
-			continue
-		}
-		newFdecl := &ast.FuncDecl{
-			Doc:  gctx.renameComments(fdecl.Doc),
-			Recv: fdecl.Recv,
-			Name: fdecl.Name,
-			Type: fdecl.Type,
-			Body: fdecl.Body,
-		}
-		outFile.Decls = append(outFile.Decls, newFdecl)
+	if opts.SourceOrder {
+		outFile.Decls = append(outFile.Decls, gctx.sourceOrderDecls(file)...)
+	} else {
+		outFile.Decls = append(outFile.Decls, gctx.kindOrderDecls()...)
 	}
+	outFile.Decls = append(outFile.Decls, adapterDecls...)
 
 	// newTokenPositioner().fixPositions(outFile)
+	layout := sourceLayout(gctx.fset, outFile)
 	clearPositions(outFile)
+	err = positionGroups(outFset, outFile, layout)
+	if err != nil {
+		return errors.Wrap(err, "positioning declarations failed")
+	}
 
 	// ast.Print(outFset, outFile)
 
@@ -575,6 +1504,13 @@ func gen(in io.Reader, inFilename string, targetPackageName string, typeMapping
 	buff := &bytes.Buffer{}
 
 	buff.WriteString("// Code generated by rei. DO NOT EDIT.\n\n")
+	if len(unbound) > 0 {
+		// The output is a template with the unbound parameters.
+		for _, p := range unbound {
+			buff.WriteString(p.String() + "\n")
+		}
+		buff.WriteString("\n")
+	}
 
 	err = printer.Fprint(buff, outFset, outFile)
 	if err != nil {
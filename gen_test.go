@@ -3,8 +3,13 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -15,6 +20,7 @@ func TestGen(t *testing.T) {
 		src         string
 		expected    string
 		typeMapping map[string]*Type
+		opts        genOptions
 	}{
 		{
 			src: `package main
@@ -50,8 +56,7 @@ func (dao *TypeDAO) Empty() {
 package main
 
 // ConcreteDAO implements DAO for Concrete
-type ConcreteDAO struct {
-}
+type ConcreteDAO struct{}
 
 // zeroConcrete is the zero value of Concrete
 var zeroConcrete Concrete
@@ -106,8 +111,7 @@ func (dao *TypeDAO) Empty() {
 
 package main
 
-type ConcreteDAO struct {
-}
+type ConcreteDAO struct{}
 
 var zero Concrete
 
@@ -322,16 +326,2053 @@ func ConcreteFrobnicator(t *Concrete) {
 				},
 			},
 		},
+		{
+			src: `package main
+
+type Type struct {
+	ID int64
+}
+
+// NewTypeList returns a new TypeList.
+func NewTypeList() TypeList {
+	return nil
+}
+
+// TypeList is a list of Type.
+type TypeList []Type
+
+const (
+	// MaxTypes is the maximum length of a TypeList.
+	MaxTypes = 10
+	typeSize Type = 0
+	other = 1
+)
+
+var zeroType Type
+`,
+			expected: `// Code generated by rei. DO NOT EDIT.
+
+package main
+
+// NewConcreteList returns a new ConcreteList.
+func NewConcreteList() ConcreteList {
+	return nil
+}
+
+// ConcreteList is a list of Concrete.
+type ConcreteList []Concrete
+
+const concreteSize Concrete = 0
+
+var zeroConcrete Concrete
+`,
+			typeMapping: map[string]*Type{
+				"Type": {
+					Name: "Concrete",
+				},
+			},
+			opts: genOptions{
+				SourceOrder: true,
+			},
+		},
+		{
+			src: `package main
+
+type Type int
+
+// Type values.
+const (
+	ZeroType Type = 0
+	// OneType is one.
+	OneType Type = 1
+	other        = 2
+)
+
+func AddType(a, b Type) Type {
+	return a + b
+}
+`,
+			expected: `// Code generated by rei. DO NOT EDIT.
+
+package main
+
+// Concrete values.
+const (
+	ZeroConcrete Concrete = 0
+	// OneConcrete is one.
+	OneConcrete Concrete = 1
+)
+
+func AddConcrete(a, b Concrete) Concrete {
+	return a + b
+}
+`,
+			typeMapping: map[string]*Type{
+				"Type": {
+					Name: "Concrete",
+				},
+			},
+			opts: genOptions{
+				SourceOrder: true,
+			},
+		},
+		{
+			src: `package main
+
+type Type struct {
+	ID int64
+}
+
+//rei:skip
+func typeDebug(t Type) {
+}
+
+// IndexType indexes Types.
+//rei:name {{.Type}}Index
+type IndexType map[int64]Type
+
+//rei:keep
+func Lookup(i IndexType, id int64) Type {
+	return i[id]
+}
+
+// helper is not dependant.
+//rei:include
+//rei:name {{lower .Type}}Helper
+func helper() {
+}
+`,
+			expected: `// Code generated by rei. DO NOT EDIT.
+
+package main
+
+// ConcreteIndex indexes Concretes.
+type ConcreteIndex map[int64]Concrete
+
+func Lookup(i ConcreteIndex, id int64) Concrete {
+	return i[id]
+}
+
+// concreteHelper is not dependant.
+func concreteHelper() {
+}
+`,
+			typeMapping: map[string]*Type{
+				"Type": {
+					Name: "Concrete",
+				},
+			},
+			opts: genOptions{
+				SourceOrder: true,
+			},
+		},
+		{
+			src: `//rei:param Key
+//rei:param Value
+
+package main
+
+type Key int
+type Value int
+
+// KeyValueIndex maps Keys to Values.
+//rei:name {{upper .Key}}By{{.Value}}
+type KeyValueIndex map[Key]Value
+
+func NewKeyValueIndex() KeyValueIndex {
+	return make(KeyValueIndex)
+}
+`,
+			expected: `// Code generated by rei. DO NOT EDIT.
+
+package main
+
+// StringByUser maps Strings to Users.
+type StringByUser map[string]User
+
+func NewStringUserIndex() StringByUser {
+	return make(StringByUser)
+}
+`,
+			typeMapping: map[string]*Type{
+				"Key": {
+					Name: "string",
+				},
+				"Value": {
+					Name: "User",
+				},
+			},
+			opts: genOptions{
+				SourceOrder: true,
+			},
+		},
+		{
+			src: `//rei:param KeyType doc="key type"
+//rei:param ValueType default=int
+package main
+
+type KeyType interface{}
+type ValueType interface{}
+type KeyTypeValueTypeMap map[KeyType]ValueType
+`,
+			expected: `// Code generated by rei. DO NOT EDIT.
+
+package main
+
+type StringIntMap map[string]int
+`,
+			typeMapping: map[string]*Type{
+				"KeyType": {
+					Name: "string",
+				},
+			},
+		},
+		{
+			src: `package main
+
+import (
+	"fmt"
+
+	"github.com/nkovacs/rei/lib/rei"
+)
+
+type Type int
+
+func FormatType(v Type) string {
+	if rei.Is[Type, string]() {
+		return "string"
+	} else {
+		return "other"
+	}
+}
+
+func SizeType(v Type) int {
+	if rei.Is[Type, int]() {
+		return int(v)
+	}
+	println("not an int")
+	return 0
+}
+
+func DescribeType(v Type) string {
+	switch x := any(v).(type) {
+	case fmt.Stringer:
+		return x.String()
+	case int:
+		return "int"
+	default:
+		return "unknown"
+	}
+}
+
+func PrintType(v Type) {
+	//rei:if Type==int
+	println(v + 1)
+	//rei:else
+	println(v)
+	//rei:end
+}
+`,
+			expected: `// Code generated by rei. DO NOT EDIT.
+
+package main
+
+func FormatInt(v int) string {
+	return "other"
+}
+func SizeInt(v int) int {
+	return int(v)
+}
+func DescribeInt(v int) string {
+	return "int"
+}
+func PrintInt(v int) {
+	println(v + 1)
+}
+`,
+			typeMapping: map[string]*Type{
+				"Type": {
+					Name: "int",
+				},
+			},
+			opts: genOptions{
+				SourceOrder: true,
+			},
+		},
+		{
+			src: `package main
+
+type Type int
+
+// JoinType joins values.
+func JoinType(vs []Type) string {
+	return fmt.Sprint(vs)
+}
+
+func JoinType_string(vs []string) string {
+	return strings.Join(vs, ",")
+}
+
+func JoinType_int(vs []int) string {
+	return ""
+}
+
+// SumType sums values.
+func SumType(vs []Type) Type {
+	var sum Type
+	for _, v := range vs {
+		sum += v
 	}
+	return sum
+}
 
-	for i, tc := range testCases {
-		tc := tc
-		t.Run(fmt.Sprintf("case %v", i), func(t *testing.T) {
-			inBuff := bytes.NewBufferString(tc.src)
-			outBuff := &bytes.Buffer{}
-			gen(inBuff, "in.go", "", tc.typeMapping, outBuff, "out.go")
+// sumStrings is the override of SumType for strings.
+//rei:override SumType Type=string
+func sumStrings(vs []string) string {
+	return strings.Join(vs, "")
+}
+`,
+			expected: `// Code generated by rei. DO NOT EDIT.
 
-			assert.Equal(tc.expected, outBuff.String())
-		})
+package main
+
+import "strings"
+
+// JoinString joins values.
+func JoinString(vs []string) string {
+	return strings.Join(vs, ",")
+}
+
+// SumString sums values.
+func SumString(vs []string) string {
+	return strings.Join(vs, "")
+}
+`,
+			typeMapping: map[string]*Type{
+				"Type": {
+					Name: "string",
+				},
+			},
+			opts: genOptions{
+				SourceOrder: true,
+			},
+		},
+		{
+			src: `package main
+
+type Type int
+
+func parseType(s string) Type {
+	return Type(len(s))
+}
+
+func parseType_v2(v Type) Type {
+	return v * 2
+}
+
+func sumType(vs []Type) Type {
+	var sum Type
+	for _, v := range vs {
+		sum += v
+	}
+	return sum
+}
+
+func sumType_string(vs []Type) Type {
+	return Type(len(vs))
+}
+`,
+			expected: `// Code generated by rei. DO NOT EDIT.
+
+package main
+
+func parseInt(s string) int {
+	return int(len(s))
+}
+func sumInt(vs []int) int {
+	var sum int
+	for _, v := range vs {
+		sum += v
+	}
+	return sum
+}
+`,
+			typeMapping: map[string]*Type{
+				"Type": {
+					Name: "int",
+				},
+			},
+			opts: genOptions{
+				SourceOrder: true,
+			},
+		},
+		{
+			src: `package main
+
+//rei:builtin Before = a < b
+//rei:builtin Equal(x, y) = equalType(x, y)
+type Type interface {
+	Before(Type) bool
+	Equal(Type) bool
+}
+
+func equalType(a, b Type) bool {
+	return a == b
+}
+
+func MaxType(vs ...Type) Type {
+	max := vs[0]
+	for _, v := range vs[1:] {
+		if max.Before(v) && !max.Equal(v) {
+			max = v
+		}
+	}
+	return max
+}
+`,
+			expected: `// Code generated by rei. DO NOT EDIT.
+
+package main
+
+func equalInt(a, b int) bool {
+	return a == b
+}
+func MaxInt(vs ...int) int {
+	max := vs[0]
+	for _, v := range vs[1:] {
+		if max < v && !equalInt(max, v) {
+			max = v
+		}
+	}
+	return max
+}
+`,
+			typeMapping: map[string]*Type{
+				"Type": {
+					Name: "int",
+				},
+			},
+			opts: genOptions{
+				SourceOrder: true,
+			},
+		},
+		{
+			src: `package main
+
+//rei:builtin Before = a < b
+//rei:builtin Equal(x, y) = equalType(x, y)
+type Type interface {
+	Before(Type) bool
+	Equal(Type) bool
+}
+
+func equalType(a, b Type) bool {
+	return a == b
+}
+
+func MaxType(vs ...Type) Type {
+	max := vs[0]
+	for _, v := range vs[1:] {
+		if max.Before(v) && !max.Equal(v) {
+			max = v
+		}
+	}
+	return max
+}
+`,
+			expected: `// Code generated by rei. DO NOT EDIT.
+
+package main
+
+import "time"
+
+func equalTime(a, b time.Time) bool {
+	return a == b
+}
+func MaxTime(vs ...time.Time) time.Time {
+	max := vs[0]
+	for _, v := range vs[1:] {
+		if max.Before(v) && !max.Equal(v) {
+			max = v
+		}
+	}
+	return max
+}
+`,
+			typeMapping: map[string]*Type{
+				"Type": {
+					Name:    "Time",
+					Pkg:     "time",
+					PkgName: "time",
+				},
+			},
+			opts: genOptions{
+				SourceOrder: true,
+			},
+		},
+		{
+			src: `package main
+
+//rei:builtin Square = a * a
+type Type interface {
+	Square() Type
+}
+
+type pairType struct {
+	x, y Type
+}
+
+func SumSquaresType(p pairType) Type {
+	return p.x.Square() + p.y.Square()
+}
+`,
+			expected: `// Code generated by rei. DO NOT EDIT.
+
+package main
+
+type pairInt struct {
+	x, y int
+}
+
+func SumSquaresInt(p pairInt) int {
+	return p.x*p.x + p.y*p.y
+}
+`,
+			typeMapping: map[string]*Type{
+				"Type": {
+					Name: "int",
+				},
+			},
+			opts: genOptions{
+				SourceOrder: true,
+			},
+		},
+		{
+			src: `package main
+
+//rei:builtin func Before = a < b
+type Type interface {
+	Before(Type) bool
+}
+
+func MaxType(vs ...Type) Type {
+	max := vs[0]
+	for _, v := range vs[1:] {
+		if max.Before(v) {
+			max = v
+		}
+	}
+	return max
+}
+
+func MinType(vs ...Type) Type {
+	min := vs[0]
+	for _, v := range vs[1:] {
+		if v.Before(min) {
+			min = v
+		}
+	}
+	return min
+}
+`,
+			expected: `// Code generated by rei. DO NOT EDIT.
+
+package main
+
+func beforeInt(a int, b int) bool {
+	return a < b
+}
+func MaxInt(vs ...int) int {
+	max := vs[0]
+	for _, v := range vs[1:] {
+		if beforeInt(max, v) {
+			max = v
+		}
+	}
+	return max
+}
+func MinInt(vs ...int) int {
+	min := vs[0]
+	for _, v := range vs[1:] {
+		if beforeInt(v, min) {
+			min = v
+		}
+	}
+	return min
+}
+`,
+			typeMapping: map[string]*Type{
+				"Type": {
+					Name: "int",
+				},
+			},
+			opts: genOptions{
+				SourceOrder: true,
+			},
+		},
+		{
+			src: `package main
+
+type Type struct {
+	ID   int64
+	Name string
+}
+
+func (t Type) Key() string {
+	return t.Name
+}
+
+func NewType(id int64) *Type {
+	return &Type{ID: id}
+}
+
+func IndexType(vs []*Type) map[string]int64 {
+	index := make(map[string]int64)
+	for _, v := range vs {
+		index[v.Key()] = v.ID
+	}
+	return index
+}
+`,
+			expected: `// Code generated by rei. DO NOT EDIT.
+
+package main
+
+func NewUser(id int64) *User {
+	return &User{UserID: id}
+}
+func IndexUser(vs []*User) map[string]int64 {
+	index := make(map[string]int64)
+	for _, v := range vs {
+		index[v.Email()] = v.UserID
+	}
+	return index
+}
+`,
+			typeMapping: map[string]*Type{
+				"Type": {
+					Name: "User",
+					Fields: map[string]string{
+						"ID":  "UserID",
+						"Key": "Email",
+					},
+				},
+			},
+			opts: genOptions{
+				SourceOrder: true,
+			},
+		},
+		{
+			src: `package main
+
+type Type interface{}
+
+const Size = 16
+
+const Prefix string = "items"
+
+// RingBufferSize is a ring buffer of Size Types.
+type RingBufferSize struct {
+	items [Size]Type
+	next  int
+}
+
+func (r *RingBufferSize) Push(v Type) {
+	r.items[r.next] = v
+	r.next = (r.next + 1) % Size
+}
+
+func keyPrefix(id string) string {
+	return Prefix + "/" + id
+}
+`,
+			expected: `// Code generated by rei. DO NOT EDIT.
+
+package main
+
+// RingBuffer64 is a ring buffer of 64 Ints.
+type RingBuffer64 struct {
+	items [64]int
+	next  int
+}
+
+func (r *RingBuffer64) Push(v int) {
+	r.items[r.next] = v
+	r.next = (r.next + 1) % 64
+}
+func keyUsers(id string) string {
+	return string("users") + "/" + id
+}
+`,
+			typeMapping: map[string]*Type{
+				"Type": {
+					Name: "int",
+				},
+				"Size": {
+					Name:  "64",
+					Value: "64",
+				},
+				"Prefix": {
+					Name:  "users",
+					Value: strconv.Quote("users"),
+				},
+			},
+			opts: genOptions{
+				SourceOrder: true,
+			},
+		},
+		{
+			src: `package main
+
+type Type interface{}
+
+// compare is the comparator of Types.
+func compare(a, b Type) int {
+	panic("placeholder")
+}
+
+func hash(v Type) uint64 {
+	panic("placeholder")
+}
+
+func InsertType(vs []Type, v Type) []Type {
+	i := 0
+	for i < len(vs) && compare(vs[i], v) < 0 {
+		i++
+	}
+	vs = append(vs, v)
+	copy(vs[i+1:], vs[i:])
+	vs[i] = v
+	return vs
+}
+
+func shard(key string, shards int) int {
+	return int(hash(key) % uint64(shards))
+}
+`,
+			expected: `// Code generated by rei. DO NOT EDIT.
+
+package main
+
+import "strings"
+
+func InsertString(vs []string, v string) []string {
+	i := 0
+	for i < len(vs) && strings.Compare(vs[i], v) < 0 {
+		i++
+	}
+	vs = append(vs, v)
+	copy(vs[i+1:], vs[i:])
+	vs[i] = v
+	return vs
+}
+func shard(key string, shards int) int {
+	return int(hashString(key) % uint64(shards))
+}
+`,
+			typeMapping: map[string]*Type{
+				"Type": {
+					Name: "string",
+				},
+				"compare": {
+					Name:    "Compare",
+					Pkg:     "strings",
+					PkgName: "strings",
+				},
+				"hash": {
+					Name: "hashString",
+				},
+			},
+			opts: genOptions{
+				SourceOrder: true,
+			},
+		},
+		{
+			src: `package main
+
+import (
+	"fmt"
+
+	storage "github.com/acme/storage/sql"
+)
+
+type Type struct {
+	ID int64
+}
+
+func OpenTypeStore(dsn string) (*storage.DB, error) {
+	return storage.Open(dsn)
+}
+
+func Describe(db *storage.DB) string {
+	return fmt.Sprint(db)
+}
+
+func Version() string {
+	return fmt.Sprint(1)
+}
+`,
+			expected: `// Code generated by rei. DO NOT EDIT.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/acme/storage/bolt"
+)
+
+func OpenUserStore(dsn string) (*bolt.DB, error) {
+	return bolt.Open(dsn)
+}
+func Describe(db *bolt.DB) string {
+	return fmt.Sprint(db)
+}
+`,
+			typeMapping: map[string]*Type{
+				"Type": {
+					Name: "User",
+				},
+				"storage": {
+					Pkg:     "github.com/acme/storage/bolt",
+					PkgName: "bolt",
+					Name:    "bolt",
+					Package: true,
+				},
+			},
+			opts: genOptions{
+				SourceOrder: true,
+			},
+		},
+		{
+			src: `package main
+
+import "github.com/acme/storage/sql"
+
+type Type struct {
+	ID int64
+}
+
+func OpenTypeStore(dsn string) (*sql.DB, error) {
+	return sql.Open(dsn)
+}
+`,
+			expected: `// Code generated by rei. DO NOT EDIT.
+
+package main
+
+import "github.com/acme/storage/bolt"
+
+func OpenUserStore(dsn string) (*bolt.DB, error) {
+	return bolt.Open(dsn)
+}
+`,
+			typeMapping: map[string]*Type{
+				"Type": {
+					Name: "User",
+				},
+				"storage": {
+					Pkg:     "github.com/acme/storage/bolt",
+					PkgName: "bolt",
+					Name:    "bolt",
+					Package: true,
+				},
+			},
+			opts: genOptions{
+				SourceOrder: true,
+			},
+		},
+		{
+			src: `package main
+
+import "errors"
+
+type Type struct {
+	ID int64
+}
+
+// ErrEntityNotFound is returned if the Entity does not exist.
+var ErrEntityNotFound = errors.New("not found")
+
+type entityCache map[int64]*Type
+
+// EntityStore stores Types.
+type EntityStore struct {
+	cache       entityCache
+	entityCount int
+}
+
+func newEntityStore() *EntityStore {
+	return &EntityStore{cache: entityCache{}, entityCount: 0}
+}
+
+func (s *EntityStore) Get(id int64) (*Type, error) {
+	if v, ok := s.cache[id]; ok {
+		return v, nil
+	}
+	return nil, ErrEntityNotFound
+}
+
+func (s *EntityStore) Len() int {
+	return s.entityCount
+}
+
+func identity(x int) int {
+	return x
+}
+
+func unrelated() {
+}
+`,
+			expected: `// Code generated by rei. DO NOT EDIT.
+
+package main
+
+import "errors"
+
+// ErrCustomerNotFound is returned if the Customer does not exist.
+var ErrCustomerNotFound = errors.New("not found")
+
+type customerCache map[int64]*User
+
+// CustomerStore stores Users.
+type CustomerStore struct {
+	cache         customerCache
+	customerCount int
+}
+
+func newCustomerStore() *CustomerStore {
+	return &CustomerStore{cache: customerCache{}, customerCount: 0}
+}
+func (s *CustomerStore) Get(id int64) (*User, error) {
+	if v, ok := s.cache[id]; ok {
+		return v, nil
+	}
+	return nil, ErrCustomerNotFound
+}
+func (s *CustomerStore) Len() int {
+	return s.customerCount
+}
+`,
+			typeMapping: map[string]*Type{
+				"Type": {
+					Name: "User",
+				},
+				"Entity": {
+					Name:  "Customer",
+					Ident: true,
+				},
+			},
+			opts: genOptions{
+				SourceOrder: true,
+			},
+		},
+		{
+			src: `package main
+
+type Type struct {
+	ID int64
+}
+
+type IdSet map[int64]*Type
+
+func identity(x *Type) *Type {
+	return x
+}
+
+func (s IdSet) Add(x *Type) {
+	s[x.ID] = identity(x)
+}
+`,
+			expected: `// Code generated by rei. DO NOT EDIT.
+
+package main
+
+type KeySet map[int64]*User
+
+func identity(x *User) *User {
+	return x
+}
+func (s KeySet) Add(x *User) {
+	s[x.ID] = identity(x)
+}
+`,
+			typeMapping: map[string]*Type{
+				"Type": {
+					Name: "User",
+				},
+				"Id": {
+					Name:  "Key",
+					Ident: true,
+				},
+			},
+			opts: genOptions{
+				SourceOrder: true,
+			},
+		},
+		{
+			src: `package main
+
+type Type int
+
+const (
+	zero = iota
+	one
+	// TypeA is the first.
+	TypeA Type = iota
+	TypeB
+	TypeC
+)
+
+const (
+	Small, SmallType Type = iota, iota * 10
+	big, bigType
+)
+`,
+			expected: `// Code generated by rei. DO NOT EDIT.
+
+package main
+
+const (
+	// Int8A is the first.
+	Int8A int8 = 2
+	Int8B int8 = 3
+	Int8C int8 = 4
+)
+
+const (
+	Small, SmallInt8 int8 = iota, iota * 10
+	big, bigInt8
+)
+`,
+			typeMapping: map[string]*Type{
+				"Type": {
+					Name: "int8",
+				},
+			},
+			opts: genOptions{
+				SourceOrder: true,
+			},
+		},
+		{
+			src: `package main
+
+type Type int
+
+const (
+	zero = iota
+	one
+	// TypeA is the first.
+	TypeA Type = iota
+	TypeB
+	TypeC
+)
+
+const (
+	Small, SmallType Type = iota, iota * 10
+	big, bigType
+)
+`,
+			expected: `// Code generated by rei. DO NOT EDIT.
+
+package main
+
+// Int8A is the first.
+const Int8A int8 = 2
+const Int8B int8 = 3
+const Int8C int8 = 4
+const Small, SmallInt8 int8 = iota, iota * 10
+const big, bigInt8 int8 = 1, 1 * 10
+`,
+			typeMapping: map[string]*Type{
+				"Type": {
+					Name: "int8",
+				},
+			},
+		},
+		{
+			src: `package main
+
+import "fmt"
+
+type FieldType int
+
+type Type struct {
+	Field FieldType
+}
+
+func copyType(dst, src *Type) {
+	//rei:fields Type
+	dst.Field = src.Field
+}
+
+func columnsType() []string {
+	return []string{
+		"id",
+		//rei:fields Type
+		"Field",
+	}
+}
+
+func describeType(m Type) map[string]string {
+	return map[string]string{
+		//rei:fields Type Field Kind
+		"Field": fmt.Sprint(Kind(m.Field)),
+		//rei:fields Type
+		"{Field}Count": "FieldCount",
+	}
+}
+
+type Kind = FieldType
+`,
+			expected: `// Code generated by rei. DO NOT EDIT.
+
+package main
+
+import (
+	"fmt"
+	"image"
+)
+
+func copyRectangle(dst, src *image.Rectangle) {
+	dst.Min = src.Min
+	dst.Max = src.Max
+}
+func columnsRectangle() []string {
+	return []string{
+		"id",
+		"Min",
+		"Max",
+	}
+}
+func describeRectangle(m image.Rectangle) map[string]string {
+	return map[string]string{
+		"Min":      fmt.Sprint(image.Point(m.Min)),
+		"Max":      fmt.Sprint(image.Point(m.Max)),
+		"MinCount": "FieldCount",
+		"MaxCount": "FieldCount",
+	}
+}
+`,
+			typeMapping: map[string]*Type{
+				"Type": {
+					Name:    "Rectangle",
+					Pkg:     "image",
+					PkgName: "image",
+				},
+			},
+			opts: genOptions{
+				SourceOrder: true,
+			},
+		},
+		{
+			src: `package main
+
+type Type int
+
+var namesType = map[Type]interface{}{
+	1: struct{}{},
+	2: "two", 3: "three",
+}
+
+var setType = map[Type]struct{}{0: {}}
+`,
+			expected: `// Code generated by rei. DO NOT EDIT.
+
+package main
+
+var namesInt = map[int]interface{}{
+	1: struct{}{},
+	2: "two", 3: "three",
+}
+var setInt = map[int]struct{}{0: {}}
+`,
+			typeMapping: map[string]*Type{
+				"Type": {
+					Name: "int",
+				},
+			},
+			opts: genOptions{
+				SourceOrder: true,
+			},
+		},
+		{
+			src: `package main
+
+import "log"
+
+type Type interface {
+	Method(args ...any) error
+}
+
+// LoggingType logs the calls of a Type.
+type LoggingType struct {
+	next Type
+}
+
+// Method calls Method of the wrapped Type.
+//rei:methods Type
+func (l *LoggingType) Method(args ...any) error {
+	log.Println("Method", args)
+	return l.next.Method(args...)
+}
+`,
+			expected: `// Code generated by rei. DO NOT EDIT.
+
+package main
+
+import (
+	"log"
+	"sort"
+)
+
+// LoggingInterface logs the calls of a Interface.
+type LoggingInterface struct {
+	next sort.Interface
+}
+
+// Len calls Len of the wrapped Interface.
+func (l *LoggingInterface) Len() int {
+	log.Println("Len", []any{})
+	return l.next.Len()
+}
+
+// Less calls Less of the wrapped Interface.
+func (l *LoggingInterface) Less(i int, j int) bool {
+	log.Println("Less", []any{i, j})
+	return l.next.Less(i, j)
+}
+
+// Swap calls Swap of the wrapped Interface.
+func (l *LoggingInterface) Swap(i int, j int) {
+	log.Println("Swap", []any{i, j})
+	l.next.Swap(i, j)
+}
+`,
+			typeMapping: map[string]*Type{
+				"Type": {
+					Name:    "Interface",
+					Pkg:     "sort",
+					PkgName: "sort",
+				},
+			},
+			opts: genOptions{
+				SourceOrder: true,
+			},
+		},
+		{
+			src: `package main
+
+type Type interface {
+	Method(args ...any)
+}
+
+// CountingType counts the calls of a Type.
+type CountingType struct {
+	n    int
+	next Type
+}
+
+//rei:methods Type
+func (l *CountingType) Method(args ...any) {
+	l.n++
+	l.next.Method(args...)
+}
+`,
+			expected: `// Code generated by rei. DO NOT EDIT.
+
+package main
+
+import "fmt"
+
+// CountingStringer counts the calls of a Stringer.
+type CountingStringer struct {
+	n    int
+	next fmt.Stringer
+}
+
+func (l *CountingStringer) String() string {
+	l.n++
+	return l.next.String()
+}
+`,
+			typeMapping: map[string]*Type{
+				"Type": {
+					Name:    "Stringer",
+					Pkg:     "fmt",
+					PkgName: "fmt",
+				},
+			},
+			opts: genOptions{
+				SourceOrder: true,
+			},
+		},
+		{
+			src: `package main
+
+type Type interface {
+	Get() string
+	Len() int
+}
+
+// TypeCache caches the value of a Type.
+type TypeCache struct {
+	src   Type
+	value string
+}
+
+// Get returns the cached value.
+func (c *TypeCache) Get() string {
+	if c.value == "" && c.src.Len() > 0 {
+		c.value = c.src.Get()
+	}
+	return c.value
+}
+`,
+			expected: `// Code generated by rei. DO NOT EDIT.
+
+package main
+
+import "strings"
+
+// BuilderCache caches the value of a Builder.
+type BuilderCache struct {
+	src   BuilderAdapter
+	value string
+}
+
+// Get returns the cached value.
+func (c *BuilderCache) Get() string {
+	if c.value == "" && c.src.Len() > 0 {
+		c.value = c.src.Get()
+	}
+	return c.value
+}
+
+// BuilderAdapter adapts *strings.Builder to the methods of Type.
+type BuilderAdapter struct {
+	*strings.Builder
+}
+
+func (a BuilderAdapter) Get() string {
+	return a.Builder.String()
+}
+`,
+			typeMapping: map[string]*Type{
+				"Type": {
+					Name:    "Builder",
+					Pkg:     "strings",
+					PkgName: "strings",
+					Pointer: true,
+					Fields:  map[string]string{"Get": "String"},
+					Adapter: true,
+				},
+			},
+			opts: genOptions{
+				SourceOrder: true,
+			},
+		},
+		{
+			src: `package main
+
+type Type struct {
+	ID int64
+}
+
+// TypeWrapper wraps a Type.
+type TypeWrapper struct {
+	*Type
+	extra int
+}
+
+func (w *TypeWrapper) id() int64 {
+	return w.Type.ID + w.ID
+}
+
+func newTypeWrapper(t *Type) TypeWrapper {
+	return TypeWrapper{Type: t, extra: 1}
+}
+`,
+			expected: `// Code generated by rei. DO NOT EDIT.
+
+package main
+
+import "image"
+
+// PointWrapper wraps a Point.
+type PointWrapper struct {
+	*image.Point
+	extra int
+}
+
+func (w *PointWrapper) id() int64 {
+	return w.Point.X + w.X
+}
+func newPointWrapper(t *image.Point) PointWrapper {
+	return PointWrapper{Point: t, extra: 1}
+}
+`,
+			typeMapping: map[string]*Type{
+				"Type": {
+					Name:    "Point",
+					Pkg:     "image",
+					PkgName: "image",
+					Fields:  map[string]string{"ID": "X"},
+				},
+			},
+			opts: genOptions{
+				SourceOrder: true,
+			},
+		},
+		{
+			src: `package main
+
+type Type struct{}
+
+func GetType() (*Type, error) {
+	return nil, nil
+}
+`,
+			expected: `// Code generated by rei. DO NOT EDIT.
+
+package main
+
+import "image"
+
+func GetPoint() (**image.Point, error) {
+	return nil, nil
+}
+`,
+			typeMapping: map[string]*Type{
+				"Type": {
+					Name:    "Point",
+					Pkg:     "image",
+					PkgName: "image",
+					Pointer: true,
+				},
+			},
+		},
+	}
+
+	for i, tc := range testCases {
+		tc := tc
+		t.Run(fmt.Sprintf("case %v", i), func(t *testing.T) {
+			inBuff := bytes.NewBufferString(tc.src)
+			outBuff := &bytes.Buffer{}
+			err := gen(inBuff, "in.go", "", tc.typeMapping, outBuff, "out.go", tc.opts)
+			assert.NoError(err)
+
+			assert.Equal(tc.expected, outBuff.String())
+		})
+	}
+}
+
+func TestGenMethods(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "rei")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"go.mod":    "module example.com/methods\n",
+		"user.go":   "package main\n\ntype User struct {\n\tName string\n}\n",
+		"member.go": "package main\n\ntype Member struct {\n\tName string\n}\n\nfunc (m Member) String() string {\n\treturn m.Name\n}\n",
+	}
+	for name, src := range files {
+		if !assert.NoError(ioutil.WriteFile(filepath.Join(dir, name), []byte(src), 0644)) {
+			return
+		}
+	}
+
+	src := `package main
+
+type Type struct {
+	Name string
+}
+
+// String returns the Type's name.
+func (t Type) String() string {
+	return "Type " + t.Name
+}
+
+func (t *Type) SetName(name string) {
+	t.Name = name
+}
+
+func NewType(name string) *Type {
+	return &Type{Name: name}
+}
+`
+	testCases := []struct {
+		concrete string
+		expected string
+	}{
+		{"User", `// Code generated by rei. DO NOT EDIT.
+
+package main
+
+// String returns the User's name.
+func (t User) String() string {
+	return "Type " + t.Name
+}
+func (t *User) SetName(name string) {
+	t.Name = name
+}
+func NewUser(name string) *User {
+	return &User{Name: name}
+}
+`},
+		// The concrete type's own method is kept.
+		{"Member", `// Code generated by rei. DO NOT EDIT.
+
+package main
+
+func (t *Member) SetName(name string) {
+	t.Name = name
+}
+func NewMember(name string) *Member {
+	return &Member{Name: name}
+}
+`},
+		// Not declared in the destination package.
+		{"Admin", `// Code generated by rei. DO NOT EDIT.
+
+package main
+
+func NewAdmin(name string) *Admin {
+	return &Admin{Name: name}
+}
+`},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.concrete, func(t *testing.T) {
+			outBuff := &bytes.Buffer{}
+			err := gen(bytes.NewBufferString(src), "in.go", "", map[string]*Type{"Type": {Name: tc.concrete}}, outBuff, "out.go", genOptions{
+				SourceOrder: true,
+				Methods:     true,
+				Dir:         dir,
+			})
+			if assert.NoError(err) {
+				assert.Equal(tc.expected, outBuff.String())
+			}
+		})
+	}
+}
+
+func TestGenErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	testCases := []struct {
+		name        string
+		src         string
+		typeMapping map[string]*Type
+		err         string
+		mismatch    bool
+	}{
+		{
+			name: "repeated shim argument",
+			src: `package main
+
+//rei:builtin Square = a * a
+type Type interface {
+	Square() Type
+}
+
+func SumSquaresType(next func() Type, n int) Type {
+	var sum Type
+	for i := 0; i < n; i++ {
+		sum = next().Square()
+	}
+	return sum
+}
+`,
+			typeMapping: map[string]*Type{
+				"Type": {
+					Name: "int",
+				},
+			},
+			err: "a is used 2 times by the shim of Square, so next() must be an identifier or a selector, use the func form",
+		},
+		{
+			name: "constraint directive",
+			src: `package main
+
+//rei:constraint ordered
+type Type int
+
+func MaxType(a, b Type) Type {
+	if a > b {
+		return a
+	}
+	return b
+}
+`,
+			typeMapping: map[string]*Type{
+				"Type": {
+					Name: "bool",
+				},
+			},
+			err: `Type=bool does not satisfy constraint "ordered" (in.go:4:6)`,
+		},
+		{
+			name: "parameter constraint",
+			src: `//rei:param Reader constraint="implements io.Reader"
+package main
+
+import "io"
+
+type Reader io.Reader
+
+func ReadReader(r Reader) {
+}
+`,
+			typeMapping: map[string]*Type{
+				"Reader": {
+					Name:    "File",
+					Pkg:     "os",
+					PkgName: "os",
+				},
+			},
+			err: `Reader=os.File does not satisfy constraint "implements io.Reader" (parameter Reader)`,
+		},
+		{
+			name: "undeclared generic type",
+			src: `package main
+
+type Type int
+
+func AddType(a, b Type) Type {
+	return a + b
+}
+`,
+			typeMapping: map[string]*Type{
+				"Tpye": {
+					Name: "int",
+				},
+			},
+			err:      "generic types not declared in the source file: Tpye",
+			mismatch: true,
+		},
+		{
+			name: "package matching several imports",
+			src: `package main
+
+import (
+	"github.com/acme/storage/cache"
+	"github.com/acme/storage/sql"
+)
+
+type Type int
+
+func OpenType(dsn string) (*sql.DB, *cache.Cache) {
+	return sql.Open(dsn), cache.New()
+}
+`,
+			typeMapping: map[string]*Type{
+				"Type": {
+					Name: "int",
+				},
+				"storage": {
+					Pkg:     "github.com/acme/storage/bolt",
+					PkgName: "bolt",
+					Name:    "bolt",
+					Package: true,
+				},
+			},
+			err:      `pkg:storage matches both "github.com/acme/storage/cache" and "github.com/acme/storage/sql"`,
+			mismatch: true,
+		},
+		{
+			name: "no dependants",
+			src: `package main
+
+type Type int
+
+func Add(a, b int) int {
+	return a + b
+}
+`,
+			typeMapping: map[string]*Type{
+				"Type": {
+					Name: "int",
+				},
+			},
+			err:      "no declarations depend on the generic types",
+			mismatch: true,
+		},
+		{
+			name: "unknown parameter",
+			src: `//rei:param Type
+package main
+
+type Type int
+type Other int
+
+func AddType(a, b Type) Type {
+	return a + b
+}
+`,
+			typeMapping: map[string]*Type{
+				"Type": {
+					Name: "int",
+				},
+				"Other": {
+					Name: "int",
+				},
+			},
+			err:      "unknown template parameter Other",
+			mismatch: true,
+		},
+		{
+			name: "unbalanced block directive",
+			src: `package main
+
+type Type int
+
+func PrintType(v Type) {
+	//rei:if Type==int
+	println(v)
+}
+`,
+			typeMapping: map[string]*Type{
+				"Type": {
+					Name: "int",
+				},
+			},
+			err: "without //rei:end",
+		},
+		{
+			name: "override of unknown function",
+			src: `package main
+
+type Type int
+
+func SumType(vs []Type) Type {
+	return 0
+}
+
+//rei:override sumType Type=string
+func sumStrings(vs []string) string {
+	return ""
+}
+`,
+			typeMapping: map[string]*Type{
+				"Type": {
+					Name: "string",
+				},
+			},
+			err: "override of unknown function sumType",
+		},
+		{
+			name: "unknown field",
+			src: `package main
+
+type Type struct {
+	ID int64
+}
+
+func IDType(t Type) int64 {
+	return t.ID
+}
+`,
+			typeMapping: map[string]*Type{
+				"Type": {
+					Name: "User",
+					Fields: map[string]string{
+						"Id": "UserID",
+					},
+				},
+			},
+			err:      "generic type Type has no field or method Id",
+			mismatch: true,
+		},
+		{
+			name: "fields of a non-struct type",
+			src: `package main
+
+type Type struct {
+	Field int
+}
+
+func printType(m Type) {
+	//rei:fields Type
+	println(m.Field)
+}
+`,
+			typeMapping: map[string]*Type{
+				"Type": {
+					Name: "string",
+				},
+			},
+			err:      "Type=string is not a struct type",
+			mismatch: true,
+		},
+		{
+			name: "methods of a non-interface type",
+			src: `package main
+
+type Type interface {
+	Method(args ...any)
+}
+
+type WrappedType struct {
+	next Type
+}
+
+//rei:methods Type
+func (w WrappedType) Method(args ...any) {
+	w.next.Method(args...)
+}
+`,
+			typeMapping: map[string]*Type{
+				"Type": {
+					Name: "string",
+				},
+			},
+			err: "Type=string is not an interface type",
+		},
+		{
+			name: "methods without a call to return",
+			src: `package main
+
+type Type interface {
+	Method(args ...any)
+}
+
+type CountingType struct {
+	n    int
+	next Type
+}
+
+//rei:methods Type
+func (l *CountingType) Method(args ...any) {
+	l.next.Method(args...)
+	l.n++
+}
+`,
+			typeMapping: map[string]*Type{
+				"Type": {
+					Name:    "Stringer",
+					Pkg:     "fmt",
+					PkgName: "fmt",
+				},
+			},
+			err:      "String has results, but Method does not end with a call of Method to return them",
+			mismatch: true,
+		},
+		{
+			name: "methods of a function",
+			src: `package main
+
+type Type interface {
+	Method(args ...any)
+}
+
+//rei:methods Type
+func Method(next Type, args ...any) {
+	next.Method(args...)
+}
+`,
+			typeMapping: map[string]*Type{
+				"Type": {
+					Name: "string",
+				},
+			},
+			err: "methods requires a method",
+		},
+		{
+			name: "adapter of a missing method",
+			src: `package main
+
+type Type interface {
+	Get() string
+}
+
+type TypeCache struct {
+	src Type
+}
+`,
+			typeMapping: map[string]*Type{
+				"Type": {
+					Name:    "Builder",
+					Pkg:     "strings",
+					PkgName: "strings",
+					Fields:  map[string]string{"Get": "Fetch"},
+					Adapter: true,
+				},
+			},
+			err:      "strings.Builder has no method Fetch",
+			mismatch: true,
+		},
+		{
+			name: "embedded type literal",
+			src: `package main
+
+type Type struct{}
+
+type TypeWrapper struct {
+	Type
+}
+`,
+			typeMapping: map[string]*Type{
+				"Type": {
+					Name: "struct{}",
+				},
+			},
+			err:      "generic type Type is embedded, it cannot be mapped to struct{}",
+			mismatch: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			inBuff := bytes.NewBufferString(tc.src)
+			outBuff := &bytes.Buffer{}
+			err := gen(inBuff, "in.go", "", tc.typeMapping, outBuff, "out.go", genOptions{})
+			if assert.Error(err) {
+				assert.Contains(err.Error(), tc.err)
+				_, mismatch := errors.Cause(err).(*mappingError)
+				assert.Equal(tc.mismatch, mismatch)
+			}
+			assert.Empty(outBuff.String())
+		})
+	}
+}
+
+func TestGenPartial(t *testing.T) {
+	assert := assert.New(t)
+
+	src := `//rei:param KeyType doc="key type of the map"
+//rei:param ValueType doc="element type of the map's slices"
+
+package main
+
+import "github.com/nkovacs/rei/lib/rei"
+
+type KeyType interface{}
+
+// ValueType is the element type.
+//rei:constraint comparable
+type ValueType interface{}
+
+type KeyTypeValueTypeSliceMap map[KeyType][]ValueType
+
+func (m KeyTypeValueTypeSliceMap) Flatten() []ValueType {
+	var ret []ValueType
+	for _, v := range m {
+		ret = append(ret, v...)
+	}
+	return ret
+}
+
+func countValueType(vs []ValueType) int {
+	if rei.Is[ValueType, string]() {
+		return -1
+	}
+	return len(vs)
+}
+`
+	partial := `// Code generated by rei. DO NOT EDIT.
+
+//rei:param ValueType doc="element type of the map's slices"
+
+package main
+
+import "github.com/nkovacs/rei/lib/rei"
+
+// ValueType is the element type.
+//
+//rei:constraint comparable
+type ValueType interface{}
+type StringValueTypeSliceMap map[string][]ValueType
+
+func (m StringValueTypeSliceMap) Flatten() []ValueType {
+	var ret []ValueType
+	for _, v := range m {
+		ret = append(ret, v...)
+	}
+	return ret
+}
+func countValueType(vs []ValueType) int {
+	if rei.Is[ValueType, string]() {
+		return -1
+	}
+	return len(vs)
+}
+`
+	concrete := `// Code generated by rei. DO NOT EDIT.
+
+package main
+
+type StringIntSliceMap map[string][]int
+
+func (m StringIntSliceMap) Flatten() []int {
+	var ret []int
+	for _, v := range m {
+		ret = append(ret, v...)
+	}
+	return ret
+}
+func countInt(vs []int) int {
+	return len(vs)
+}
+`
+	outBuff := &bytes.Buffer{}
+	typeMapping := map[string]*Type{
+		"KeyType": {
+			Name: "string",
+		},
+	}
+	err := gen(bytes.NewBufferString(src), "in.go", "", typeMapping, outBuff, "out.go", genOptions{SourceOrder: true, Partial: true})
+	assert.NoError(err)
+	assert.Equal(partial, outBuff.String())
+
+	// The partial instantiation is a template itself.
+	concreteBuff := &bytes.Buffer{}
+	typeMapping = map[string]*Type{
+		"ValueType": {
+			Name: "int",
+		},
+	}
+	err = gen(outBuff, "partial.go", "", typeMapping, concreteBuff, "out.go", genOptions{SourceOrder: true})
+	assert.NoError(err)
+	assert.Equal(concrete, concreteBuff.String())
+
+	// Without -partial, every parameter must be bound.
+	err = gen(bytes.NewBufferString(src), "in.go", "", map[string]*Type{"KeyType": {Name: "string"}}, &bytes.Buffer{}, "out.go", genOptions{})
+	assert.Error(err)
+}
+
+func TestGenWarnings(t *testing.T) {
+	assert := assert.New(t)
+
+	src := `package main
+
+type KeyType interface{}
+type ValueType interface{}
+
+func (k KeyType) String() string {
+	return ""
+}
+
+type KeyTypeSet map[KeyType]struct{}
+`
+	inBuff := bytes.NewBufferString(src)
+	outBuff := &bytes.Buffer{}
+	warnings := &bytes.Buffer{}
+	typeMapping := map[string]*Type{
+		"KeyType": {
+			Name: "string",
+		},
+		"ValueType": {
+			Name: "int",
+		},
 	}
+	err := gen(inBuff, "in.go", "", typeMapping, outBuff, "out.go", genOptions{Warnings: warnings})
+	assert.NoError(err)
+	assert.Equal("warning: in.go:4:6: generic type ValueType is declared but not used\n", warnings.String())
 }
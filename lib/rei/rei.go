@@ -0,0 +1,17 @@
+// Package rei contains helpers for writing rei templates.
+// Calls to these helpers are evaluated by rei during generation,
+// and do not appear in the generated code.
+package rei
+
+import "reflect"
+
+// Is reports whether T and U are the same type.
+// In a template, rei replaces it with true or false depending on the concrete types,
+// and removes the branches of if statements that don't apply:
+//
+//	if rei.Is[Type, string]() {
+//		return strings.Compare(a, b)
+//	}
+func Is[T, U any]() bool {
+	return reflect.TypeOf((*T)(nil)).Elem() == reflect.TypeOf((*U)(nil)).Elem()
+}
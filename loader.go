@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/importer"
+	"go/token"
+	"go/types"
+
+	"golang.org/x/tools/go/packages"
+
+	"github.com/pkg/errors"
+)
+
+// typeLoader loads concrete types with go/types.
+type typeLoader struct {
+	// dir is the directory of the package the code is generated into.
+	// Concrete types without a package are looked up there.
+	dir  string
+	pkgs map[string]*types.Package
+}
+
+func newTypeLoader(dir string) *typeLoader {
+	if dir == "" {
+		dir = "."
+	}
+	return &typeLoader{
+		dir:  dir,
+		pkgs: make(map[string]*types.Package),
+	}
+}
+
+// loadPackages loads the packages matching the patterns from source.
+// Packages with type errors are returned as well, since the package
+// the code is generated into is usually incomplete.
+func loadPackages(dir string, patterns ...string) ([]*packages.Package, error) {
+	cfg := &packages.Config{
+		Mode: packages.NeedName | packages.NeedFiles | packages.NeedImports |
+			packages.NeedTypes | packages.NeedSyntax | packages.NeedTypesInfo,
+		Dir: dir,
+	}
+	pkgs, err := packages.Load(cfg, patterns...)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("loading %v failed", patterns))
+	}
+	return pkgs, nil
+}
+
+// load returns the package with the given import path.
+// An empty path is the package in the loader's directory.
+func (l *typeLoader) load(pkgPath string) (*types.Package, error) {
+	if pkg, ok := l.pkgs[pkgPath]; ok {
+		return pkg, nil
+	}
+	pattern := pkgPath
+	if pattern == "" {
+		pattern = "."
+	}
+	pkgs, err := loadPackages(l.dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(pkgs) != 1 || pkgs[0].Types == nil {
+		return nil, fmt.Errorf("package %v not found", pattern)
+	}
+	pkg := pkgs[0].Types
+	l.pkgs[pkgPath] = pkg
+	return pkg, nil
+}
+
+// lookup returns the go/types type of a concrete type.
+func (l *typeLoader) lookup(t *Type) (types.Type, error) {
+	var obj types.Object
+	if t.Pkg == "" {
+		switch t.Name {
+		case "struct{}":
+			obj = types.NewTypeName(token.NoPos, nil, t.Name, types.NewStruct(nil, nil))
+		case "interface{}":
+			obj = types.NewTypeName(token.NoPos, nil, t.Name, types.NewInterfaceType(nil, nil))
+		default:
+			obj = types.Universe.Lookup(t.Name)
+		}
+	}
+	if obj == nil {
+		pkg, err := l.load(t.Pkg)
+		if err != nil {
+			return nil, err
+		}
+		obj = pkg.Scope().Lookup(t.Name)
+	}
+	tn, ok := obj.(*types.TypeName)
+	if !ok {
+		return nil, fmt.Errorf("type %v not found", t)
+	}
+	typ := tn.Type()
+	if t.Pointer {
+		typ = types.NewPointer(typ)
+	}
+	return typ, nil
+}
+
+// qualifyByName qualifies types with their package's name.
+func qualifyByName(pkg *types.Package) string {
+	return pkg.Name()
+}
+
+// checkTemplate type checks the template file with go/types.
+// Type errors are ignored, since the template may use declarations
+// from other files of its package.
+func checkTemplate(fset *token.FileSet, file *ast.File) *types.Info {
+	return checkFiles(fset, file)
+}
+
+// checkFiles type checks the files of a package like checkTemplate.
+func checkFiles(fset *token.FileSet, files ...*ast.File) *types.Info {
+	info := &types.Info{
+		Types:      make(map[ast.Expr]types.TypeAndValue),
+		Defs:       make(map[*ast.Ident]types.Object),
+		Uses:       make(map[*ast.Ident]types.Object),
+		Selections: make(map[*ast.SelectorExpr]*types.Selection),
+		Instances:  make(map[*ast.Ident]types.Instance),
+	}
+	conf := types.Config{
+		Importer: importer.ForCompiler(fset, "source", nil),
+		Error:    func(error) {},
+	}
+	conf.Check(files[0].Name.Name, fset, files, info)
+	return info
+}
@@ -5,9 +5,13 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
 )
 
 const myName = "rei"
@@ -19,16 +23,47 @@ const (
 	exitcodeDestFileFailed
 	exitcodeSourceFileInvalid
 	exitcodeGenFailed
+	exitcodeMappingMismatch
 )
 
 func usage() {
 	fmt.Fprintln(os.Stderr, `Usage: `+myName+` -in {source} [-out {dest}] "{types}"
+       `+myName+` describe {source}
+       `+myName+` auto [{packages}]
+       `+myName+` gen -t {name}={template}[:{param}] [-out {dir}] {models}...
+       `+myName+` mono -in {source} [-out {dest}] {instantiations}...
+       `+myName+` to-generics [-out {dest}] {source} [{generic}...]
 
 Generates concrete code from generic code.
 
 {source}  - (required) Source file with generic types
 {dest}    - (optional) Destination file
-{types}   - (required) Type mapping
+{types}   - Type mapping, required unless every parameter
+            declared in the source file has a default
+
+The describe command prints the parameters declared in the source file.
+
+The auto command generates the instantiations the packages refer to,
+but don't declare yet, of the templates registered in the packages with
+//rei:template {path} directives. The mapping is inferred from the name,
+e.g. NewUserDAO instantiates the template declaring NewTypeDAO with Type=User.
+
+The gen command generates the templates named by //rei:gen {name},{name}
+annotations on the types of the {models} package directories into {dir}
+as rei_{name}_{type}.go. Every {name} must be given with a -t flag. The type
+is mapped to {param}, the template's only parameter by default.
+
+The mono command generates concrete code from the generic functions and
+types declared with type parameters in the source file, for each of the
+{instantiations}, e.g. Map[int,string] generates MapIntString.
+
+The to-generics command converts the source file into Go code with type
+parameters. The declarations depending on the {generic} types, the source
+file's declared parameters or Type by default, get type parameters, and
+the generic types are replaced with constraints inferred from their uses.
+
+Templates used by the source file with //rei:uses directives are generated
+into the destination's directory as rei_{template}_{types}.go.
 
 Type mapping is in the following format:
   {generic1}={concrete1},[{generic2}={concrete2}]
@@ -40,26 +75,94 @@ where concrete can be one of the following:
   ("pkg/pkg/go-pkg")pkg.ConcreteType
 `+"\t"+`concrete type in a different package, package name
 `+"\t"+`doesn't match directory name
+  const:64, str:users
+`+"\t"+`value of a constant declared in the source file
+  strings.Compare, compareFoo
+`+"\t"+`function replacing a placeholder function declared in the source file
+Packages imported by the source file, by name or path elements, can be substituted with:
+  pkg:{name}=pkg/pkg/pkg
+  pkg:{name}=("pkg/pkg/go-pkg")pkg
+Fragments of declaration names can be replaced with:
+  name:{fragment}={replacement}
+Types of a package can be matched with a wildcard:
+  pkg/pkg/pkg.*, pkg/pkg/pkg./regexp/
+`+"\t"+`the template is generated for every matching exported type
+`+"\t"+`that satisfies the -where constraints, into one file per
+`+"\t"+`type if {dest} is a directory, or combined into {dest}
+Types can be followed by a field mapping:
+  ConcreteType{Field:ConcreteField,Method:ConcreteMethod}
+`+"\t"+`fields and methods of the generic type are renamed
+  adapt:ConcreteType{Method:ConcreteMethod}
+`+"\t"+`an adapter type embedding the concrete type implements
+`+"\t"+`the mapped methods, and replaces the generic type
 
 Flags:`)
 	flag.PrintDefaults()
 }
 
+// targetPackage returns the name of the package generated into the directory dir
+// from the source file in, or an empty string if it's the source's directory.
+func targetPackage(in, dir string) string {
+	if rel, err := filepath.Rel(path.Dir(in), dir); err != nil || rel != "." {
+		// not the same directory, use directory name for generated package
+		return path.Base(dir)
+	}
+	return ""
+}
+
+// stringsFlag collects the values of a repeatable flag.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *stringsFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
 func fatal(code int, a ...interface{}) {
 	fmt.Fprintln(os.Stderr, a...)
 	os.Exit(code)
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "describe" {
+		describeMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "gen" {
+		genMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "auto" {
+		autoMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "mono" {
+		monoMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "to-generics" {
+		toGenericsMain(os.Args[2:])
+		return
+	}
+
 	var (
-		in  = flag.String("in", "", "generic file")
-		out = flag.String("out", "", "file to save output to instead of stdout")
+		in          = flag.String("in", "", "generic file")
+		out         = flag.String("out", "", "file to save output to instead of stdout")
+		sourceOrder = flag.Bool("sourceorder", true, "keep the declaration order and grouping of the source file")
+		methods     = flag.Bool("methods", false, "generate the methods of generic types onto concrete types in the destination package")
+		partial     = flag.Bool("partial", false, "allow unbound parameters, generating a template with the remaining parameters")
+		where       stringsFlag
 	)
+	flag.Var(&where, "where", "constraint the types matching a wildcard must satisfy, can be repeated")
 	flag.Usage = usage
 	flag.Parse()
 	args := flag.Args()
 
-	if len(args) < 1 {
+	if len(args) > 1 {
 		usage()
 		os.Exit(exitcodeInvalidArgs)
 	}
@@ -69,9 +172,14 @@ func main() {
 		os.Exit(exitcodeInvalidArgs)
 	}
 
-	typeMapping, err := parseMapping(args[0])
-	if err != nil {
-		fatal(exitcodeInvalidTypeMapping, err)
+	// The mapping can be omitted if every parameter has a default.
+	typeMapping := make(map[string]*Type)
+	var err error
+	if len(args) == 1 {
+		typeMapping, err = parseMapping(args[0])
+		if err != nil {
+			fatal(exitcodeInvalidTypeMapping, err)
+		}
 	}
 
 	var file *os.File
@@ -84,14 +192,74 @@ func main() {
 	// if targetPackageName is empty, gen will use the source package's name.
 	targetPackageName := ""
 
-	var outWriter io.Writer
 	var outFilename string
 	if len(*out) > 0 {
-		targetDirName := path.Base(path.Dir(*out))
-		if rel, err := filepath.Rel(path.Dir(*in), path.Dir(*out)); err != nil || rel != "." {
-			// not the same directory, use directory name for generated package
-			targetPackageName = targetDirName
+		targetPackageName = targetPackage(*in, path.Dir(*out))
+		outFilename = *out
+	} else {
+		outFilename = "stdout"
+	}
+
+	buffer := &bytes.Buffer{}
+
+	opts := genOptions{
+		SourceOrder: *sourceOrder,
+		Dir:         path.Dir(*in),
+		Warnings:    os.Stderr,
+		Methods:     *methods,
+		Partial:     *partial,
+	}
+	if len(*out) > 0 {
+		opts.Dir = path.Dir(*out)
+	}
+
+	// The templates used by the source file are generated next to the destination,
+	// which doesn't exist when printing to stdout.
+	if len(*out) == 0 {
+		uses, err := templateUses(*in)
+		if err != nil {
+			fatal(exitcodeSourceFileInvalid, err)
+		}
+		if len(uses) > 0 {
+			fatal(exitcodeInvalidArgs, fmt.Errorf("%v uses other templates, -out is required", *in))
+		}
+	}
+
+	if hasWildcard(typeMapping) {
+		var constraints []*constraint
+		for _, text := range where {
+			c, err := parseConstraint(text)
+			if err != nil {
+				fatal(exitcodeInvalidArgs, err)
+			}
+			constraints = append(constraints, c)
 		}
+		src, err := ioutil.ReadAll(file)
+		if err != nil {
+			fatal(exitcodeSourceFileInvalid, err)
+		}
+		err = genWildcards(src, *in, *out, targetPackageName, typeMapping, constraints, os.Stdout, opts)
+		if _, ok := errors.Cause(err).(*mappingError); ok {
+			fatal(exitcodeMappingMismatch, err)
+		}
+		if err != nil {
+			fatal(exitcodeGenFailed, err)
+		}
+		return
+	}
+
+	err = gen(file, *in, targetPackageName, typeMapping, buffer, outFilename, opts)
+	if _, ok := errors.Cause(err).(*mappingError); ok {
+		fatal(exitcodeMappingMismatch, err)
+	}
+	if err != nil {
+		fatal(exitcodeGenFailed, err)
+	}
+
+	// The destination is only created if generating succeeded,
+	// so that a failed run does not leave an empty file behind.
+	var outWriter io.Writer = os.Stdout
+	if len(*out) > 0 {
 		err = os.MkdirAll(path.Dir(*out), 0755)
 		if err != nil {
 			fatal(exitcodeDestFileFailed, err)
@@ -103,20 +271,25 @@ func main() {
 		}
 		defer outFile.Close()
 		outWriter = outFile
-		outFilename = *out
-	} else {
-		outWriter = os.Stdout
-		outFilename = "stdout"
 	}
 
-	buffer := &bytes.Buffer{}
-
-	err = gen(file, *in, targetPackageName, typeMapping, buffer, outFilename)
+	_, err = io.Copy(outWriter, buffer)
 	if err != nil {
 		fatal(exitcodeGenFailed, err)
 	}
 
-	_, err = io.Copy(outWriter, buffer)
+	// The templates used by the source file are generated next to the destination.
+	usesPackageName := targetPackageName
+	if usesPackageName == "" {
+		usesPackageName, err = packageName(*in)
+		if err != nil {
+			fatal(exitcodeSourceFileInvalid, err)
+		}
+	}
+	err = generateUses(*in, typeMapping, opts.Dir, usesPackageName, opts, make(map[string]string))
+	if _, ok := errors.Cause(err).(*mappingError); ok {
+		fatal(exitcodeMappingMismatch, err)
+	}
 	if err != nil {
 		fatal(exitcodeGenFailed, err)
 	}
@@ -7,22 +7,68 @@ import (
 	"github.com/pkg/errors"
 )
 
+// splitMapping splits a type mapping string at the commas
+// that are not part of a field mapping or a quoted string.
+func splitMapping(s string) []string {
+	var mappings []string
+	depth := 0
+	start := 0
+	inQuote, escaped := false, false
+	for i, r := range s {
+		if inQuote {
+			switch {
+			case escaped:
+				escaped = false
+			case r == '\\':
+				escaped = true
+			case r == '"':
+				inQuote = false
+			}
+			continue
+		}
+		switch r {
+		case '"':
+			inQuote = true
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				mappings = append(mappings, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(mappings, s[start:])
+}
+
 // parseMapping parses a type mapping string into
 // a map of generic placeholder type names and concrete Types.
 // A type mapping string consists of comma separated values in the
-// form Type=ConcreteType.
+// form Type=ConcreteType, pkg:name=pkg/path for packages,
+// or name:Fragment=Replacement for identifier fragments.
 func parseMapping(s string) (map[string]*Type, error) {
 	ret := make(map[string]*Type)
-	mappings := strings.Split(s, ",")
+	mappings := splitMapping(s)
 	for _, mapping := range mappings {
 		parts := strings.SplitN(mapping, "=", 2)
 		if len(parts) != 2 {
 			return ret, fmt.Errorf("invalid mapping %v, expected Type=ConcreteType", mapping)
 		}
+		parse := ParseType
+		switch {
+		case strings.HasPrefix(parts[0], "pkg:"):
+			parts[0] = strings.TrimPrefix(parts[0], "pkg:")
+			parse = ParsePackage
+		case strings.HasPrefix(parts[0], "name:"):
+			parts[0] = strings.TrimPrefix(parts[0], "name:")
+			parse = ParseIdent
+		}
 		if ok, _ := isIdentifier(parts[0]); !ok {
 			return ret, fmt.Errorf("invalid mapping %v, %v is not a valid identifier", mapping, parts[0])
 		}
-		tp, err := ParseType(parts[1])
+		tp, err := parse(parts[1])
 		if err != nil {
 			return ret, errors.Wrap(err, fmt.Sprintf("in mapping %v", mapping))
 		}
@@ -125,6 +125,66 @@ func TestParseMapping(t *testing.T) {
 				},
 			},
 		},
+		{
+			"Type=models.User{ID:UserID,Key:Email},Other=int",
+			true,
+			map[string]*Type{
+				"Type": {
+					Pkg:     "models",
+					PkgName: "models",
+					Name:    "User",
+					Fields: map[string]string{
+						"ID":  "UserID",
+						"Key": "Email",
+					},
+				},
+				"Other": {
+					Name: "int",
+				},
+			},
+		},
+		{
+			`pkg:storage=github.com/acme/storage/bolt,pkg:db=("github.com/acme/go-db")db`,
+			true,
+			map[string]*Type{
+				"storage": {
+					Pkg:     "github.com/acme/storage/bolt",
+					PkgName: "bolt",
+					Name:    "bolt",
+					Package: true,
+				},
+				"db": {
+					Pkg:     "github.com/acme/go-db",
+					PkgName: "db",
+					Name:    "db",
+					Aliased: true,
+					Package: true,
+				},
+			},
+		},
+		{
+			"pkg:storage=",
+			false,
+			map[string]*Type{},
+		},
+		{
+			"name:Entity=Customer,Type=User",
+			true,
+			map[string]*Type{
+				"Entity": {
+					Name:  "Customer",
+					Ident: true,
+				},
+				"Type": {
+					Name: "User",
+				},
+			},
+		},
+		{
+			"name:Entity=Customer.Name",
+			false,
+			map[string]*Type{},
+		},
 		{
 			"Type=*Concrete",
 			true,
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// methodLoop is a method of a template repeated for each method of
+// the interface a generic type is mapped to, e.g. to generate decorators.
+// It's declared with a //rei:methods directive on the method:
+//
+//	//rei:methods Type
+//	func (l *LoggingType) Method(args ...any) error {
+//		log.Println("Method", args)
+//		return l.next.Method(args...)
+//	}
+//
+// In each copy, the method's name is replaced with the interface method's name,
+// also in string literals and in the doc comment, and its signature with the
+// interface method's signature. The variadic parameter, args above, is replaced
+// with the parameters of the interface method: it's spread in calls like
+// args..., and used as a slice of the parameters elsewhere.
+// Returning a call from a method without results is turned into a statement,
+// and the call of the method at the end of a method without results
+// is returned from the methods with results.
+type methodLoop struct {
+	decl    *ast.FuncDecl
+	generic string
+	// args is the name of the variadic parameter, if there's one,
+	// argsType the type of its elements.
+	args     string
+	argsType ast.Expr
+}
+
+// collectMethodLoops finds the methods with //rei:methods directives.
+func (gctx *genericContext) collectMethodLoops(file *ast.File) error {
+	for _, decl := range file.Decls {
+		d, ok := decl.(*ast.FuncDecl)
+		if !ok {
+			continue
+		}
+		dirs := gctx.directives[d]
+		if dirs == nil || dirs.methods == "" {
+			continue
+		}
+		where := gctx.fset.Position(d.Pos())
+		if d.Recv == nil {
+			return fmt.Errorf("%v: %vmethods requires a method", where, directivePrefix)
+		}
+		if gctx.genericTypes[dirs.methods] == nil {
+			return fmt.Errorf("%v: %v is not a generic type", where, dirs.methods)
+		}
+		l := &methodLoop{
+			decl:    d,
+			generic: dirs.methods,
+		}
+		params := d.Type.Params.List
+		if len(params) > 0 {
+			last := params[len(params)-1]
+			if _, ok := last.Type.(*ast.Ellipsis); !ok || len(params) > 1 || len(last.Names) != 1 {
+				return fmt.Errorf("%v: %vmethods requires a single variadic parameter", where, directivePrefix)
+			}
+			l.args = last.Names[0].Name
+			l.argsType = last.Type.(*ast.Ellipsis).Elt
+		}
+		if d.Type.Results != nil {
+			for _, result := range d.Type.Results.List {
+				if len(result.Names) > 0 {
+					return fmt.Errorf("%v: %vmethods requires unnamed results", where, directivePrefix)
+				}
+			}
+		}
+		gctx.methodLoops = append(gctx.methodLoops, l)
+	}
+	return nil
+}
+
+// interfaceMethods returns the methods of the interface a generic type is mapped to.
+func (gctx *genericContext) interfaceMethods(generic string) ([]*types.Func, error) {
+	gType := gctx.genericTypes[generic]
+	t, err := gctx.loader.lookup(gType)
+	if err != nil {
+		return nil, err
+	}
+	iface, ok := t.Underlying().(*types.Interface)
+	if !ok || gType.Pointer {
+		return nil, fmt.Errorf("%v=%v is not an interface type", generic, gType)
+	}
+	methods := make([]*types.Func, iface.NumMethods())
+	for i := range methods {
+		methods[i] = iface.Method(i)
+	}
+	return methods, nil
+}
+
+// usedNames returns the identifiers used in n.
+func usedNames(n ast.Node) map[string]bool {
+	names := make(map[string]bool)
+	ast.Inspect(n, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok {
+			names[id.Name] = true
+		}
+		return true
+	})
+	return names
+}
+
+// funcType returns the function type of a signature, and the names of its parameters.
+// Unnamed parameters and parameters whose name is used are named p0, p1, and so on.
+// The packages the types refer to are added to imports.
+func (gctx *genericContext) funcType(sig *types.Signature, used map[string]bool, imports map[string]string) (*ast.FuncType, []string, error) {
+	funcType := &ast.FuncType{
+		Params:  &ast.FieldList{},
+		Results: &ast.FieldList{},
+	}
+	var names []string
+	for i := 0; i < sig.Params().Len(); i++ {
+		p := sig.Params().At(i)
+		name := p.Name()
+		if name == "" || name == "_" || used[name] {
+			name = fmt.Sprintf("p%v", i)
+		}
+		names = append(names, name)
+		var typ ast.Expr
+		var err error
+		if sig.Variadic() && i == sig.Params().Len()-1 {
+			typ, err = gctx.typeExpr(p.Type().(*types.Slice).Elem(), imports)
+			typ = &ast.Ellipsis{Elt: typ}
+		} else {
+			typ, err = gctx.typeExpr(p.Type(), imports)
+		}
+		if err != nil {
+			return nil, nil, errors.Wrap(err, fmt.Sprintf("parameter %v", name))
+		}
+		funcType.Params.List = append(funcType.Params.List, &ast.Field{
+			Names: []*ast.Ident{{Name: name}},
+			Type:  typ,
+		})
+	}
+	for i := 0; i < sig.Results().Len(); i++ {
+		typ, err := gctx.typeExpr(sig.Results().At(i).Type(), imports)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "result")
+		}
+		funcType.Results.List = append(funcType.Results.List, &ast.Field{
+			Type: typ,
+		})
+	}
+	return funcType, names, nil
+}
+
+// expandMethod returns a copy of the loop's method for an interface method.
+func (gctx *genericContext) expandMethod(l *methodLoop, m *types.Func, imports map[string]string) (*ast.FuncDecl, error) {
+	funcType, names, err := gctx.funcType(m.Type().(*types.Signature), usedNames(l.decl), imports)
+	if err != nil {
+		return nil, errors.Wrap(err, m.Name())
+	}
+	funcType.Func = l.decl.Type.Func
+	variadic := m.Type().(*types.Signature).Variadic()
+	placeholder := l.decl.Name.Name
+	args := func() []ast.Expr {
+		exprs := make([]ast.Expr, len(names))
+		for i, name := range names {
+			exprs[i] = &ast.Ident{Name: name}
+		}
+		return exprs
+	}
+
+	// forwards are the calls of the method on other values, e.g. l.next.Method(args...).
+	forwards := make(map[*ast.CallExpr]bool)
+	body := copyNode(l.decl.Body).(*ast.BlockStmt)
+	Apply(body, func(parent ast.Node, name string, index int, n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.CallExpr:
+			if sel, ok := n.Fun.(*ast.SelectorExpr); ok && sel.Sel.Name == placeholder {
+				forwards[n] = true
+			}
+			// args... is spread into the parameters.
+			if id, ok := lastArg(n); ok && n.Ellipsis.IsValid() && id.Name == l.args {
+				n.Args = append(n.Args[:len(n.Args)-1], args()...)
+				if !variadic {
+					n.Ellipsis = token.NoPos
+				}
+			}
+		case *ast.Ident:
+			switch {
+			case n.Name == placeholder:
+				SetField(parent, name, index, &ast.Ident{NamePos: n.NamePos, Name: m.Name()})
+			case n.Name == l.args && n.Obj != nil:
+				SetField(parent, name, index, &ast.CompositeLit{
+					Type: &ast.ArrayType{Elt: copyNode(l.argsType).(ast.Expr)},
+					Elts: args(),
+				})
+			}
+		case *ast.BasicLit:
+			if n.Kind != token.STRING {
+				return true
+			}
+			value, err := strconv.Unquote(n.Value)
+			if err != nil || !strings.Contains(value, placeholder) {
+				return true
+			}
+			SetField(parent, name, index, &ast.BasicLit{
+				ValuePos: n.ValuePos,
+				Kind:     token.STRING,
+				Value:    strconv.Quote(strings.Replace(value, placeholder, m.Name(), -1)),
+			})
+		}
+		return true
+	}, nil)
+	switch {
+	case len(funcType.Results.List) == 0:
+		returnCalls(body)
+	case l.decl.Type.Results == nil || len(l.decl.Type.Results.List) == 0:
+		if !returnForward(body, forwards) {
+			return nil, &mappingError{
+				msg: fmt.Sprintf("%v has results, but %v does not end with a call of %v to return them", m.Name(), placeholder, placeholder),
+			}
+		}
+	}
+
+	var doc *ast.CommentGroup
+	if l.decl.Doc != nil {
+		doc = &ast.CommentGroup{}
+		for _, c := range l.decl.Doc.List {
+			text := c.Text
+			if !isDirective(c) {
+				text = strings.Replace(text, placeholder, m.Name(), -1)
+			}
+			doc.List = append(doc.List, &ast.Comment{Slash: c.Slash, Text: text})
+		}
+	}
+	return &ast.FuncDecl{
+		Doc:  doc,
+		Recv: l.decl.Recv,
+		Name: &ast.Ident{NamePos: l.decl.Name.NamePos, Name: m.Name()},
+		Type: funcType,
+		Body: body,
+	}, nil
+}
+
+// lastArg returns the last argument of a call if it's an identifier.
+func lastArg(call *ast.CallExpr) (*ast.Ident, bool) {
+	if len(call.Args) == 0 {
+		return nil, false
+	}
+	id, ok := call.Args[len(call.Args)-1].(*ast.Ident)
+	return id, ok
+}
+
+// returnForward replaces the call of the method at the end of a method
+// without results with a return statement, for interface methods with results.
+// It reports false if the method doesn't end with a call of the method.
+func returnForward(body *ast.BlockStmt, forwards map[*ast.CallExpr]bool) bool {
+	if len(body.List) == 0 {
+		return false
+	}
+	stmt, ok := body.List[len(body.List)-1].(*ast.ExprStmt)
+	if !ok {
+		return false
+	}
+	call, ok := stmt.X.(*ast.CallExpr)
+	if !ok || !forwards[call] {
+		return false
+	}
+	body.List[len(body.List)-1] = &ast.ReturnStmt{
+		Return:  stmt.Pos(),
+		Results: []ast.Expr{call},
+	}
+	return true
+}
+
+// returnCalls replaces return statements returning a call,
+// which are invalid in functions without results, with the call
+// followed by a return, or only the call at the end of the function.
+func returnCalls(body *ast.BlockStmt) {
+	var replace func(list []ast.Stmt, last bool) []ast.Stmt
+	replace = func(list []ast.Stmt, last bool) []ast.Stmt {
+		var stmts []ast.Stmt
+		for i, stmt := range list {
+			ret, ok := stmt.(*ast.ReturnStmt)
+			if !ok || len(ret.Results) != 1 {
+				stmts = append(stmts, stmt)
+				continue
+			}
+			call, ok := ret.Results[0].(*ast.CallExpr)
+			if !ok {
+				stmts = append(stmts, stmt)
+				continue
+			}
+			stmts = append(stmts, &ast.ExprStmt{X: call})
+			if !last || i != len(list)-1 {
+				stmts = append(stmts, &ast.ReturnStmt{Return: ret.Return})
+			}
+		}
+		return stmts
+	}
+	body.List = replace(body.List, true)
+	ast.Inspect(body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.BlockStmt:
+			if n != body {
+				n.List = replace(n.List, false)
+			}
+		case *ast.CaseClause:
+			n.Body = replace(n.Body, false)
+		case *ast.CommClause:
+			n.Body = replace(n.Body, false)
+		case *ast.FuncLit:
+			// Returns of function literals are not the method's.
+			return false
+		}
+		return true
+	})
+}
+
+// expandMethodLoops generates the methods of the //rei:methods directives
+// for each method of the interfaces.
+// It returns the packages the methods' signatures refer to, by path.
+// It must be called before renaming, so the copies are renamed as well.
+func (gctx *genericContext) expandMethodLoops() (map[string]string, error) {
+	imports := make(map[string]string)
+	for _, l := range gctx.methodLoops {
+		if !gctx.visited[l.decl.Pos()] {
+			continue
+		}
+		methods, err := gctx.interfaceMethods(l.generic)
+		if err != nil {
+			return nil, errors.Wrap(err, gctx.fset.Position(l.decl.Pos()).String())
+		}
+		expanded := make([]*ast.FuncDecl, 0, len(methods))
+		for _, m := range methods {
+			d, err := gctx.expandMethod(l, m, imports)
+			if err != nil {
+				return nil, errors.Wrap(err, gctx.fset.Position(l.decl.Pos()).String())
+			}
+			expanded = append(expanded, d)
+		}
+		gctx.expandedMethods[l.decl] = expanded
+	}
+	return imports, nil
+}
+
+// outputFuncs returns the functions generated for a function declaration:
+// the expansions of a //rei:methods method, or the declaration itself.
+func (gctx *genericContext) outputFuncs(d *ast.FuncDecl) []*ast.FuncDecl {
+	if expanded, ok := gctx.expandedMethods[d]; ok {
+		return expanded
+	}
+	return []*ast.FuncDecl{d}
+}
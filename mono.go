@@ -0,0 +1,716 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"go/types"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/tools/imports"
+
+	"github.com/pkg/errors"
+)
+
+// monoInstance is an instantiation of a generic function or type
+// declared with type parameters in the source file.
+type monoInstance struct {
+	name     string
+	typeArgs []types.Type
+	// monoName is the name of the generated declaration, e.g. MapIntString for Map[int, string].
+	monoName string
+}
+
+// monomorphizer generates concrete declarations from the generic functions
+// and types of a source file, replacing their type parameters with type arguments.
+type monomorphizer struct {
+	fset *token.FileSet
+	file *ast.File
+	info *types.Info
+	pkg  *types.Package
+
+	funcs     map[string]*ast.FuncDecl
+	types     map[string]*ast.TypeSpec
+	typeDecls map[string]*ast.GenDecl
+	methods   map[string][]*ast.FuncDecl
+
+	instances map[string]*monoInstance
+	queue     []*monoInstance
+	// imports are the packages the type arguments refer to, by path.
+	imports map[string]string
+	// srcPath is the import path of the source package if the declarations
+	// are generated into another package, which must qualify its references to it.
+	srcPath string
+}
+
+// newMonomorphizer returns a monomorphizer of the source file.
+// argsFile declares the type arguments of the instantiations, see argsFile.
+func newMonomorphizer(fset *token.FileSet, file, argsFile *ast.File) (*monomorphizer, error) {
+	m := &monomorphizer{
+		fset:      fset,
+		file:      file,
+		info:      checkFiles(fset, file, argsFile),
+		funcs:     make(map[string]*ast.FuncDecl),
+		types:     make(map[string]*ast.TypeSpec),
+		typeDecls: make(map[string]*ast.GenDecl),
+		methods:   make(map[string][]*ast.FuncDecl),
+		instances: make(map[string]*monoInstance),
+		imports:   make(map[string]string),
+	}
+	for _, decl := range file.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if d.Recv != nil {
+				if name := receiverTypeName(d.Recv.List[0].Type); name != "" {
+					m.methods[name] = append(m.methods[name], d)
+				}
+				continue
+			}
+			if d.Type.TypeParams != nil {
+				m.funcs[d.Name.Name] = d
+				m.pkg = m.info.Defs[d.Name].Pkg()
+			}
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				if ts, ok := spec.(*ast.TypeSpec); ok && ts.TypeParams != nil {
+					m.types[ts.Name.Name] = ts
+					m.typeDecls[ts.Name.Name] = d
+					m.pkg = m.info.Defs[ts.Name].Pkg()
+				}
+			}
+		}
+	}
+	if m.pkg == nil {
+		return nil, fmt.Errorf("no generic functions or types with type parameters in %v", fset.File(file.Pos()).Name())
+	}
+	return m, nil
+}
+
+// receiverTypeName returns the name of a method's receiver type.
+func receiverTypeName(expr ast.Expr) string {
+	if star, ok := expr.(*ast.StarExpr); ok {
+		expr = star.X
+	}
+	switch e := expr.(type) {
+	case *ast.IndexExpr:
+		expr = e.X
+	case *ast.IndexListExpr:
+		expr = e.X
+	}
+	if id, ok := expr.(*ast.Ident); ok {
+		return id.Name
+	}
+	return ""
+}
+
+// parseInstance parses an instantiation given on the command line, e.g. Map[int,string].
+func parseInstance(s string) (string, []ast.Expr, error) {
+	expr, err := parser.ParseExpr(s)
+	if err != nil {
+		return "", nil, errors.Wrap(err, fmt.Sprintf("invalid instantiation %v", s))
+	}
+	var x ast.Expr
+	var args []ast.Expr
+	switch e := expr.(type) {
+	case *ast.IndexExpr:
+		x, args = e.X, []ast.Expr{e.Index}
+	case *ast.IndexListExpr:
+		x, args = e.X, e.Indices
+	}
+	id, ok := x.(*ast.Ident)
+	if !ok {
+		return "", nil, fmt.Errorf("invalid instantiation %v, expected Name[Type,...]", s)
+	}
+	return id.Name, args, nil
+}
+
+// genericObject returns the object of a generic function or type of the source file.
+func (m *monomorphizer) genericObject(name string) types.Object {
+	if d, ok := m.funcs[name]; ok {
+		return m.info.Defs[d.Name]
+	}
+	if ts, ok := m.types[name]; ok {
+		return m.info.Defs[ts.Name]
+	}
+	return nil
+}
+
+// argsFile returns a file declaring a variable of each type argument of the instantiations,
+// which is type checked with the source file to evaluate them.
+// It imports the packages the type arguments refer to like the source file,
+// or by their name if the source file doesn't import them,
+// so standard library packages like time can be used.
+// It also returns the type expressions of the type arguments in the file.
+func argsFile(fset *token.FileSet, file *ast.File, args [][]ast.Expr) (*ast.File, [][]ast.Expr, error) {
+	paths := make(map[string]string)
+	for _, spec := range file.Imports {
+		paths[importName(spec)] = spec.Path.Value
+	}
+	imported := make(map[string]bool)
+	header := "package " + file.Name.Name + "\n"
+	src := &bytes.Buffer{}
+	for _, instArgs := range args {
+		for _, arg := range instArgs {
+			ast.Inspect(arg, func(n ast.Node) bool {
+				sel, ok := n.(*ast.SelectorExpr)
+				if !ok {
+					return true
+				}
+				if x, ok := sel.X.(*ast.Ident); ok && !imported[x.Name] {
+					imported[x.Name] = true
+					pkgPath, ok := paths[x.Name]
+					if !ok {
+						pkgPath = strconv.Quote(x.Name)
+					}
+					header += fmt.Sprintf("import %v %v\n", x.Name, pkgPath)
+				}
+				return true
+			})
+			fmt.Fprintf(src, "var _ %v\n", types.ExprString(arg))
+		}
+	}
+	f, err := parser.ParseFile(fset, "instantiations", header+src.String(), 0)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "invalid type arguments")
+	}
+	var specs []ast.Expr
+	for _, decl := range f.Decls {
+		if d, ok := decl.(*ast.GenDecl); ok && d.Tok == token.VAR {
+			specs = append(specs, d.Specs[0].(*ast.ValueSpec).Type)
+		}
+	}
+	fileArgs := make([][]ast.Expr, len(args))
+	for i, instArgs := range args {
+		fileArgs[i], specs = specs[:len(instArgs)], specs[len(instArgs):]
+	}
+	return f, fileArgs, nil
+}
+
+// evalInstance returns the instantiation of a generic declaration
+// with type arguments declared in the file returned by argsFile.
+func (m *monomorphizer) evalInstance(name string, args []ast.Expr) (*monoInstance, error) {
+	typeArgs := make([]types.Type, len(args))
+	for i, arg := range args {
+		tv, ok := m.info.Types[arg]
+		if !ok || tv.Type == nil || tv.Type == types.Typ[types.Invalid] {
+			return nil, fmt.Errorf("invalid type argument %v of %v", types.ExprString(arg), name)
+		}
+		if !tv.IsType() {
+			return nil, fmt.Errorf("invalid type argument %v of %v: not a type", types.ExprString(arg), name)
+		}
+		typeArgs[i] = tv.Type
+	}
+	return m.instance(name, typeArgs)
+}
+
+// instance returns the instantiation of a generic declaration,
+// and queues it for generation if it's new.
+// It returns a mappingError if the type arguments don't satisfy the constraints.
+func (m *monomorphizer) instance(name string, typeArgs []types.Type) (*monoInstance, error) {
+	obj := m.genericObject(name)
+	if obj == nil {
+		return nil, fmt.Errorf("%v is not a generic function or type declared in the source file", name)
+	}
+	argNames := make([]string, len(typeArgs))
+	monoName := name
+	for i, t := range typeArgs {
+		argNames[i] = types.TypeString(t, m.qualifier)
+		monoName += typeArgName(t)
+	}
+	key := name + "[" + strings.Join(argNames, ",") + "]"
+	if inst, ok := m.instances[key]; ok {
+		return inst, nil
+	}
+	if _, err := types.Instantiate(nil, obj.Type(), typeArgs, true); err != nil {
+		return nil, &mappingError{
+			msg: fmt.Sprintf("cannot instantiate %v: %v", key, err),
+		}
+	}
+	inst := &monoInstance{
+		name:     name,
+		typeArgs: typeArgs,
+		monoName: monoName,
+	}
+	m.instances[key] = inst
+	m.queue = append(m.queue, inst)
+	return inst, nil
+}
+
+// typeArgName returns the name of a type argument used in the names
+// of the generated declarations, e.g. Int for int and PtrUser for *models.User.
+func typeArgName(t types.Type) string {
+	switch t := types.Unalias(t).(type) {
+	case *types.Basic:
+		return upperFirst(t.Name())
+	case *types.Named:
+		name := upperFirst(t.Obj().Name())
+		for i := 0; i < t.TypeArgs().Len(); i++ {
+			name += typeArgName(t.TypeArgs().At(i))
+		}
+		return name
+	case *types.Pointer:
+		return "Ptr" + typeArgName(t.Elem())
+	case *types.Slice:
+		return "Slice" + typeArgName(t.Elem())
+	case *types.Array:
+		return fmt.Sprintf("Array%v%v", t.Len(), typeArgName(t.Elem()))
+	case *types.Map:
+		return "Map" + typeArgName(t.Key()) + typeArgName(t.Elem())
+	case *types.Chan:
+		return "Chan" + typeArgName(t.Elem())
+	case *types.Interface:
+		if t.Empty() {
+			return "Any"
+		}
+	}
+	return upperFirst(valueName(types.TypeString(t, qualifyByName)))
+}
+
+// qualifier qualifies types of other packages with their name,
+// and records them as imports.
+func (m *monomorphizer) qualifier(pkg *types.Package) string {
+	if pkg == m.pkg {
+		if m.srcPath == "" {
+			return ""
+		}
+		m.imports[m.srcPath] = pkg.Name()
+		return pkg.Name()
+	}
+	m.imports[pkg.Path()] = pkg.Name()
+	return pkg.Name()
+}
+
+// sourceRef returns the reference to a package level declaration of the source package
+// that is not generated, qualified with the source package's name,
+// or nil if id doesn't refer to one or the declarations are generated into the source package.
+// Unexported declarations can't be referred to from another package.
+func (m *monomorphizer) sourceRef(id *ast.Ident) (ast.Expr, error) {
+	obj := m.info.Uses[id]
+	if m.srcPath == "" || obj == nil || obj.Pkg() != m.pkg || obj.Parent() != m.pkg.Scope() {
+		return nil, nil
+	}
+	if !obj.Exported() {
+		return nil, fmt.Errorf("%v: %v is not exported, it cannot be referred to from another package", m.fset.Position(id.Pos()), id.Name)
+	}
+	return &ast.SelectorExpr{
+		X:   &ast.Ident{Name: m.qualifier(m.pkg)},
+		Sel: &ast.Ident{Name: id.Name},
+	}, nil
+}
+
+// subst returns t with the type parameters replaced by the types in targs.
+func subst(t types.Type, targs map[*types.TypeParam]types.Type) types.Type {
+	switch t := t.(type) {
+	case *types.TypeParam:
+		if arg, ok := targs[t]; ok {
+			return arg
+		}
+	case *types.Pointer:
+		return types.NewPointer(subst(t.Elem(), targs))
+	case *types.Slice:
+		return types.NewSlice(subst(t.Elem(), targs))
+	case *types.Array:
+		return types.NewArray(subst(t.Elem(), targs), t.Len())
+	case *types.Map:
+		return types.NewMap(subst(t.Key(), targs), subst(t.Elem(), targs))
+	case *types.Chan:
+		return types.NewChan(t.Dir(), subst(t.Elem(), targs))
+	case *types.Signature:
+		tuple := func(tuple *types.Tuple) *types.Tuple {
+			vars := make([]*types.Var, tuple.Len())
+			for i := range vars {
+				v := tuple.At(i)
+				vars[i] = types.NewParam(v.Pos(), v.Pkg(), v.Name(), subst(v.Type(), targs))
+			}
+			return types.NewTuple(vars...)
+		}
+		return types.NewSignatureType(nil, nil, nil, tuple(t.Params()), tuple(t.Results()), t.Variadic())
+	case *types.Named:
+		if t.TypeArgs().Len() == 0 {
+			return t
+		}
+		args := make([]types.Type, t.TypeArgs().Len())
+		for i := range args {
+			args[i] = subst(t.TypeArgs().At(i), targs)
+		}
+		if inst, err := types.Instantiate(nil, t.Origin(), args, false); err == nil {
+			return inst
+		}
+	}
+	return t
+}
+
+// typeExpr returns the type expression of a concrete type.
+// Instantiations of the generic types of the source file are replaced
+// with their generated types.
+func (m *monomorphizer) typeExpr(t types.Type) (ast.Expr, error) {
+	switch t := t.(type) {
+	case *types.Pointer:
+		x, err := m.typeExpr(t.Elem())
+		return &ast.StarExpr{X: x}, err
+	case *types.Slice:
+		elt, err := m.typeExpr(t.Elem())
+		return &ast.ArrayType{Elt: elt}, err
+	case *types.Map:
+		key, err := m.typeExpr(t.Key())
+		if err != nil {
+			return nil, err
+		}
+		value, err := m.typeExpr(t.Elem())
+		return &ast.MapType{Key: key, Value: value}, err
+	case *types.Named:
+		if t.TypeArgs().Len() > 0 && t.Obj().Pkg() == m.pkg && m.types[t.Obj().Name()] != nil {
+			args := make([]types.Type, t.TypeArgs().Len())
+			for i := range args {
+				args[i] = t.TypeArgs().At(i)
+			}
+			inst, err := m.instance(t.Obj().Name(), args)
+			if err != nil {
+				return nil, err
+			}
+			return &ast.Ident{Name: inst.monoName}, nil
+		}
+	}
+	return parser.ParseExpr(types.TypeString(t, m.qualifier))
+}
+
+// genericIdent returns the identifier of a generic function or type referred to by expr,
+// which is either an identifier or an explicit instantiation.
+func (m *monomorphizer) genericIdent(expr ast.Expr) *ast.Ident {
+	switch e := expr.(type) {
+	case *ast.IndexExpr:
+		expr = e.X
+	case *ast.IndexListExpr:
+		expr = e.X
+	}
+	id, ok := expr.(*ast.Ident)
+	if !ok {
+		return nil
+	}
+	if _, ok := m.info.Instances[id]; !ok {
+		return nil
+	}
+	obj := m.info.Uses[id]
+	if obj == nil || obj.Pkg() != m.pkg || m.genericObject(id.Name) != obj {
+		return nil
+	}
+	return id
+}
+
+// instantiate returns a copy of a declaration with its type parameters
+// replaced by the type arguments in targs.
+func (m *monomorphizer) instantiate(decl ast.Node, targs map[*types.TypeParam]types.Type) (ast.Node, error) {
+	var err error
+	c := copyNodeWith(decl, func(n ast.Node) ast.Node {
+		if err != nil {
+			return nil
+		}
+		expr, ok := n.(ast.Expr)
+		if !ok {
+			return nil
+		}
+		// References to generic declarations are replaced with their instantiations.
+		if id := m.genericIdent(expr); id != nil {
+			typeArgs := m.info.Instances[id].TypeArgs
+			args := make([]types.Type, typeArgs.Len())
+			for i := range args {
+				args[i] = subst(typeArgs.At(i), targs)
+			}
+			var inst *monoInstance
+			inst, err = m.instance(id.Name, args)
+			if err != nil {
+				return nil
+			}
+			return &ast.Ident{NamePos: id.NamePos, Name: inst.monoName}
+		}
+		id, ok := expr.(*ast.Ident)
+		if !ok {
+			return nil
+		}
+		var ref ast.Expr
+		if ref, err = m.sourceRef(id); ref != nil || err != nil {
+			return ref
+		}
+		tn, ok := m.info.Uses[id].(*types.TypeName)
+		if !ok {
+			return nil
+		}
+		tp, ok := tn.Type().(*types.TypeParam)
+		if !ok || targs[tp] == nil {
+			return nil
+		}
+		var typ ast.Expr
+		typ, err = m.typeExpr(targs[tp])
+		return typ
+	})
+	return c, err
+}
+
+// typeParams maps the type parameters declared in a field list to the type arguments.
+func (m *monomorphizer) typeParams(fields *ast.FieldList, typeArgs []types.Type) map[*types.TypeParam]types.Type {
+	targs := make(map[*types.TypeParam]types.Type)
+	i := 0
+	for _, field := range fields.List {
+		for _, name := range field.Names {
+			if tn, ok := m.info.Defs[name].(*types.TypeName); ok && i < len(typeArgs) {
+				targs[tn.Type().(*types.TypeParam)] = typeArgs[i]
+			}
+			i++
+		}
+	}
+	return targs
+}
+
+// receiverTypeParams maps the type parameters declared by a method's receiver to the type arguments.
+func (m *monomorphizer) receiverTypeParams(recv ast.Expr, typeArgs []types.Type) map[*types.TypeParam]types.Type {
+	if star, ok := recv.(*ast.StarExpr); ok {
+		recv = star.X
+	}
+	var indices []ast.Expr
+	switch e := recv.(type) {
+	case *ast.IndexExpr:
+		indices = []ast.Expr{e.Index}
+	case *ast.IndexListExpr:
+		indices = e.Indices
+	}
+	targs := make(map[*types.TypeParam]types.Type)
+	for i, index := range indices {
+		id, ok := index.(*ast.Ident)
+		if !ok || i >= len(typeArgs) {
+			continue
+		}
+		if tn, ok := m.info.Defs[id].(*types.TypeName); ok {
+			targs[tn.Type().(*types.TypeParam)] = typeArgs[i]
+		}
+	}
+	return targs
+}
+
+// renameDoc replaces the generic declaration's name in its doc comment.
+func renameDoc(doc *ast.CommentGroup, name, monoName string) *ast.CommentGroup {
+	if doc == nil {
+		return nil
+	}
+	re := regexp.MustCompile(`\b` + regexp.QuoteMeta(name) + `\b`)
+	renamed := &ast.CommentGroup{}
+	for _, c := range doc.List {
+		renamed.List = append(renamed.List, &ast.Comment{
+			Slash: c.Slash,
+			Text:  re.ReplaceAllString(c.Text, monoName),
+		})
+	}
+	return renamed
+}
+
+// generate returns the declarations of an instantiation.
+func (m *monomorphizer) generate(inst *monoInstance) ([]ast.Decl, error) {
+	if d, ok := m.funcs[inst.name]; ok {
+		c, err := m.instantiate(d, m.typeParams(d.Type.TypeParams, inst.typeArgs))
+		if err != nil {
+			return nil, err
+		}
+		fd := c.(*ast.FuncDecl)
+		fd.Doc = renameDoc(d.Doc, inst.name, inst.monoName)
+		fd.Name = &ast.Ident{NamePos: fd.Name.NamePos, Name: inst.monoName}
+		fd.Type.TypeParams = nil
+		return []ast.Decl{fd}, nil
+	}
+
+	ts := m.types[inst.name]
+	c, err := m.instantiate(ts, m.typeParams(ts.TypeParams, inst.typeArgs))
+	if err != nil {
+		return nil, err
+	}
+	spec := c.(*ast.TypeSpec)
+	spec.Name = &ast.Ident{NamePos: spec.Name.NamePos, Name: inst.monoName}
+	spec.TypeParams = nil
+	doc := ts.Doc
+	if len(m.typeDecls[inst.name].Specs) == 1 {
+		doc = m.typeDecls[inst.name].Doc
+	}
+	spec.Doc = nil
+	decls := []ast.Decl{
+		&ast.GenDecl{
+			Doc:   renameDoc(doc, inst.name, inst.monoName),
+			Tok:   token.TYPE,
+			Specs: []ast.Spec{spec},
+		},
+	}
+	for _, d := range m.methods[inst.name] {
+		recv := d.Recv.List[0]
+		c, err := m.instantiate(d, m.receiverTypeParams(recv.Type, inst.typeArgs))
+		if err != nil {
+			return nil, err
+		}
+		fd := c.(*ast.FuncDecl)
+		fd.Doc = renameDoc(d.Doc, inst.name, inst.monoName)
+		var recvType ast.Expr = &ast.Ident{Name: inst.monoName}
+		if _, ok := recv.Type.(*ast.StarExpr); ok {
+			recvType = &ast.StarExpr{X: recvType}
+		}
+		fd.Recv.List[0].Type = recvType
+		decls = append(decls, fd)
+	}
+	return decls, nil
+}
+
+// monomorphize generates concrete declarations from the generic functions and types
+// of the source file for the instantiations, e.g. Map[int,string] generates MapIntString.
+// The generic declarations the instantiations refer to are generated as well.
+// If targetPackageName is not empty, they are generated into another package,
+// which imports the source package to refer to its other declarations.
+func monomorphize(in io.Reader, inFilename string, targetPackageName string, instantiations []string, out io.Writer, outFilename string) error {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, inFilename, in, parser.ParseComments)
+	if err != nil {
+		return errors.Wrap(err, "parsing file failed")
+	}
+	names := make([]string, len(instantiations))
+	args := make([][]ast.Expr, len(instantiations))
+	for i, s := range instantiations {
+		names[i], args[i], err = parseInstance(s)
+		if err != nil {
+			return err
+		}
+	}
+	argsFile, args, err := argsFile(fset, file, args)
+	if err != nil {
+		return err
+	}
+	m, err := newMonomorphizer(fset, file, argsFile)
+	if err != nil {
+		return err
+	}
+	if targetPackageName != "" {
+		pkg, err := newTypeLoader(path.Dir(inFilename)).load("")
+		if err != nil {
+			return errors.Wrap(err, "loading the source package failed")
+		}
+		m.srcPath = pkg.Path()
+	}
+	for i, name := range names {
+		if _, err := m.evalInstance(name, args[i]); err != nil {
+			return err
+		}
+	}
+
+	var decls []ast.Decl
+	for i := 0; i < len(m.queue); i++ {
+		instDecls, err := m.generate(m.queue[i])
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("generating %v failed", m.queue[i].monoName))
+		}
+		decls = append(decls, instDecls...)
+	}
+
+	if targetPackageName == "" {
+		targetPackageName = file.Name.Name
+	}
+	outFile := &ast.File{
+		Name: &ast.Ident{
+			Name: targetPackageName,
+		},
+	}
+	// The imports of the source file are kept if the generated declarations use them.
+	used := make(map[string]bool)
+	for _, decl := range decls {
+		ast.Inspect(decl, func(n ast.Node) bool {
+			if sel, ok := n.(*ast.SelectorExpr); ok {
+				if x, ok := sel.X.(*ast.Ident); ok && x.Obj == nil {
+					used[x.Name] = true
+				}
+			}
+			return true
+		})
+	}
+	var outImports []*ast.ImportSpec
+	for _, spec := range file.Imports {
+		if used[importName(spec)] {
+			outImports = append(outImports, spec)
+		}
+	}
+	outImports = addImports(outImports, m.imports)
+	if len(outImports) > 0 {
+		importDecl := &ast.GenDecl{
+			Tok: token.IMPORT,
+		}
+		for _, spec := range outImports {
+			importDecl.Specs = append(importDecl.Specs, spec)
+		}
+		outFile.Decls = append(outFile.Decls, importDecl)
+	}
+	outFile.Decls = append(outFile.Decls, decls...)
+
+	outFset := token.NewFileSet()
+	layout := sourceLayout(m.fset, outFile)
+	layout.separate = true
+	clearPositions(outFile)
+	err = positionGroups(outFset, outFile, layout)
+	if err != nil {
+		return errors.Wrap(err, "positioning declarations failed")
+	}
+
+	buff := &bytes.Buffer{}
+	buff.WriteString("// Code generated by rei. DO NOT EDIT.\n\n")
+	err = printer.Fprint(buff, outFset, outFile)
+	if err != nil {
+		return errors.Wrap(err, "writing file failed")
+	}
+	outBytes, err := imports.Process(outFilename, buff.Bytes(), nil)
+	if err != nil {
+		return errors.Wrap(err, "Formatting file failed")
+	}
+	_, err = out.Write(outBytes)
+	return errors.Wrap(err, "writing file failed")
+}
+
+func monoMain(args []string) {
+	flags := flag.NewFlagSet(myName+" mono", flag.ExitOnError)
+	in := flags.String("in", "", "file with generic functions and types")
+	out := flags.String("out", "", "file to save output to instead of stdout")
+	flags.Usage = usage
+	flags.Parse(args)
+	if *in == "" || flags.NArg() == 0 {
+		usage()
+		os.Exit(exitcodeInvalidArgs)
+	}
+
+	src, err := ioutil.ReadFile(*in)
+	if err != nil {
+		fatal(exitcodeSourceFileInvalid, err)
+	}
+	targetPackageName := ""
+	outFilename := "stdout"
+	if *out != "" {
+		targetPackageName = targetPackage(*in, path.Dir(*out))
+		outFilename = *out
+	}
+	buffer := &bytes.Buffer{}
+	err = monomorphize(bytes.NewReader(src), *in, targetPackageName, flags.Args(), buffer, outFilename)
+	if _, ok := errors.Cause(err).(*mappingError); ok {
+		fatal(exitcodeMappingMismatch, err)
+	}
+	if err != nil {
+		fatal(exitcodeGenFailed, err)
+	}
+	if *out == "" {
+		os.Stdout.Write(buffer.Bytes())
+		return
+	}
+	if err := os.MkdirAll(path.Dir(*out), 0755); err != nil {
+		fatal(exitcodeDestFileFailed, err)
+	}
+	if err := ioutil.WriteFile(*out, buffer.Bytes(), 0644); err != nil {
+		fatal(exitcodeDestFileFailed, err)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+const monoSrc = `package slices
+
+import (
+	"cmp"
+	"fmt"
+	"strings"
+)
+
+// Map applies f to every element of xs.
+func Map[T, U any](xs []T, f func(T) U) []U {
+	out := make([]U, 0, len(xs))
+	for _, x := range xs {
+		out = append(out, f(x))
+	}
+	return out
+}
+
+// Max returns the largest element of xs.
+func Max[T cmp.Ordered](xs ...T) T {
+	var m T
+	for i, x := range xs {
+		if i == 0 || x > m {
+			m = x
+		}
+	}
+	return m
+}
+
+// Join formats the elements of xs.
+func Join[T any](xs []T) string {
+	return strings.Join(Map(xs, func(x T) string { return fmt.Sprint(x) }), ",")
+}
+
+// List is a linked list.
+type List[T any] struct {
+	head *node[T]
+}
+
+type node[T any] struct {
+	value T
+	next  *node[T]
+}
+
+// Push adds v to the front of the list.
+func (l *List[E]) Push(v E) {
+	l.head = &node[E]{value: v, next: l.head}
+}
+`
+
+func TestMonomorphize(t *testing.T) {
+	assert := assert.New(t)
+	testCases := []struct {
+		instantiations []string
+		expected       string
+	}{
+		{
+			instantiations: []string{"Map[int,string]", "Max[float64]"},
+			expected: `// Code generated by rei. DO NOT EDIT.
+
+package slices
+
+// MapIntString applies f to every element of xs.
+func MapIntString(xs []int, f func(int) string) []string {
+	out := make([]string, 0, len(xs))
+	for _, x := range xs {
+		out = append(out, f(x))
+	}
+	return out
+}
+
+// MaxFloat64 returns the largest element of xs.
+func MaxFloat64(xs ...float64) float64 {
+	var m float64
+	for i, x := range xs {
+		if i == 0 || x > m {
+			m = x
+		}
+	}
+	return m
+}
+`,
+		},
+		{
+			instantiations: []string{"Join[time.Duration]"},
+			expected: `// Code generated by rei. DO NOT EDIT.
+
+package slices
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// JoinDuration formats the elements of xs.
+func JoinDuration(xs []time.Duration) string {
+	return strings.Join(MapDurationString(xs, func(x time.Duration) string { return fmt.Sprint(x) }), ",")
+}
+
+// MapDurationString applies f to every element of xs.
+func MapDurationString(xs []time.Duration, f func(time.Duration) string) []string {
+	out := make([]string, 0, len(xs))
+	for _, x := range xs {
+		out = append(out, f(x))
+	}
+	return out
+}
+`,
+		},
+		{
+			instantiations: []string{"List[*strings.Builder]"},
+			expected: `// Code generated by rei. DO NOT EDIT.
+
+package slices
+
+import "strings"
+
+// ListPtrBuilder is a linked list.
+type ListPtrBuilder struct {
+	head *nodePtrBuilder
+}
+
+// Push adds v to the front of the list.
+func (l *ListPtrBuilder) Push(v *strings.Builder) {
+	l.head = &nodePtrBuilder{value: v, next: l.head}
+}
+
+type nodePtrBuilder struct {
+	value *strings.Builder
+	next  *nodePtrBuilder
+}
+`,
+		},
+	}
+	for i, tc := range testCases {
+		tc := tc
+		t.Run(fmt.Sprintf("case %v", i), func(t *testing.T) {
+			out := &bytes.Buffer{}
+			err := monomorphize(bytes.NewBufferString(monoSrc), "slices.go", "", tc.instantiations, out, "out.go")
+			if assert.NoError(err) {
+				assert.Equal(tc.expected, out.String())
+			}
+		})
+	}
+}
+
+func TestMonomorphizeErrors(t *testing.T) {
+	assert := assert.New(t)
+	testCases := []struct {
+		instantiation string
+		err           string
+		mismatch      bool
+	}{
+		{"Max[[]int]", "[]int does not satisfy cmp.Ordered", true},
+		{"Map[int]", "cannot instantiate Map[int]", true},
+		{"Max[foo.Bar]", "invalid type argument foo.Bar of Max", false},
+		{"Min[int]", "Min is not a generic function or type declared in the source file", false},
+		{"Max", "invalid instantiation Max", false},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.instantiation, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			err := monomorphize(bytes.NewBufferString(monoSrc), "slices.go", "", []string{tc.instantiation}, out, "out.go")
+			if assert.Error(err) {
+				assert.Contains(err.Error(), tc.err)
+				_, mismatch := errors.Cause(err).(*mappingError)
+				assert.Equal(tc.mismatch, mismatch)
+			}
+			assert.Empty(out.String())
+		})
+	}
+}
+
+func TestMonomorphizePackage(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "rei")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	src := `package k
+
+// Celsius is a temperature.
+type Celsius float64
+
+const three = 3
+
+// Scale doubles x.
+func Scale(x int) int {
+	return x * 2
+}
+
+func double[T ~int](x T) T {
+	return T(Scale(int(x)))
+}
+
+func Conv[T ~float64](x T) Celsius {
+	return Celsius(x)
+}
+
+func triple[T ~int](x T) T {
+	return x * three
+}
+`
+	files := map[string]string{
+		"go.mod": "module example.com/k\n",
+		"k.go":   src,
+	}
+	for name, src := range files {
+		if !assert.NoError(ioutil.WriteFile(filepath.Join(dir, name), []byte(src), 0644)) {
+			return
+		}
+	}
+	inFilename := filepath.Join(dir, "k.go")
+
+	out := &bytes.Buffer{}
+	err = monomorphize(bytes.NewBufferString(src), inFilename, "other", []string{"double[int]", "Conv[float64]"}, out, "out.go")
+	if assert.NoError(err) {
+		assert.Equal(`// Code generated by rei. DO NOT EDIT.
+
+package other
+
+import "example.com/k"
+
+func doubleInt(x int) int {
+	return int(k.Scale(int(x)))
+}
+
+func ConvFloat64(x float64) k.Celsius {
+	return k.Celsius(x)
+}
+`, out.String())
+	}
+
+	out.Reset()
+	err = monomorphize(bytes.NewBufferString(src), inFilename, "other", []string{"triple[int]"}, out, "out.go")
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "three is not exported, it cannot be referred to from another package")
+	}
+	assert.Empty(out.String())
+}
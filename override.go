@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// override is a function that replaces the body of a generic function
+// when the generic types are mapped to specific concrete types.
+type override struct {
+	decl   *ast.FuncDecl
+	target string
+	// mapping is the concrete types the override applies to.
+	mapping map[string]*Type
+}
+
+// parseOverride parses the arguments of a //rei:override directive:
+//
+//	//rei:override sumType Type=string,Other=int
+func parseOverride(args string) (target string, mapping map[string]*Type, err error) {
+	parts := strings.Fields(args)
+	if len(parts) != 2 {
+		return "", nil, fmt.Errorf("invalid override %v, expected function name and type mapping", args)
+	}
+	if ok, _ := isIdentifier(parts[0]); !ok {
+		return "", nil, fmt.Errorf("invalid override %v, %v is not a valid identifier", args, parts[0])
+	}
+	mapping, err = parseMapping(parts[1])
+	if err != nil {
+		return "", nil, errors.Wrap(err, fmt.Sprintf("invalid override %v", args))
+	}
+	return parts[0], mapping, nil
+}
+
+// sameType reports whether two concrete types are the same,
+// ignoring the name the package is imported as.
+func sameType(a, b *Type) bool {
+	return a.Pkg == b.Pkg && a.Name == b.Name && a.Pointer == b.Pointer
+}
+
+// matches reports whether the override applies to the type mapping.
+func (o *override) matches(genericTypes map[string]*Type) bool {
+	if len(o.mapping) == 0 {
+		return false
+	}
+	for generic, t := range o.mapping {
+		gType, ok := genericTypes[generic]
+		if !ok || !sameType(gType, t) {
+			return false
+		}
+	}
+	return true
+}
+
+// conventionOverride returns the override of a function named
+// after the naming convention {target}_{ConcreteType},
+// e.g. sumType_string overrides sumType when Type is mapped to string.
+// Every function whose target is a function in the file that depends on
+// the generic types is an override, whatever its suffix. It only applies
+// if the suffix names the concrete type of a generic type whose name
+// is part of the target's name.
+func (gctx *genericContext) conventionOverride(d *ast.FuncDecl, funcs map[string]*ast.FuncDecl) *override {
+	idx := strings.LastIndex(d.Name.Name, "_")
+	if idx <= 0 || idx == len(d.Name.Name)-1 {
+		return nil
+	}
+	target, suffix := d.Name.Name[:idx], d.Name.Name[idx+1:]
+	if funcs[target] == nil || gctx.funcs[funcs[target].Pos()] == nil {
+		return nil
+	}
+	o := &override{
+		decl:   d,
+		target: target,
+	}
+	for generic, gType := range gctx.genericTypes {
+		if !strings.Contains(target, lowerFirst(generic)) && !strings.Contains(target, upperFirst(generic)) {
+			continue
+		}
+		if gType.Name == suffix {
+			o.mapping = map[string]*Type{
+				generic: gType,
+			}
+		}
+	}
+	return o
+}
+
+// applyOverrides replaces the signature and body of generic functions
+// with the override matching the type mapping, and removes
+// every override from the file and the dependants.
+// It must be called after collectDependants, since the overridden
+// function may not depend on the generic types anymore.
+// Overrides are declared with a //rei:override directive,
+// or by naming them after the {target}_{ConcreteType} convention.
+func (gctx *genericContext) applyOverrides(file *ast.File) error {
+	funcs := make(map[string]*ast.FuncDecl)
+	for _, decl := range file.Decls {
+		if d, ok := decl.(*ast.FuncDecl); ok && d.Recv == nil {
+			funcs[d.Name.Name] = d
+		}
+	}
+
+	var overrides []*override
+	isOverride := make(map[ast.Decl]bool)
+	for _, decl := range file.Decls {
+		d, ok := decl.(*ast.FuncDecl)
+		if !ok || d.Recv != nil {
+			continue
+		}
+		var o *override
+		if dirs := gctx.directives[d]; dirs != nil && dirs.overrideTarget != "" {
+			if funcs[dirs.overrideTarget] == nil {
+				return fmt.Errorf("%v: override of unknown function %v", gctx.fset.Position(d.Pos()), dirs.overrideTarget)
+			}
+			o = &override{
+				decl:    d,
+				target:  dirs.overrideTarget,
+				mapping: dirs.overrideMapping,
+			}
+		} else {
+			o = gctx.conventionOverride(d, funcs)
+		}
+		if o == nil {
+			continue
+		}
+		isOverride[d] = true
+		overrides = append(overrides, o)
+	}
+
+	applied := make(map[string]*override)
+	for _, o := range overrides {
+		if !o.matches(gctx.genericTypes) {
+			continue
+		}
+		if prev, ok := applied[o.target]; ok {
+			return fmt.Errorf("%v: %v and %v both override %v",
+				gctx.fset.Position(o.decl.Pos()), prev.decl.Name.Name, o.decl.Name.Name, o.target)
+		}
+		applied[o.target] = o
+		target := funcs[o.target]
+		// Keep the target's position, the function's position is its type's position.
+		funcType := *o.decl.Type
+		funcType.Func = target.Type.Func
+		target.Type = &funcType
+		target.Body = o.decl.Body
+	}
+
+	decls := file.Decls[:0]
+	for _, decl := range file.Decls {
+		if isOverride[decl] {
+			delete(gctx.funcs, decl.Pos())
+			continue
+		}
+		decls = append(decls, decl)
+	}
+	file.Decls = decls
+	return nil
+}
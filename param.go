@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// Param describes a template parameter declared in the template's header
+// with a //rei:param directive:
+//
+//	//rei:param Type constraint=comparable default=string doc="element type"
+type Param struct {
+	Name       string
+	Constraint string
+	Default    string
+	Doc        string
+}
+
+// headerDirectives are the directives that are only valid
+// in the template's header.
+var headerDirectives = map[string]bool{
+	"param": true,
+	"uses":  true,
+}
+
+// splitArgs splits the arguments of a directive at whitespace.
+// Double quoted parts are unquoted, e.g. doc="element type" is a single argument.
+func splitArgs(s string) ([]string, error) {
+	var args []string
+	var arg []byte
+	inArg := false
+	for i := 0; i < len(s); {
+		switch {
+		case s[i] == '"':
+			quoted, err := strconv.QuotedPrefix(s[i:])
+			if err != nil {
+				return args, fmt.Errorf("invalid quoted string at %v in %v", i, s)
+			}
+			unquoted, _ := strconv.Unquote(quoted)
+			arg = append(arg, unquoted...)
+			inArg = true
+			i += len(quoted)
+		case unicode.IsSpace(rune(s[i])):
+			if inArg {
+				args = append(args, string(arg))
+				arg = arg[:0]
+				inArg = false
+			}
+			i++
+		default:
+			arg = append(arg, s[i])
+			inArg = true
+			i++
+		}
+	}
+	if inArg {
+		args = append(args, string(arg))
+	}
+	return args, nil
+}
+
+// headerComments returns the comments of the file before its first declaration.
+func headerComments(file *ast.File) []*ast.CommentGroup {
+	end := token.NoPos
+	if len(file.Decls) > 0 {
+		end = file.Decls[0].Pos()
+	}
+	var ret []*ast.CommentGroup
+	for _, cg := range file.Comments {
+		if end.IsValid() && cg.Pos() >= end {
+			break
+		}
+		ret = append(ret, cg)
+	}
+	return ret
+}
+
+// headerDirective calls fn for every directive with the given name
+// in the template's header.
+func headerDirective(fset *token.FileSet, file *ast.File, name string, fn func(args string) error) error {
+	for _, cg := range headerComments(file) {
+		for _, c := range cg.List {
+			if !isDirective(c) {
+				continue
+			}
+			dirName, args := splitDirective(c)
+			if dirName != name {
+				continue
+			}
+			if err := fn(args); err != nil {
+				return errors.Wrap(err, fset.Position(c.Pos()).String())
+			}
+		}
+	}
+	return nil
+}
+
+// parseParam parses the arguments of a //rei:param directive.
+func parseParam(s string) (*Param, error) {
+	args, err := splitArgs(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("missing parameter name")
+	}
+	p := &Param{
+		Name: args[0],
+	}
+	if ok, _ := isIdentifier(p.Name); !ok {
+		return nil, fmt.Errorf("invalid parameter name %v", p.Name)
+	}
+	for _, arg := range args[1:] {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid parameter option %v, expected key=value", arg)
+		}
+		switch parts[0] {
+		case "constraint":
+			p.Constraint = parts[1]
+		case "default":
+			if _, err := ParseType(parts[1]); err != nil {
+				return nil, errors.Wrap(err, fmt.Sprintf("invalid default of %v", p.Name))
+			}
+			p.Default = parts[1]
+		case "doc":
+			p.Doc = parts[1]
+		default:
+			return nil, fmt.Errorf("unknown parameter option %v", parts[0])
+		}
+	}
+	return p, nil
+}
+
+// parseParams returns the parameters declared in the template's header.
+func parseParams(fset *token.FileSet, file *ast.File) ([]*Param, error) {
+	var params []*Param
+	seen := make(map[string]bool)
+	err := headerDirective(fset, file, "param", func(args string) error {
+		p, err := parseParam(args)
+		if err != nil {
+			return err
+		}
+		if seen[p.Name] {
+			return fmt.Errorf("duplicate parameter %v", p.Name)
+		}
+		seen[p.Name] = true
+		params = append(params, p)
+		return nil
+	})
+	return params, err
+}
+
+// String returns the parameter in the format of the //rei:param directive.
+func (p *Param) String() string {
+	s := directivePrefix + "param " + p.Name
+	if p.Constraint != "" {
+		s += " constraint=" + quoteArg(p.Constraint)
+	}
+	if p.Default != "" {
+		s += " default=" + quoteArg(p.Default)
+	}
+	if p.Doc != "" {
+		s += " doc=" + quoteArg(p.Doc)
+	}
+	return s
+}
+
+// quoteArg quotes a directive argument if splitArgs would split it.
+func quoteArg(s string) string {
+	if strings.IndexFunc(s, func(r rune) bool { return unicode.IsSpace(r) || r == '"' }) != -1 {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// splitParams splits the parameters into the ones bound by the type mapping,
+// and the ones left unbound.
+func splitParams(params []*Param, typeMapping map[string]*Type) (bound, unbound []*Param) {
+	for _, p := range params {
+		if _, ok := typeMapping[p.Name]; ok {
+			bound = append(bound, p)
+		} else {
+			unbound = append(unbound, p)
+		}
+	}
+	return bound, unbound
+}
+
+// applyParams validates the type mapping against the declared parameters,
+// and adds the default of parameters missing from the mapping.
+// If the template does not declare parameters, the mapping is not validated.
+func applyParams(params []*Param, typeMapping map[string]*Type) error {
+	if len(params) == 0 {
+		return nil
+	}
+	declared := make(map[string]bool, len(params))
+	for _, p := range params {
+		declared[p.Name] = true
+	}
+	names := make([]string, 0, len(typeMapping))
+	for name := range typeMapping {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !declared[name] {
+			return &mappingError{
+				msg: fmt.Sprintf("unknown template parameter %v", name),
+			}
+		}
+	}
+	for _, p := range params {
+		if _, ok := typeMapping[p.Name]; ok {
+			continue
+		}
+		if p.Default == "" {
+			return &mappingError{
+				msg: fmt.Sprintf("missing template parameter %v", p.Name),
+			}
+		}
+		tp, err := ParseType(p.Default)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("invalid default of %v", p.Name))
+		}
+		typeMapping[p.Name] = &tp
+	}
+	return nil
+}
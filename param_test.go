@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitArgs(t *testing.T) {
+	assert := assert.New(t)
+	testCases := []struct {
+		input    string
+		ok       bool
+		expected []string
+	}{
+		{"Type", true, []string{"Type"}},
+		{"  Type   default=string ", true, []string{"Type", "default=string"}},
+		{`Type doc="element type"`, true, []string{"Type", "doc=element type"}},
+		{`Type doc="a \"quoted\" doc"`, true, []string{"Type", `doc=a "quoted" doc`}},
+		{`Type doc="unterminated`, false, nil},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.input, func(t *testing.T) {
+			args, err := splitArgs(tc.input)
+			assert.Equal(tc.ok, err == nil, fmt.Sprintf("%v: %v", tc.input, err))
+			if tc.ok {
+				assert.Equal(tc.expected, args, tc.input)
+			}
+		})
+	}
+}
+
+func TestParseParam(t *testing.T) {
+	assert := assert.New(t)
+	testCases := []struct {
+		input    string
+		ok       bool
+		expected *Param
+	}{
+		{"Type", true, &Param{Name: "Type"}},
+		{`Type constraint=comparable default=string doc="element type"`, true, &Param{
+			Name:       "Type",
+			Constraint: "comparable",
+			Default:    "string",
+			Doc:        "element type",
+		}},
+		{`Type constraint="implements io.Reader" default=*os.File`, true, &Param{
+			Name:       "Type",
+			Constraint: "implements io.Reader",
+			Default:    "*os.File",
+		}},
+		{"", false, nil},
+		{"1Type", false, nil},
+		{"Type default", false, nil},
+		{"Type default=1string", false, nil},
+		{"Type frobnicate=true", false, nil},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.input, func(t *testing.T) {
+			p, err := parseParam(tc.input)
+			assert.Equal(tc.ok, err == nil, fmt.Sprintf("%v: %v", tc.input, err))
+			if tc.ok {
+				assert.Equal(tc.expected, p, tc.input)
+				// String must produce a directive that parses to the same parameter.
+				reparsed, err := parseParam(strings.TrimPrefix(p.String(), directivePrefix+"param "))
+				assert.NoError(err, p.String())
+				assert.Equal(p, reparsed, p.String())
+			}
+		})
+	}
+}
+
+func TestApplyParams(t *testing.T) {
+	assert := assert.New(t)
+	params := []*Param{
+		{Name: "KeyType"},
+		{Name: "ValueType", Default: "int"},
+	}
+	testCases := []struct {
+		name     string
+		mapping  map[string]*Type
+		ok       bool
+		expected map[string]*Type
+	}{
+		{
+			"default",
+			map[string]*Type{"KeyType": {Name: "string"}},
+			true,
+			map[string]*Type{"KeyType": {Name: "string"}, "ValueType": {Name: "int"}},
+		},
+		{
+			"override default",
+			map[string]*Type{"KeyType": {Name: "string"}, "ValueType": {Name: "bool"}},
+			true,
+			map[string]*Type{"KeyType": {Name: "string"}, "ValueType": {Name: "bool"}},
+		},
+		{
+			"missing",
+			map[string]*Type{"ValueType": {Name: "bool"}},
+			false,
+			nil,
+		},
+		{
+			"unknown",
+			map[string]*Type{"KeyType": {Name: "string"}, "Type": {Name: "bool"}},
+			false,
+			nil,
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			err := applyParams(params, tc.mapping)
+			assert.Equal(tc.ok, err == nil, fmt.Sprintf("%v: %v", tc.name, err))
+			if tc.ok {
+				assert.Equal(tc.expected, tc.mapping, tc.name)
+			}
+		})
+	}
+}
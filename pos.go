@@ -1,8 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"go/ast"
+	"go/printer"
 	"go/token"
 )
 
@@ -136,6 +138,17 @@ func (t *tokenPositioner) fixPositions(n ast.Node) {
 		n.Lbrack = t.next()
 		t.fixPositions(n.Index)
 		n.Rbrack = t.next()
+	case *ast.IndexListExpr:
+		if n == nil {
+			return
+		}
+		t.fixPositions(n.X)
+		n.Lbrack = t.next()
+		for _, index := range n.Indices {
+			t.fixPositions(index)
+			t.next() // comma
+		}
+		n.Rbrack = t.next()
 	case *ast.SliceExpr:
 		if n == nil {
 			return
@@ -662,6 +675,16 @@ func clearPositions(n ast.Node) {
 		n.Lbrack = 0
 		clearPositions(n.Index)
 		n.Rbrack = 0
+	case *ast.IndexListExpr:
+		if n == nil {
+			return
+		}
+		clearPositions(n.X)
+		n.Lbrack = 0
+		for _, index := range n.Indices {
+			clearPositions(index)
+		}
+		n.Rbrack = 0
 	case *ast.SliceExpr:
 		if n == nil {
 			return
@@ -1032,3 +1055,295 @@ func clearPositions(n ast.Node) {
 		panic(fmt.Sprintf("unknown node: %#v", n))
 	}
 }
+
+// positionGroups assigns positions to the parenthesized declarations of a file
+// whose positions have been cleared, so that the printer puts every spec
+// and its doc comment on a separate line.
+// The printer places comments by comparing their line with the line
+// it is currently at, so each group starts further than the number of lines
+// the whole file can be printed in.
+// The lists are positioned according to their layout in the source, see sourceLayout:
+// the elements of multi-line composite literals on their lines, and the braces
+// of one-line empty struct and interface types on the same line.
+// If the layout separates declarations, the other declarations start a group as well.
+func positionGroups(fset *token.FileSet, file *ast.File, layout *listLayout) error {
+	if layout == nil {
+		layout = &listLayout{}
+	}
+	var groups []*ast.GenDecl
+	size, listSize, separated := 0, 0, 0
+	for _, decl := range file.Decls {
+		ast.Inspect(decl, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.CompositeLit:
+				if layout.lits[n] != nil {
+					listSize += len(n.Elts) + 2
+				}
+			case *ast.FieldList:
+				if layout.empty[n] {
+					listSize++
+				}
+			case *ast.FuncLit:
+				if layout.separate {
+					listSize++
+				}
+			}
+			return true
+		})
+		d, ok := decl.(*ast.GenDecl)
+		if !ok || len(d.Specs) < 2 {
+			if layout.separate {
+				separated++
+				size += 2
+				if doc := declDoc(decl); doc != nil {
+					size += len(doc.List)
+				}
+			}
+			continue
+		}
+		groups = append(groups, d)
+		size += 4
+		if d.Doc != nil {
+			size += len(d.Doc.List)
+		}
+		for _, spec := range d.Specs {
+			size++
+			if doc := specDoc(spec); doc != nil {
+				size += len(doc.List)
+			}
+		}
+	}
+	size += listSize
+	if size == 0 {
+		return nil
+	}
+
+	gap := 0
+	if len(groups)+separated > 0 {
+		buff := &bytes.Buffer{}
+		if err := printer.Fprint(buff, fset, file); err != nil {
+			return err
+		}
+		// The elements of the literals can add a line each.
+		gap = bytes.Count(buff.Bytes(), []byte("\n")) + listSize + 1
+		size += gap * (len(groups) + separated)
+	}
+
+	// Every offset is on a new line.
+	f := fset.AddFile("", -1, size)
+	lines := make([]int, size)
+	for i := range lines {
+		lines[i] = i
+	}
+	f.SetLines(lines)
+
+	t := &tokenPositioner{
+		currentPos: token.Pos(f.Base()),
+	}
+	var positionLists func(n ast.Node) bool
+	positionLists = func(n ast.Node) bool {
+		if fn, ok := n.(*ast.FuncLit); ok && layout.separate {
+			// A function literal keeps a position to print its keyword,
+			// which must not move the printer back before its declaration.
+			fn.Type.Func = t.next()
+			return true
+		}
+		if fields, ok := n.(*ast.FieldList); ok && layout.empty[fields] {
+			fields.Opening = t.next()
+			fields.Closing = fields.Opening
+			return false
+		}
+		lit, ok := n.(*ast.CompositeLit)
+		if !ok || layout.lits[lit] == nil {
+			return true
+		}
+		if lit.Type != nil {
+			ast.Inspect(lit.Type, positionLists)
+		}
+		breaks := layout.lits[lit]
+		pos := t.next()
+		lit.Lbrace = pos
+		for i, elt := range lit.Elts {
+			if breaks[i] {
+				pos = t.next()
+			}
+			setStartPos(elt, pos)
+			ast.Inspect(elt, positionLists)
+		}
+		if breaks[len(lit.Elts)] {
+			pos = t.next()
+		}
+		lit.Rbrace = pos
+		return false
+	}
+	for _, decl := range file.Decls {
+		d, ok := decl.(*ast.GenDecl)
+		if !ok || len(d.Specs) < 2 {
+			if layout.separate {
+				t.nextN(gap)
+				if doc := declDoc(decl); doc != nil {
+					for _, c := range doc.List {
+						c.Slash = t.next()
+					}
+				}
+				switch d := decl.(type) {
+				case *ast.FuncDecl:
+					d.Type.Func = t.next()
+				case *ast.GenDecl:
+					d.TokPos = t.next()
+				}
+			}
+			ast.Inspect(decl, positionLists)
+			if d, ok := decl.(*ast.FuncDecl); ok && layout.separate && d.Body != nil {
+				// The printer keeps a body on one line if its braces are.
+				d.Body.Lbrace = d.Type.Func
+				d.Body.Rbrace = t.next()
+			}
+			continue
+		}
+		t.nextN(gap)
+		if d.Doc != nil {
+			for _, c := range d.Doc.List {
+				c.Slash = t.next()
+			}
+		}
+		d.TokPos = t.next()
+		d.Lparen = t.next()
+		for _, spec := range d.Specs {
+			if doc := specDoc(spec); doc != nil {
+				for _, c := range doc.List {
+					c.Slash = t.next()
+				}
+			}
+			switch s := spec.(type) {
+			case *ast.TypeSpec:
+				s.Name.NamePos = t.next()
+			case *ast.ValueSpec:
+				s.Names[0].NamePos = t.next()
+			}
+			ast.Inspect(spec, positionLists)
+		}
+		d.Rparen = t.next()
+	}
+	return nil
+}
+
+func declDoc(decl ast.Decl) *ast.CommentGroup {
+	switch d := decl.(type) {
+	case *ast.FuncDecl:
+		return d.Doc
+	case *ast.GenDecl:
+		return d.Doc
+	}
+	return nil
+}
+
+func specDoc(spec ast.Spec) *ast.CommentGroup {
+	switch s := spec.(type) {
+	case *ast.TypeSpec:
+		return s.Doc
+	case *ast.ValueSpec:
+		return s.Doc
+	}
+	return nil
+}
+
+// listLayout is the layout of the lists of a file in its source,
+// which is lost when the positions are cleared.
+type listLayout struct {
+	// lits are the composite literals whose braces are on different lines,
+	// with the elements and the closing brace that start a new line.
+	lits map[*ast.CompositeLit][]bool
+	// empty are the field lists of the empty struct and interface types
+	// whose braces are on the same line.
+	empty map[*ast.FieldList]bool
+	// separate puts every declaration on its own group of lines,
+	// so that they are separated by blank lines.
+	separate bool
+}
+
+// sourceLayout returns the layout of the lists of n in fset, i.e. in the source file.
+// Elements repeated by //rei:fields have the position of the original,
+// each copy starts a new line.
+// It must be called before the positions are cleared.
+func sourceLayout(fset *token.FileSet, n ast.Node) *listLayout {
+	layout := &listLayout{
+		lits:  make(map[*ast.CompositeLit][]bool),
+		empty: make(map[*ast.FieldList]bool),
+	}
+	line := func(pos token.Pos) int {
+		return fset.Position(pos).Line
+	}
+	ast.Inspect(n, func(n ast.Node) bool {
+		var fields *ast.FieldList
+		switch n := n.(type) {
+		case *ast.StructType:
+			fields = n.Fields
+		case *ast.InterfaceType:
+			fields = n.Methods
+		case *ast.CompositeLit:
+			if !n.Lbrace.IsValid() || !n.Rbrace.IsValid() || line(n.Lbrace) == line(n.Rbrace) {
+				return true
+			}
+			breaks := make([]bool, len(n.Elts)+1)
+			prev := n.Lbrace
+			for i, elt := range n.Elts {
+				breaks[i] = elt.Pos() == prev || line(elt.Pos()) != line(prev)
+				prev = elt.Pos()
+			}
+			if len(n.Elts) > 0 {
+				prev = n.Elts[len(n.Elts)-1].End()
+			}
+			breaks[len(n.Elts)] = line(n.Rbrace) != line(prev)
+			layout.lits[n] = breaks
+		}
+		if fields != nil && len(fields.List) == 0 && fields.Opening.IsValid() && line(fields.Opening) == line(fields.Closing) {
+			layout.empty[fields] = true
+		}
+		return true
+	})
+	return layout
+}
+
+// setStartPos sets the position of the first token of an expression.
+// Expressions starting with a token that has no position are not changed.
+func setStartPos(e ast.Expr, pos token.Pos) {
+	switch e := e.(type) {
+	case *ast.Ident:
+		e.NamePos = pos
+	case *ast.BasicLit:
+		e.ValuePos = pos
+	case *ast.KeyValueExpr:
+		setStartPos(e.Key, pos)
+	case *ast.CompositeLit:
+		if e.Type != nil {
+			setStartPos(e.Type, pos)
+		} else {
+			e.Lbrace = pos
+		}
+	case *ast.CallExpr:
+		setStartPos(e.Fun, pos)
+	case *ast.SelectorExpr:
+		setStartPos(e.X, pos)
+	case *ast.IndexExpr:
+		setStartPos(e.X, pos)
+	case *ast.SliceExpr:
+		setStartPos(e.X, pos)
+	case *ast.TypeAssertExpr:
+		setStartPos(e.X, pos)
+	case *ast.BinaryExpr:
+		setStartPos(e.X, pos)
+	case *ast.UnaryExpr:
+		e.OpPos = pos
+	case *ast.StarExpr:
+		e.Star = pos
+	case *ast.ParenExpr:
+		e.Lparen = pos
+	case *ast.FuncLit:
+		e.Type.Func = pos
+	case *ast.ArrayType:
+		e.Lbrack = pos
+	case *ast.MapType:
+		e.Map = pos
+	}
+}
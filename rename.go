@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// renamePair replaces old with new.
+// A word pair only replaces old at identifier word boundaries.
+type renamePair struct {
+	old, new string
+	word     bool
+}
+
+// renamer replaces the names of generic types and the fragments of identifier mappings.
+// Like strings.Replacer, it replaces the first matching pair at each position,
+// in the order of the pairs, without rescanning replaced text.
+type renamer []renamePair
+
+// newRenamer returns a renamer of a list of old, new string pairs.
+func newRenamer(pairs []string, word bool) renamer {
+	r := make(renamer, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		r = append(r, renamePair{
+			old:  pairs[i],
+			new:  pairs[i+1],
+			word: word,
+		})
+	}
+	return r
+}
+
+// Replace returns a copy of s with all replacements performed.
+func (r renamer) Replace(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		matched := false
+		for _, p := range r {
+			if p.old == "" || !strings.HasPrefix(s[i:], p.old) {
+				continue
+			}
+			if p.word && !isWordAt(s, i, i+len(p.old)) {
+				continue
+			}
+			b.WriteString(p.new)
+			i += len(p.old)
+			matched = true
+			break
+		}
+		if !matched {
+			b.WriteByte(s[i])
+			i++
+		}
+	}
+	return b.String()
+}
+
+// containsWord reports whether s contains word at identifier word boundaries.
+func containsWord(s, word string) bool {
+	if word == "" {
+		return false
+	}
+	for i := 0; i+len(word) <= len(s); {
+		j := strings.Index(s[i:], word)
+		if j < 0 {
+			return false
+		}
+		if isWordAt(s, i+j, i+j+len(word)) {
+			return true
+		}
+		i += j + 1
+	}
+	return false
+}
+
+// isWordAt reports whether s[start:end] is delimited by identifier word boundaries:
+// the start or end of s, a character that can't be part of a word
+// like an underscore, or a lower to upper case transition,
+// e.g. Entity in ErrEntityNotFound and entity in entityCache, but not entity in identity.
+func isWordAt(s string, start, end int) bool {
+	if start > 0 {
+		prev, _ := utf8.DecodeLastRuneInString(s[:start])
+		first, _ := utf8.DecodeRuneInString(s[start:])
+		if isWordRune(prev) && !(unicode.IsUpper(first) && (unicode.IsLower(prev) || unicode.IsDigit(prev))) {
+			return false
+		}
+	}
+	if end < len(s) {
+		next, _ := utf8.DecodeRuneInString(s[end:])
+		if unicode.IsLower(next) {
+			return false
+		}
+	}
+	return true
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// shim is the replacement of a method of a generic type
+// for concrete types that don't have the method, e.g. builtin types.
+// It's declared with a //rei:builtin directive on the generic type:
+//
+//	//rei:builtin Less = a < b
+//	//rei:builtin Less(x, y) = x < y
+//	//rei:builtin func Less = a < b
+//
+// In the short form the receiver is a, and the arguments are b, c, and so on.
+// The func form declares a function with the expression as its body,
+// e.g. lessType(a, b Type) bool, and the calls are replaced with calls of it.
+type shim struct {
+	method string
+	// params are the names of the receiver and the arguments.
+	params []string
+	expr   string
+	// function is set for the func form.
+	function bool
+	// pos is the position of the directive.
+	pos token.Pos
+}
+
+func parseShim(text string) (*shim, error) {
+	parts := strings.SplitN(text, "=", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid shim %q, expected Method = expression", text)
+	}
+	s := &shim{
+		expr: strings.TrimSpace(parts[1]),
+	}
+	if _, err := parser.ParseExpr(s.expr); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("invalid shim %q", text))
+	}
+	signature := strings.TrimSpace(parts[0])
+	if strings.HasPrefix(signature, "func ") {
+		s.function = true
+		signature = strings.TrimSpace(strings.TrimPrefix(signature, "func "))
+	}
+	if idx := strings.Index(signature, "("); idx != -1 {
+		if !strings.HasSuffix(signature, ")") {
+			return nil, fmt.Errorf("invalid shim %q, missing )", text)
+		}
+		for _, param := range strings.Split(signature[idx+1:len(signature)-1], ",") {
+			s.params = append(s.params, strings.TrimSpace(param))
+		}
+		signature = strings.TrimSpace(signature[:idx])
+	}
+	s.method = signature
+	if ok, _ := isIdentifier(s.method); !ok {
+		return nil, fmt.Errorf("invalid shim %q, %v is not a valid method name", text, s.method)
+	}
+	for _, param := range s.params {
+		if ok, _ := isIdentifier(param); !ok {
+			return nil, fmt.Errorf("invalid shim %q, %v is not a valid parameter name", text, param)
+		}
+	}
+	return s, nil
+}
+
+// param returns the name of the i-th parameter, 0 being the receiver.
+func (s *shim) param(i int) string {
+	if s.params != nil {
+		if i < len(s.params) {
+			return s.params[i]
+		}
+		return ""
+	}
+	return string(rune('a' + i))
+}
+
+// isPrimary reports whether e can be used as an operand without parentheses.
+func isPrimary(e ast.Expr) bool {
+	switch e.(type) {
+	case *ast.Ident, *ast.BasicLit, *ast.CompositeLit, *ast.ParenExpr,
+		*ast.SelectorExpr, *ast.IndexExpr, *ast.SliceExpr, *ast.CallExpr, *ast.TypeAssertExpr:
+		return true
+	}
+	return false
+}
+
+// isReference reports whether e is an identifier or a selector of one,
+// which can be evaluated more than once.
+func isReference(e ast.Expr) bool {
+	switch e := e.(type) {
+	case *ast.Ident:
+		return true
+	case *ast.SelectorExpr:
+		return isReference(e.X)
+	case *ast.ParenExpr:
+		return isReference(e.X)
+	}
+	return false
+}
+
+// needsParens reports whether e must be parenthesized to be used as
+// the child of parent with the given field name.
+func needsParens(parent ast.Node, name string, e ast.Expr) bool {
+	if isPrimary(e) {
+		return false
+	}
+	switch p := parent.(type) {
+	case *ast.BinaryExpr:
+		b, ok := e.(*ast.BinaryExpr)
+		if !ok {
+			return false
+		}
+		prec, parentPrec := b.Op.Precedence(), p.Op.Precedence()
+		return prec < parentPrec || (prec == parentPrec && name == "Y")
+	case *ast.UnaryExpr, *ast.StarExpr, *ast.SelectorExpr,
+		*ast.IndexExpr, *ast.SliceExpr, *ast.TypeAssertExpr:
+		return true
+	case *ast.CallExpr:
+		return name == "Fun"
+	}
+	return false
+}
+
+// expand returns the shim's expression with the parameters replaced by
+// the receiver and the arguments of a method call.
+// Other identifiers are resolved in the file's scope, so functions of
+// the template used by the shim are generated as well.
+func (s *shim) expand(file *ast.File, recv ast.Expr, args []ast.Expr) (ast.Expr, error) {
+	if s.params != nil && len(s.params) != len(args)+1 {
+		return nil, fmt.Errorf("shim of %v has %v parameters, called with %v", s.method, len(s.params), len(args)+1)
+	}
+	expr, err := parser.ParseExpr(s.expr)
+	if err != nil {
+		return nil, err
+	}
+	uses := make(map[string]int)
+	ast.Inspect(expr, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			ast.Inspect(sel.X, func(n ast.Node) bool {
+				if id, ok := n.(*ast.Ident); ok {
+					uses[id.Name]++
+				}
+				return true
+			})
+			return false
+		}
+		if id, ok := n.(*ast.Ident); ok {
+			uses[id.Name]++
+		}
+		return true
+	})
+	values := make(map[string]ast.Expr, len(args)+1)
+	for i, e := range append([]ast.Expr{recv}, args...) {
+		param := s.param(i)
+		// A copy of a call or an index would be evaluated more than once.
+		if uses[param] > 1 && !isReference(e) {
+			return nil, fmt.Errorf("%v is used %v times by the shim of %v, so %v must be an identifier or a selector, use the func form",
+				param, uses[param], s.method, types.ExprString(e))
+		}
+		if !isPrimary(e) {
+			e = &ast.ParenExpr{X: e}
+		}
+		values[param] = e
+	}
+	expr = Apply(expr, nil, func(parent ast.Node, name string, index int, n ast.Node) bool {
+		id, ok := n.(*ast.Ident)
+		if !ok {
+			return true
+		}
+		if _, ok := parent.(*ast.SelectorExpr); ok && name == "Sel" {
+			return true
+		}
+		if value, ok := values[id.Name]; ok {
+			SetField(parent, name, index, value)
+			return true
+		}
+		id.Obj = file.Scope.Lookup(id.Name)
+		return true
+	}).(ast.Expr)
+	return expr, nil
+}
+
+// needsShim reports whether the concrete type of a generic type lacks a method,
+// e.g. because it's a builtin type.
+// Concrete types that can't be loaded are assumed to have the method.
+func (gctx *genericContext) needsShim(generic, method string) bool {
+	t, err := gctx.loader.lookup(gctx.genericTypes[generic])
+	if err != nil {
+		return false
+	}
+	var pkg *types.Package
+	if named, ok := t.(*types.Named); ok {
+		pkg = named.Obj().Pkg()
+	} else if ptr, ok := t.(*types.Pointer); ok {
+		if named, ok := ptr.Elem().(*types.Named); ok {
+			pkg = named.Obj().Pkg()
+		}
+	}
+	obj, _, _ := types.LookupFieldOrMethod(t, true, pkg, method)
+	_, ok := obj.(*types.Func)
+	return !ok
+}
+
+// funcName returns the name of the function declared by the func form
+// of the shim of a method of the generic type, e.g. lessType.
+func (s *shim) funcName(generic string) string {
+	return lowerFirst(s.method) + generic
+}
+
+// declare returns the function declared by the func form of the shim,
+// e.g. for Less(Type) bool of the interface Type:
+//
+//	func lessType(a Type, b Type) bool {
+//		return a < b
+//	}
+//
+// The function is positioned at the directive, and added to the file's scope.
+func (s *shim) declare(file *ast.File, spec *ast.TypeSpec) (*ast.FuncDecl, error) {
+	iface, ok := spec.Type.(*ast.InterfaceType)
+	if !ok {
+		return nil, fmt.Errorf("%v is not an interface, the signature of %v is unknown", spec.Name.Name, s.method)
+	}
+	var method *ast.FuncType
+	for _, field := range iface.Methods.List {
+		for _, name := range field.Names {
+			if name.Name == s.method {
+				method, _ = field.Type.(*ast.FuncType)
+			}
+		}
+	}
+	if method == nil {
+		return nil, fmt.Errorf("%v is not a method of %v", s.method, spec.Name.Name)
+	}
+
+	params := []*ast.Field{{
+		Names: []*ast.Ident{{Name: s.param(0)}},
+		Type:  &ast.Ident{Name: spec.Name.Name, Obj: file.Scope.Lookup(spec.Name.Name)},
+	}}
+	var args []ast.Expr
+	for _, field := range method.Params.List {
+		n := len(field.Names)
+		if n == 0 {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			name := s.param(len(args) + 1)
+			params = append(params, &ast.Field{
+				Names: []*ast.Ident{{Name: name}},
+				Type:  copyNode(field.Type).(ast.Expr),
+			})
+			args = append(args, &ast.Ident{Name: name})
+		}
+	}
+	expr, err := s.expand(file, &ast.Ident{Name: s.param(0)}, args)
+	if err != nil {
+		return nil, err
+	}
+	var stmt ast.Stmt = &ast.ExprStmt{X: expr}
+	var results *ast.FieldList
+	if method.Results != nil && len(method.Results.List) > 0 {
+		stmt = &ast.ReturnStmt{Results: []ast.Expr{expr}}
+		results = copyNode(method.Results).(*ast.FieldList)
+	}
+
+	name := s.funcName(spec.Name.Name)
+	decl := &ast.FuncDecl{
+		Name: &ast.Ident{Name: name},
+		Type: &ast.FuncType{
+			Func:    s.pos,
+			Params:  &ast.FieldList{List: params},
+			Results: results,
+		},
+		Body: &ast.BlockStmt{List: []ast.Stmt{stmt}},
+	}
+	obj := ast.NewObj(ast.Fun, name)
+	obj.Decl = decl
+	decl.Name.Obj = obj
+	if file.Scope.Insert(obj) != nil {
+		return nil, fmt.Errorf("shim function %v is already declared", name)
+	}
+	return decl, nil
+}
+
+// insertDecl inserts decl into the file's declarations by its position.
+func insertDecl(file *ast.File, decl ast.Decl) {
+	i := sort.Search(len(file.Decls), func(i int) bool {
+		return file.Decls[i].Pos() > decl.Pos()
+	})
+	file.Decls = append(file.Decls, nil)
+	copy(file.Decls[i+1:], file.Decls[i:])
+	file.Decls[i] = decl
+}
+
+// applyShims replaces calls of the generic types' methods with the
+// expression of their //rei:builtin shim if the concrete type lacks the method,
+// or with a call of the shim's function in the func form.
+func (gctx *genericContext) applyShims(file *ast.File) error {
+	specs := gctx.genericTypeSpecs()
+	shims := make(map[string]map[string]*shim)
+	for name, spec := range specs {
+		dirs := gctx.directives[spec]
+		if dirs == nil {
+			continue
+		}
+		for _, c := range dirs.shims {
+			_, args := splitDirective(c)
+			s, err := parseShim(args)
+			if err != nil {
+				return errors.Wrap(err, gctx.fset.Position(c.Pos()).String())
+			}
+			s.pos = c.Pos()
+			if !gctx.needsShim(name, s.method) {
+				continue
+			}
+			if shims[name] == nil {
+				shims[name] = make(map[string]*shim)
+			}
+			shims[name][s.method] = s
+		}
+	}
+	if len(shims) == 0 {
+		return nil
+	}
+
+	info := gctx.templateInfo()
+	// funcs are the functions declared by the func form shims that are called.
+	funcs := make(map[*shim]*ast.FuncDecl)
+	var err error
+	Apply(file, nil, func(parent ast.Node, name string, index int, n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok || err != nil {
+			return true
+		}
+		sel, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		selection, ok := info.Selections[sel]
+		if !ok || selection.Kind() != types.MethodVal {
+			return true
+		}
+		recv := selection.Recv()
+		if ptr, ok := recv.(*types.Pointer); ok {
+			recv = ptr.Elem()
+		}
+		generic := gctx.genericTypeName(recv)
+		s := shims[generic][sel.Sel.Name]
+		if s == nil {
+			return true
+		}
+		if s.function {
+			decl := funcs[s]
+			if decl == nil {
+				decl, err = s.declare(file, specs[generic])
+				if err != nil {
+					err = errors.Wrap(err, gctx.fset.Position(s.pos).String())
+					return true
+				}
+				funcs[s] = decl
+			}
+			SetField(parent, name, index, &ast.CallExpr{
+				Fun:      &ast.Ident{Name: decl.Name.Name, Obj: decl.Name.Obj},
+				Args:     append([]ast.Expr{sel.X}, call.Args...),
+				Ellipsis: call.Ellipsis,
+			})
+			return true
+		}
+		var expr ast.Expr
+		expr, err = s.expand(file, sel.X, call.Args)
+		if err != nil {
+			err = errors.Wrap(err, gctx.fset.Position(call.Pos()).String())
+			return true
+		}
+		if needsParens(parent, name, expr) {
+			expr = &ast.ParenExpr{X: expr}
+		}
+		SetField(parent, name, index, expr)
+		return true
+	})
+	for _, decl := range funcs {
+		insertDecl(file, decl)
+	}
+	return err
+}
@@ -83,3 +83,14 @@ func sortDecls(in map[token.Pos]ast.Decl) []ast.Decl {
 	}
 	return ret
 }
+
+func sortedPositions(in map[token.Pos]bool) []token.Pos {
+	ret := make([]token.Pos, 0, len(in))
+	for p := range in {
+		ret = append(ret, p)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i] < ret[j]
+	})
+	return ret
+}
@@ -0,0 +1,681 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// reiLibPath is the import path of the package with the template helpers.
+const reiLibPath = "github.com/nkovacs/rei/lib/rei"
+
+// blockDirectives are the directives that delimit blocks of code
+// that are only generated for specific concrete types:
+//
+//	//rei:if Type==string
+//	...
+//	//rei:else
+//	...
+//	//rei:end
+var blockDirectives = map[string]bool{
+	"if":   true,
+	"else": true,
+	"end":  true,
+}
+
+// templateInfo returns the type information of the template.
+// It must be called before the template is modified.
+func (gctx *genericContext) templateInfo() *types.Info {
+	if gctx.info == nil {
+		gctx.info = checkTemplate(gctx.fset, gctx.file)
+	}
+	return gctx.info
+}
+
+// genericTypeName returns the name of the generic type t,
+// or an empty string if t is not a generic type.
+func (gctx *genericContext) genericTypeName(t types.Type) string {
+	named, ok := t.(*types.Named)
+	if !ok {
+		return ""
+	}
+	if !gctx.isGeneric[named.Obj().Pos()] {
+		return ""
+	}
+	return named.Obj().Name()
+}
+
+// concreteExprString returns the string form of a type expression
+// with the generic types replaced by their concrete types.
+func (gctx *genericContext) concreteExprString(e ast.Expr) string {
+	switch e := e.(type) {
+	case *ast.Ident:
+		if e.Obj != nil {
+			if ts, ok := e.Obj.Decl.(*ast.TypeSpec); ok && gctx.isGeneric[ts.Pos()] {
+				return types.ExprString(gctx.renames[ts.Pos()])
+			}
+			return e.Name
+		}
+		// Expressions parsed from directives are not resolved.
+		if ts, ok := gctx.genericTypeSpecs()[e.Name]; ok {
+			return types.ExprString(gctx.renames[ts.Pos()])
+		}
+		return e.Name
+	case *ast.ParenExpr:
+		return gctx.concreteExprString(e.X)
+	case *ast.StarExpr:
+		return "*" + gctx.concreteExprString(e.X)
+	case *ast.ArrayType:
+		if e.Len == nil {
+			return "[]" + gctx.concreteExprString(e.Elt)
+		}
+		return "[" + types.ExprString(e.Len) + "]" + gctx.concreteExprString(e.Elt)
+	case *ast.MapType:
+		return "map[" + gctx.concreteExprString(e.Key) + "]" + gctx.concreteExprString(e.Value)
+	case *ast.ChanType:
+		switch e.Dir {
+		case ast.SEND:
+			return "chan<- " + gctx.concreteExprString(e.Value)
+		case ast.RECV:
+			return "<-chan " + gctx.concreteExprString(e.Value)
+		}
+		return "chan " + gctx.concreteExprString(e.Value)
+	}
+	return types.ExprString(e)
+}
+
+// reiLibName returns the name the template helper package is imported as,
+// or an empty string if the template does not import it.
+func reiLibName(file *ast.File) string {
+	for _, importSpec := range file.Imports {
+		path, err := strconv.Unquote(importSpec.Path.Value)
+		if err != nil || path != reiLibPath {
+			continue
+		}
+		if importSpec.Name != nil {
+			return importSpec.Name.Name
+		}
+		return "rei"
+	}
+	return ""
+}
+
+// evalIs evaluates a rei.Is[A, B]() call.
+func (gctx *genericContext) evalIs(libName string, n ast.Node) (value bool, ok bool) {
+	call, ok := n.(*ast.CallExpr)
+	if !ok || len(call.Args) != 0 {
+		return false, false
+	}
+	index, ok := call.Fun.(*ast.IndexListExpr)
+	if !ok || len(index.Indices) != 2 {
+		return false, false
+	}
+	sel, ok := index.X.(*ast.SelectorExpr)
+	if !ok || sel.Sel.Name != "Is" {
+		return false, false
+	}
+	if x, ok := sel.X.(*ast.Ident); !ok || x.Name != libName || x.Obj != nil {
+		return false, false
+	}
+	if gctx.mentionsUnbound(index.Indices[0]) || gctx.mentionsUnbound(index.Indices[1]) {
+		// Kept for the template produced by a partial instantiation.
+		return false, false
+	}
+	return gctx.concreteExprString(index.Indices[0]) == gctx.concreteExprString(index.Indices[1]), true
+}
+
+// mentionsUnbound reports whether an expression uses an unbound parameter.
+func (gctx *genericContext) mentionsUnbound(e ast.Expr) bool {
+	found := false
+	ast.Inspect(e, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok && gctx.unbound[id.Name] {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+// evalBool evaluates a boolean expression built from evaluated rei.Is calls, !, && and ||.
+func evalBool(evaluated map[*ast.Ident]bool, e ast.Expr) (value bool, ok bool) {
+	switch e := e.(type) {
+	case *ast.Ident:
+		if !evaluated[e] {
+			return false, false
+		}
+		switch e.Name {
+		case "true":
+			return true, true
+		case "false":
+			return false, true
+		}
+	case *ast.ParenExpr:
+		return evalBool(evaluated, e.X)
+	case *ast.UnaryExpr:
+		if e.Op != token.NOT {
+			return false, false
+		}
+		x, ok := evalBool(evaluated, e.X)
+		return !x, ok
+	case *ast.BinaryExpr:
+		x, xok := evalBool(evaluated, e.X)
+		y, yok := evalBool(evaluated, e.Y)
+		switch e.Op {
+		case token.LAND:
+			if (xok && !x) || (yok && !y) {
+				return false, true
+			}
+			return x && y, xok && yok
+		case token.LOR:
+			if (xok && x) || (yok && y) {
+				return true, true
+			}
+			return x || y, xok && yok
+		}
+	}
+	return false, false
+}
+
+// typeSwitchSubject returns the expression of a type switch,
+// without the conversion to an empty interface.
+func typeSwitchSubject(ts *ast.TypeSwitchStmt) (subject ast.Expr, assert *ast.TypeAssertExpr, bound *ast.Ident) {
+	switch a := ts.Assign.(type) {
+	case *ast.ExprStmt:
+		assert, _ = a.X.(*ast.TypeAssertExpr)
+	case *ast.AssignStmt:
+		if len(a.Lhs) == 1 && len(a.Rhs) == 1 {
+			assert, _ = a.Rhs[0].(*ast.TypeAssertExpr)
+			bound, _ = a.Lhs[0].(*ast.Ident)
+		}
+	}
+	if assert == nil {
+		return nil, nil, nil
+	}
+	subject = assert.X
+	if call, ok := subject.(*ast.CallExpr); ok && len(call.Args) == 1 {
+		switch fun := call.Fun.(type) {
+		case *ast.Ident:
+			if fun.Name == "any" && fun.Obj == nil {
+				subject = call.Args[0]
+			}
+		case *ast.InterfaceType:
+			if fun.Methods == nil || len(fun.Methods.List) == 0 {
+				subject = call.Args[0]
+			}
+		}
+	}
+	return subject, assert, bound
+}
+
+// usesIdent reports whether the name bound by a type switch is used in the statements.
+func usesIdent(stmts []ast.Stmt, name string) bool {
+	used := false
+	for _, stmt := range stmts {
+		ast.Inspect(stmt, func(n ast.Node) bool {
+			if id, ok := n.(*ast.Ident); ok && id.Name == name {
+				used = true
+			}
+			return !used
+		})
+	}
+	return used
+}
+
+// specializeTypeSwitch selects the clause of a type switch on a generic type
+// that matches the concrete type. It returns false if the switch's subject
+// is not a generic type. If no clause matches, stmts is nil.
+func (gctx *genericContext) specializeTypeSwitch(ts *ast.TypeSwitchStmt) (stmts []ast.Stmt, ok bool) {
+	subject, assert, bound := typeSwitchSubject(ts)
+	if subject == nil {
+		return nil, false
+	}
+	generic := gctx.genericTypeName(gctx.templateInfo().TypeOf(subject))
+	if generic == "" || gctx.isInterface(generic) {
+		// The dynamic type of an interface is only known at runtime.
+		return nil, false
+	}
+	concrete := gctx.concreteExprString(&ast.Ident{Name: generic})
+
+	// Like at runtime, the first clause with a matching type is selected.
+	var match, def *ast.CaseClause
+	var matchType ast.Expr
+	exact := false
+	for _, stmt := range ts.Body.List {
+		clause := stmt.(*ast.CaseClause)
+		if clause.List == nil {
+			def = clause
+			continue
+		}
+		for _, e := range clause.List {
+			if gctx.concreteExprString(e) == concrete {
+				match, matchType, exact = clause, e, true
+				break
+			}
+			if gctx.implements(generic, e) {
+				match, matchType = clause, e
+				break
+			}
+		}
+		if match != nil {
+			break
+		}
+	}
+
+	var body []ast.Stmt
+	var value ast.Expr = subject
+	if match == nil {
+		if def == nil {
+			return nil, true
+		}
+		match = def
+		value = assert.X
+	} else if !exact || len(match.List) > 1 {
+		// The bound name has the case's type only if it lists a single type.
+		if len(match.List) > 1 {
+			value = assert.X
+		} else {
+			value = &ast.CallExpr{
+				Fun:  &ast.ParenExpr{X: matchType},
+				Args: []ast.Expr{subject},
+			}
+		}
+	}
+	if bound != nil && usesIdent(match.Body, bound.Name) {
+		body = append(body, &ast.AssignStmt{
+			Lhs: []ast.Expr{&ast.Ident{Name: bound.Name}},
+			Tok: token.DEFINE,
+			Rhs: []ast.Expr{value},
+		})
+	}
+	body = append(body, match.Body...)
+	if ts.Init != nil {
+		body = append([]ast.Stmt{ts.Init}, body...)
+	}
+	if body == nil {
+		body = []ast.Stmt{}
+	}
+	return body, true
+}
+
+// isInterface reports whether the concrete type of a generic type is an interface.
+// Concrete types that can't be loaded are assumed not to be interfaces.
+func (gctx *genericContext) isInterface(generic string) bool {
+	t, err := gctx.loader.lookup(gctx.genericTypes[generic])
+	if err != nil {
+		return false
+	}
+	return types.IsInterface(t)
+}
+
+// implements reports whether the concrete type of a generic type
+// implements the interface type e of a type switch case.
+// Concrete types that can't be loaded don't implement anything.
+func (gctx *genericContext) implements(generic string, e ast.Expr) bool {
+	it := gctx.templateInfo().TypeOf(e)
+	if it == nil {
+		return false
+	}
+	iface, ok := it.Underlying().(*types.Interface)
+	if !ok {
+		return false
+	}
+	t, err := gctx.loader.lookup(gctx.genericTypes[generic])
+	if err != nil {
+		return false
+	}
+	return types.Implements(t, iface)
+}
+
+// specializeStmts replaces if statements with constant conditions
+// and type switches on generic types with the branch that applies
+// to the concrete types.
+func (gctx *genericContext) specializeStmts(file *ast.File, evaluated map[*ast.Ident]bool) {
+	// Blocks that replace a statement in a list, and can be merged into their parent.
+	inline := make(map[*ast.BlockStmt]bool)
+	removed := &ast.EmptyStmt{
+		Implicit: true,
+	}
+
+	replace := func(parent ast.Node, name string, index int, stmts []ast.Stmt) {
+		if stmts == nil {
+			if ifStmt, ok := parent.(*ast.IfStmt); ok && name == "Else" {
+				ifStmt.Else = nil
+				return
+			}
+			if index < 0 {
+				SetField(parent, name, index, &ast.BlockStmt{})
+				return
+			}
+			SetField(parent, name, index, removed)
+			return
+		}
+		block := &ast.BlockStmt{
+			List: stmts,
+		}
+		if index >= 0 {
+			inline[block] = true
+		}
+		SetField(parent, name, index, block)
+	}
+
+	Apply(file, nil, func(parent ast.Node, name string, index int, n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.IfStmt:
+			value, ok := evalBool(evaluated, n.Cond)
+			if !ok {
+				return true
+			}
+			var stmts []ast.Stmt
+			if value {
+				stmts = n.Body.List
+			} else if n.Else != nil {
+				if block, ok := n.Else.(*ast.BlockStmt); ok {
+					stmts = block.List
+				} else {
+					stmts = []ast.Stmt{n.Else}
+				}
+			}
+			if n.Init != nil {
+				stmts = append([]ast.Stmt{n.Init}, stmts...)
+			}
+			if stmts == nil && (value || n.Else != nil) {
+				stmts = []ast.Stmt{}
+			}
+			replace(parent, name, index, stmts)
+		case *ast.TypeSwitchStmt:
+			if stmts, ok := gctx.specializeTypeSwitch(n); ok {
+				replace(parent, name, index, stmts)
+			}
+		}
+		return true
+	})
+
+	// Remove the removed statements, and merge blocks that don't declare anything.
+	// The statements following a branch that ends in a return are unreachable,
+	// they are removed up to the next label.
+	filter := func(list []ast.Stmt) []ast.Stmt {
+		ret := list[:0]
+		unreachable := false
+		for _, stmt := range list {
+			if _, ok := stmt.(*ast.LabeledStmt); ok {
+				unreachable = false
+			}
+			if stmt == removed || unreachable {
+				continue
+			}
+			block, ok := stmt.(*ast.BlockStmt)
+			if ok && inline[block] {
+				unreachable = terminates(block.List)
+				if !declares(block.List) {
+					ret = append(ret, block.List...)
+					continue
+				}
+			}
+			ret = append(ret, stmt)
+		}
+		return ret
+	}
+	ast.Inspect(file, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.BlockStmt:
+			n.List = filter(n.List)
+		case *ast.CaseClause:
+			n.Body = filter(n.Body)
+		case *ast.CommClause:
+			n.Body = filter(n.Body)
+		}
+		return true
+	})
+}
+
+// terminates reports whether the statements end in a return, branch or panic,
+// so the statements following them are never executed.
+func terminates(stmts []ast.Stmt) bool {
+	if len(stmts) == 0 {
+		return false
+	}
+	switch s := stmts[len(stmts)-1].(type) {
+	case *ast.ReturnStmt:
+		return true
+	case *ast.BranchStmt:
+		return s.Tok != token.FALLTHROUGH
+	case *ast.BlockStmt:
+		return terminates(s.List)
+	case *ast.ExprStmt:
+		call, ok := s.X.(*ast.CallExpr)
+		if !ok {
+			return false
+		}
+		id, ok := call.Fun.(*ast.Ident)
+		return ok && id.Name == "panic" && id.Obj == nil
+	}
+	return false
+}
+
+// declares reports whether the statements declare names in their block.
+func declares(stmts []ast.Stmt) bool {
+	for _, stmt := range stmts {
+		switch s := stmt.(type) {
+		case *ast.DeclStmt:
+			return true
+		case *ast.AssignStmt:
+			if s.Tok == token.DEFINE {
+				return true
+			}
+		case *ast.LabeledStmt:
+			return true
+		}
+	}
+	return false
+}
+
+// prunedRange is a range of the source file that is not generated.
+type prunedRange struct {
+	from, to token.Pos
+}
+
+// blockDirectiveRanges returns the ranges of the source file
+// removed by //rei:if blocks.
+func (gctx *genericContext) blockDirectiveRanges(file *ast.File) ([]prunedRange, error) {
+	type openBlock struct {
+		c         *ast.Comment
+		value     bool
+		elsePos   token.Pos
+		hasParent bool
+	}
+	var comments []*ast.Comment
+	for _, cg := range file.Comments {
+		for _, c := range cg.List {
+			if !isDirective(c) {
+				continue
+			}
+			if name, _ := splitDirective(c); blockDirectives[name] {
+				comments = append(comments, c)
+			}
+		}
+	}
+	sort.Slice(comments, func(i, j int) bool {
+		return comments[i].Pos() < comments[j].Pos()
+	})
+
+	var ranges []prunedRange
+	var stack []*openBlock
+	for _, c := range comments {
+		name, args := splitDirective(c)
+		where := gctx.fset.Position(c.Pos()).String()
+		switch name {
+		case "if":
+			value, err := gctx.evalTypeCondition(args)
+			if err != nil {
+				return nil, errors.Wrap(err, where)
+			}
+			stack = append(stack, &openBlock{
+				c:     c,
+				value: value,
+			})
+		case "else":
+			if len(stack) == 0 || stack[len(stack)-1].elsePos.IsValid() {
+				return nil, fmt.Errorf("%v: %velse without %vif", where, directivePrefix, directivePrefix)
+			}
+			stack[len(stack)-1].elsePos = c.Pos()
+		case "end":
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("%v: %vend without %vif", where, directivePrefix, directivePrefix)
+			}
+			block := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			switch {
+			case block.value && block.elsePos.IsValid():
+				ranges = append(ranges, prunedRange{block.elsePos, c.End()})
+			case !block.value && block.elsePos.IsValid():
+				ranges = append(ranges, prunedRange{block.c.Pos(), block.elsePos})
+			case !block.value:
+				ranges = append(ranges, prunedRange{block.c.Pos(), c.End()})
+			}
+		}
+	}
+	if len(stack) > 0 {
+		return nil, fmt.Errorf("%v: %vif without %vend", gctx.fset.Position(stack[0].c.Pos()), directivePrefix, directivePrefix)
+	}
+	return ranges, nil
+}
+
+// evalTypeCondition evaluates the condition of a //rei:if directive,
+// e.g. Type==string or Type!=[]byte.
+func (gctx *genericContext) evalTypeCondition(cond string) (bool, error) {
+	e, err := parser.ParseExpr(cond)
+	if err != nil {
+		return false, errors.Wrap(err, fmt.Sprintf("invalid condition %v", cond))
+	}
+	be, ok := e.(*ast.BinaryExpr)
+	if !ok || (be.Op != token.EQL && be.Op != token.NEQ) {
+		return false, fmt.Errorf("invalid condition %v, expected Type==ConcreteType or Type!=ConcreteType", cond)
+	}
+	if gctx.mentionsUnbound(be) {
+		return false, fmt.Errorf("condition %v uses an unbound parameter, it can't be kept in a partial instantiation", cond)
+	}
+	equal := gctx.concreteExprString(be.X) == gctx.concreteExprString(be.Y)
+	return equal == (be.Op == token.EQL), nil
+}
+
+// pruneBlockDirectives removes the declarations and statements
+// in //rei:if blocks that don't apply to the concrete types.
+func (gctx *genericContext) pruneBlockDirectives(file *ast.File) error {
+	ranges, err := gctx.blockDirectiveRanges(file)
+	if err != nil {
+		return err
+	}
+	if len(ranges) == 0 {
+		return nil
+	}
+	pruned := func(n ast.Node) bool {
+		for _, r := range ranges {
+			if n.Pos() >= r.from && n.Pos() < r.to {
+				return true
+			}
+		}
+		return false
+	}
+
+	decls := file.Decls[:0]
+	for _, decl := range file.Decls {
+		if !pruned(decl) {
+			decls = append(decls, decl)
+		}
+	}
+	file.Decls = decls
+
+	filter := func(list []ast.Stmt) []ast.Stmt {
+		ret := list[:0]
+		for _, stmt := range list {
+			if !pruned(stmt) {
+				ret = append(ret, stmt)
+			}
+		}
+		return ret
+	}
+	ast.Inspect(file, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.BlockStmt:
+			n.List = filter(n.List)
+		case *ast.CaseClause:
+			n.Body = filter(n.Body)
+		case *ast.CommClause:
+			n.Body = filter(n.Body)
+		}
+		return true
+	})
+	return nil
+}
+
+// needsSpecialization reports whether the template has code that specialize
+// may remove: if it imports the rei package, has //rei:if blocks,
+// or has type switches on a value converted to an empty interface,
+// which is how a generic type is switched on.
+func needsSpecialization(file *ast.File) bool {
+	if reiLibName(file) != "" {
+		return true
+	}
+	for _, cg := range file.Comments {
+		for _, c := range cg.List {
+			if !isDirective(c) {
+				continue
+			}
+			if name, _ := splitDirective(c); blockDirectives[name] {
+				return true
+			}
+		}
+	}
+	found := false
+	ast.Inspect(file, func(n ast.Node) bool {
+		if found {
+			return false
+		}
+		if ts, ok := n.(*ast.TypeSwitchStmt); ok {
+			if subject, assert, _ := typeSwitchSubject(ts); subject != nil && subject != assert.X {
+				found = true
+			}
+		}
+		return true
+	})
+	return found
+}
+
+// specialize removes the code that does not apply to the concrete types:
+// //rei:if blocks, if statements with rei.Is conditions,
+// and type switches on generic types.
+func (gctx *genericContext) specialize(file *ast.File) error {
+	if !needsSpecialization(file) {
+		// Nothing to specialize, the template is type checked lazily if it's needed later.
+		return nil
+	}
+	// Type check the template before it's modified.
+	gctx.templateInfo()
+
+	if err := gctx.pruneBlockDirectives(file); err != nil {
+		return err
+	}
+
+	evaluated := make(map[*ast.Ident]bool)
+	if libName := reiLibName(file); libName != "" {
+		Apply(file, nil, func(parent ast.Node, name string, index int, n ast.Node) bool {
+			if value, ok := gctx.evalIs(libName, n); ok {
+				id := &ast.Ident{
+					Name: strconv.FormatBool(value),
+				}
+				evaluated[id] = true
+				SetField(parent, name, index, id)
+			}
+			return true
+		})
+	}
+
+	gctx.specializeStmts(file, evaluated)
+	return nil
+}
@@ -0,0 +1,848 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"go/types"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/imports"
+
+	"github.com/pkg/errors"
+)
+
+// numericTypes are the types of the numeric constraint as a type parameter constraint.
+const numericTypes = "~int | ~int8 | ~int16 | ~int32 | ~int64 | ~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr | ~float32 | ~float64"
+
+// inferredConstraint is the constraint of a type parameter converted from a generic type,
+// inferred from the generic type's uses and declared constraints.
+type inferredConstraint struct {
+	comparable bool
+	ordered    bool
+	numeric    bool
+	// embeds are the interfaces of implements constraints.
+	embeds []ast.Expr
+	// methods are the methods called on the generic type, by name.
+	methods map[string]*types.Func
+	// fields are the methods and embedded interfaces of a generic type that is an interface.
+	fields []*ast.Field
+}
+
+// genericsConverter converts a rei template into Go code with type parameters.
+// The generic types become type parameters of the declarations that depend on them.
+type genericsConverter struct {
+	fset *token.FileSet
+	file *ast.File
+	info *types.Info
+
+	// params are the generic types, in the order of the type parameter lists.
+	params       []string
+	placeholders map[types.Object]string
+	specs        map[string]*ast.TypeSpec
+
+	// decls are the declarations of the template's top-level objects,
+	// deps the generic types they depend on.
+	decls map[types.Object]ast.Node
+	deps  map[types.Object]map[string]bool
+
+	constraints map[string]*inferredConstraint
+	// interfaces are the constraint interfaces by the name of the placeholder
+	// they're printed in place of. They're printed separately,
+	// since the template has no positions for their lines.
+	interfaces map[string]*ast.InterfaceType
+}
+
+// placeholder returns the generic type t or *t is, or an empty string.
+func (c *genericsConverter) placeholder(t types.Type) string {
+	if ptr, ok := t.(*types.Pointer); ok {
+		t = ptr.Elem()
+	}
+	named, ok := t.(*types.Named)
+	if !ok {
+		return ""
+	}
+	return c.placeholders[named.Obj()]
+}
+
+// isPlaceholderMethod reports whether a function declaration is a method of a generic type.
+func (c *genericsConverter) isPlaceholderMethod(d *ast.FuncDecl) bool {
+	if d.Recv == nil || len(d.Recv.List) == 0 {
+		return false
+	}
+	id := receiverIdent(d.Recv.List[0])
+	return id != nil && c.placeholders[c.info.Uses[id]] != ""
+}
+
+// collectDecls finds the top-level declarations and the generic types they depend on.
+// Methods are part of their receiver type's declaration.
+// It returns an error if a variable or a constant depends on a generic type.
+func (c *genericsConverter) collectDecls() error {
+	refs := make(map[types.Object][]ast.Node)
+	for _, decl := range c.file.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if c.isPlaceholderMethod(d) {
+				continue
+			}
+			if d.Recv != nil {
+				if id := receiverIdent(d.Recv.List[0]); id != nil {
+					obj := c.info.Uses[id]
+					refs[obj] = append(refs[obj], d)
+				}
+				continue
+			}
+			obj := c.info.Defs[d.Name]
+			c.decls[obj] = d
+			refs[obj] = append(refs[obj], d)
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				switch s := spec.(type) {
+				case *ast.TypeSpec:
+					obj := c.info.Defs[s.Name]
+					if c.placeholders[obj] != "" {
+						continue
+					}
+					c.decls[obj] = s
+					refs[obj] = append(refs[obj], s)
+				case *ast.ValueSpec:
+					for _, name := range s.Names {
+						if obj := c.info.Defs[name]; obj != nil {
+							c.decls[obj] = s
+							refs[obj] = append(refs[obj], s)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	// uses are the top-level objects each declaration refers to.
+	uses := make(map[types.Object]map[types.Object]bool)
+	for obj, nodes := range refs {
+		c.deps[obj] = make(map[string]bool)
+		uses[obj] = make(map[types.Object]bool)
+		for _, n := range nodes {
+			ast.Inspect(n, func(n ast.Node) bool {
+				id, ok := n.(*ast.Ident)
+				if !ok {
+					return true
+				}
+				used := c.info.Uses[id]
+				if name := c.placeholders[used]; name != "" {
+					c.deps[obj][name] = true
+				} else if _, ok := c.decls[used]; ok && used != obj {
+					uses[obj][used] = true
+				}
+				return true
+			})
+		}
+	}
+	for changed := true; changed; {
+		changed = false
+		for obj, used := range uses {
+			for u := range used {
+				for name := range c.deps[u] {
+					if !c.deps[obj][name] {
+						c.deps[obj][name] = true
+						changed = true
+					}
+				}
+			}
+		}
+	}
+
+	for obj, decl := range c.decls {
+		if _, ok := decl.(*ast.ValueSpec); ok && len(c.deps[obj]) > 0 {
+			return fmt.Errorf("%v: %v depends on %v, Go has no generic variables or constants",
+				c.fset.Position(obj.Pos()), obj.Name(), strings.Join(c.typeParams(obj), ", "))
+		}
+	}
+	return nil
+}
+
+// typeParams returns the type parameters of a declaration in order.
+func (c *genericsConverter) typeParams(obj types.Object) []string {
+	var names []string
+	for _, name := range c.params {
+		if c.deps[obj][name] {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// inferConstraints infers the constraints of the generic types from their uses
+// in the declarations that are converted, and from their declared constraints.
+func (c *genericsConverter) inferConstraints(params []*Param) error {
+	for _, name := range c.params {
+		c.constraints[name] = &inferredConstraint{
+			methods: make(map[string]*types.Func),
+		}
+	}
+	declared := make(map[string][]string)
+	for _, p := range params {
+		if p.Constraint != "" {
+			declared[p.Name] = append(declared[p.Name], p.Constraint)
+		}
+	}
+	for _, decl := range c.file.Decls {
+		d, ok := decl.(*ast.GenDecl)
+		if !ok {
+			continue
+		}
+		for _, spec := range d.Specs {
+			ts, ok := spec.(*ast.TypeSpec)
+			if !ok || c.placeholders[c.info.Defs[ts.Name]] == "" {
+				continue
+			}
+			if iface, ok := ts.Type.(*ast.InterfaceType); ok {
+				c.constraints[ts.Name.Name].fields = iface.Methods.List
+			}
+			dirs := &directives{}
+			if err := parseDirectives(dirs, d.Doc, ts.Doc); err != nil {
+				return errors.Wrap(err, c.fset.Position(ts.Pos()).String())
+			}
+			declared[ts.Name.Name] = append(declared[ts.Name.Name], dirs.constraints...)
+		}
+	}
+	for _, name := range c.params {
+		for _, text := range declared[name] {
+			con, err := parseConstraint(text)
+			if err != nil {
+				return errors.Wrap(err, fmt.Sprintf("parameter %v", name))
+			}
+			ic := c.constraints[name]
+			switch con.kind {
+			case "comparable":
+				ic.comparable = true
+			case "ordered":
+				ic.ordered = true
+			case "numeric":
+				ic.numeric = true
+			case "implements":
+				ic.embeds = append(ic.embeds, mappedTypeExpr(con.typ))
+			default:
+				return fmt.Errorf("constraint %q of %v cannot be converted to a type parameter constraint", text, name)
+			}
+		}
+	}
+
+	var err error
+	for _, decl := range c.file.Decls {
+		if d, ok := decl.(*ast.FuncDecl); ok && c.isPlaceholderMethod(d) {
+			continue
+		}
+		ast.Inspect(decl, func(n ast.Node) bool {
+			if err != nil {
+				return false
+			}
+			switch n := n.(type) {
+			case *ast.TypeSpec:
+				if c.placeholders[c.info.Defs[n.Name]] != "" {
+					return false
+				}
+			case *ast.SelectorExpr:
+				selection, ok := c.info.Selections[n]
+				if !ok {
+					return true
+				}
+				name := c.placeholder(selection.Recv())
+				if name == "" {
+					return true
+				}
+				fn, ok := selection.Obj().(*types.Func)
+				if !ok {
+					err = fmt.Errorf("%v: field %v of %v cannot be used through a type parameter",
+						c.fset.Position(n.Pos()), n.Sel.Name, name)
+					return false
+				}
+				// The method set of a pointer to a type parameter is empty,
+				// and a pointer receiver method is not in the type's method set.
+				_, ptrRecv := fn.Type().(*types.Signature).Recv().Type().(*types.Pointer)
+				if !isNamedPlaceholder(selection.Recv()) || ptrRecv {
+					err = fmt.Errorf("%v: method %v of %v is called through a pointer, it cannot be converted to a type parameter",
+						c.fset.Position(n.Pos()), n.Sel.Name, name)
+					return false
+				}
+				c.constraints[name].methods[fn.Name()] = fn
+			case *ast.CompositeLit:
+				if name := c.placeholder(c.info.TypeOf(n)); name != "" {
+					err = fmt.Errorf("%v: composite literal of %v cannot be converted to a type parameter",
+						c.fset.Position(n.Pos()), name)
+					return false
+				}
+			case *ast.BinaryExpr:
+				x, y := n.X, n.Y
+				if c.info.Types[x].IsNil() {
+					x, y = y, x
+				}
+				name := c.placeholder(c.info.TypeOf(x))
+				if name == "" || !isNamedPlaceholder(c.info.TypeOf(x)) {
+					return true
+				}
+				if c.info.Types[y].IsNil() {
+					err = fmt.Errorf("%v: comparison of %v with nil cannot be converted to a type parameter",
+						c.fset.Position(n.Pos()), name)
+					return false
+				}
+				c.addOperator(name, n.Op)
+			case *ast.AssignStmt:
+				if n.Tok == token.ASSIGN || n.Tok == token.DEFINE || len(n.Lhs) != 1 {
+					return true
+				}
+				if name := c.placeholder(c.info.TypeOf(n.Lhs[0])); name != "" && isNamedPlaceholder(c.info.TypeOf(n.Lhs[0])) {
+					// x += y is x = x + y.
+					c.addOperator(name, n.Tok-(token.ADD_ASSIGN-token.ADD))
+				}
+			case *ast.UnaryExpr:
+				if n.Op == token.SUB {
+					if name := c.placeholder(c.info.TypeOf(n.X)); name != "" && isNamedPlaceholder(c.info.TypeOf(n.X)) {
+						c.constraints[name].numeric = true
+					}
+				}
+			case *ast.IncDecStmt:
+				if name := c.placeholder(c.info.TypeOf(n.X)); name != "" && isNamedPlaceholder(c.info.TypeOf(n.X)) {
+					c.constraints[name].numeric = true
+				}
+			case *ast.MapType:
+				if name := c.placeholder(c.info.TypeOf(n.Key)); name != "" && isNamedPlaceholder(c.info.TypeOf(n.Key)) {
+					c.constraints[name].comparable = true
+				}
+			}
+			return true
+		})
+	}
+	return err
+}
+
+// isNamedPlaceholder reports whether t is not a pointer,
+// since operators on pointers to generic types don't constrain them.
+func isNamedPlaceholder(t types.Type) bool {
+	_, ok := t.(*types.Named)
+	return ok
+}
+
+// addOperator adds the constraint required by an operator on the generic type.
+func (c *genericsConverter) addOperator(name string, op token.Token) {
+	ic := c.constraints[name]
+	switch op {
+	case token.EQL, token.NEQ:
+		ic.comparable = true
+	case token.LSS, token.GTR, token.LEQ, token.GEQ, token.ADD:
+		ic.ordered = true
+	case token.SUB, token.MUL, token.QUO, token.REM:
+		ic.numeric = true
+	}
+}
+
+// constraintDecl returns the type parameter constraint of a generic type,
+// and the declaration of the constraint interface if it needs one,
+// e.g. if the generic type's methods are called.
+func (c *genericsConverter) constraintDecl(name string) (ast.Expr, *ast.TypeSpec, error) {
+	ic := c.constraints[name]
+	var elems []ast.Expr
+	switch {
+	case ic.numeric:
+		expr, err := parser.ParseExpr("interface{" + numericTypes + "}")
+		if err != nil {
+			return nil, nil, err
+		}
+		clearPositions(expr)
+		elems = append(elems, expr.(*ast.InterfaceType).Methods.List[0].Type)
+	case ic.ordered:
+		elems = append(elems, &ast.SelectorExpr{X: &ast.Ident{Name: "cmp"}, Sel: &ast.Ident{Name: "Ordered"}})
+	case ic.comparable:
+		elems = append(elems, &ast.Ident{Name: "comparable"})
+	}
+	elems = append(elems, ic.embeds...)
+	if len(ic.methods) == 0 && len(ic.fields) == 0 && !ic.numeric {
+		switch len(elems) {
+		case 0:
+			return &ast.Ident{Name: "any"}, nil, nil
+		case 1:
+			return elems[0], nil, nil
+		}
+	}
+
+	iface := &ast.InterfaceType{Methods: &ast.FieldList{}}
+	for _, elem := range elems {
+		iface.Methods.List = append(iface.Methods.List, &ast.Field{Type: elem})
+	}
+	// The methods' signatures can refer to the generic types,
+	// which become type parameters of the constraint.
+	refs := make(map[string]bool)
+	addRefs := func(n ast.Node) {
+		ast.Inspect(n, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.SelectorExpr:
+				// Types of other packages.
+				return false
+			case *ast.Ident:
+				if c.specs[n.Name] != nil {
+					refs[n.Name] = true
+				}
+			}
+			return true
+		})
+	}
+	declared := make(map[string]bool)
+	for _, field := range ic.fields {
+		field = copyNode(field).(*ast.Field)
+		clearPositions(field)
+		addRefs(field)
+		for _, name := range field.Names {
+			declared[name.Name] = true
+		}
+		iface.Methods.List = append(iface.Methods.List, field)
+	}
+	methods := make([]string, 0, len(ic.methods))
+	for method := range ic.methods {
+		if !declared[method] {
+			methods = append(methods, method)
+		}
+	}
+	sort.Strings(methods)
+	qualifier := func(pkg *types.Package) string {
+		if pkg == c.info.Defs[c.specs[name].Name].Pkg() {
+			return ""
+		}
+		return pkg.Name()
+	}
+	for _, method := range methods {
+		sig := ic.methods[method].Type().(*types.Signature)
+		expr, err := parser.ParseExpr(types.TypeString(types.NewSignatureType(nil, nil, nil, sig.Params(), sig.Results(), sig.Variadic()), qualifier))
+		if err != nil {
+			return nil, nil, errors.Wrap(err, fmt.Sprintf("method %v of %v", method, name))
+		}
+		clearPositions(expr)
+		addRefs(expr)
+		iface.Methods.List = append(iface.Methods.List, &ast.Field{
+			Names: []*ast.Ident{{Name: method}},
+			Type:  expr,
+		})
+	}
+
+	constraintName := name + "Constraint"
+	spec := &ast.TypeSpec{
+		Name: &ast.Ident{Name: constraintName},
+		Type: iface,
+	}
+	var constraint ast.Expr = &ast.Ident{Name: constraintName}
+	var args []ast.Expr
+	for _, param := range c.params {
+		if !refs[param] {
+			continue
+		}
+		if spec.TypeParams == nil {
+			spec.TypeParams = &ast.FieldList{}
+		}
+		spec.TypeParams.List = append(spec.TypeParams.List, &ast.Field{
+			Names: []*ast.Ident{{Name: param}},
+			Type:  &ast.Ident{Name: "any"},
+		})
+		args = append(args, &ast.Ident{Name: param})
+	}
+	if len(args) > 0 {
+		constraint = indexExpr(&ast.Ident{Name: constraintName}, args)
+	}
+	return constraint, spec, nil
+}
+
+// placeNode sets the positions of a new node and its children to pos,
+// so that the printer keeps it on one line with the original node at pos.
+func placeNode(n ast.Node, pos token.Pos) {
+	posType := reflect.TypeOf(token.NoPos)
+	ast.Inspect(n, func(n ast.Node) bool {
+		if n == nil {
+			return false
+		}
+		v := reflect.ValueOf(n).Elem()
+		for i := 0; i < v.NumField(); i++ {
+			if v.Field(i).Type() == posType {
+				v.Field(i).Set(reflect.ValueOf(pos))
+			}
+		}
+		return true
+	})
+}
+
+// indexExpr returns the instantiation of x with the type arguments.
+func indexExpr(x ast.Expr, args []ast.Expr) ast.Expr {
+	if len(args) == 1 {
+		return &ast.IndexExpr{X: x, Lbrack: x.End(), Index: args[0], Rbrack: x.End()}
+	}
+	return &ast.IndexListExpr{X: x, Lbrack: x.End(), Indices: args, Rbrack: x.End()}
+}
+
+// paramIdents returns the type arguments of a reference to a declaration
+// with the type parameters, positioned at pos.
+func paramIdents(params []string, pos token.Pos) []ast.Expr {
+	args := make([]ast.Expr, len(params))
+	for i, param := range params {
+		args[i] = &ast.Ident{NamePos: pos, Name: param}
+	}
+	return args
+}
+
+// inferable reports whether the type arguments of a call of a generic function
+// can be inferred from its arguments. Variadic parameters don't count,
+// since the call can omit them.
+func (c *genericsConverter) inferable(d *ast.FuncDecl) bool {
+	inParams := make(map[string]bool)
+	params := d.Type.Params.List
+	if len(params) > 0 {
+		if _, ok := params[len(params)-1].Type.(*ast.Ellipsis); ok {
+			params = params[:len(params)-1]
+		}
+	}
+	ast.Inspect(&ast.FieldList{List: params}, func(n ast.Node) bool {
+		id, ok := n.(*ast.Ident)
+		if !ok {
+			return true
+		}
+		obj := c.info.Uses[id]
+		if name := c.placeholders[obj]; name != "" {
+			inParams[name] = true
+		} else if _, ok := c.decls[obj]; ok {
+			for name := range c.deps[obj] {
+				inParams[name] = true
+			}
+		}
+		return true
+	})
+	for name := range c.deps[c.info.Defs[d.Name]] {
+		if !inParams[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// convert rewrites the template: the generic types are replaced by their constraints,
+// and the declarations depending on them get type parameters.
+func (c *genericsConverter) convert() error {
+	constraints := make(map[string]ast.Expr)
+	constraintSpecs := make(map[string]*ast.TypeSpec)
+	for _, name := range c.params {
+		constraint, spec, err := c.constraintDecl(name)
+		if err != nil {
+			return err
+		}
+		constraints[name] = constraint
+		constraintSpecs[name] = spec
+	}
+	typeParamList := func(obj types.Object, pos token.Pos) *ast.FieldList {
+		params := c.typeParams(obj)
+		if len(params) == 0 {
+			return nil
+		}
+		list := &ast.FieldList{}
+		for _, param := range params {
+			list.List = append(list.List, &ast.Field{
+				Names: []*ast.Ident{{Name: param}},
+				Type:  copyNode(constraints[param]).(ast.Expr),
+			})
+		}
+		placeNode(list, pos)
+		return list
+	}
+
+	removed := make(map[ast.Node]bool)
+	for _, decl := range c.file.Decls {
+		if d, ok := decl.(*ast.FuncDecl); ok && c.isPlaceholderMethod(d) {
+			removed[d] = true
+		}
+	}
+
+	// References to the converted declarations are instantiated with the type parameters.
+	calls := make(map[*ast.Ident]bool)
+	ast.Inspect(c.file, func(n ast.Node) bool {
+		if call, ok := n.(*ast.CallExpr); ok {
+			if id, ok := call.Fun.(*ast.Ident); ok {
+				calls[id] = true
+			}
+		}
+		return true
+	})
+	Apply(c.file, func(parent ast.Node, name string, index int, n ast.Node) bool {
+		id, ok := n.(*ast.Ident)
+		if !ok {
+			return true
+		}
+		obj := c.info.Uses[id]
+		params := c.typeParams(obj)
+		if len(params) == 0 {
+			return true
+		}
+		if d, ok := c.decls[obj].(*ast.FuncDecl); ok && calls[id] && c.inferable(d) {
+			return true
+		}
+		SetField(parent, name, index, indexExpr(id, paramIdents(params, id.End())))
+		return true
+	}, nil)
+
+	var decls []ast.Decl
+	for _, decl := range c.file.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if removed[d] {
+				continue
+			}
+			if d.Recv == nil {
+				d.Type.TypeParams = typeParamList(c.info.Defs[d.Name], d.Name.End())
+			}
+		case *ast.GenDecl:
+			var specs []ast.Spec
+			for _, spec := range d.Specs {
+				ts, ok := spec.(*ast.TypeSpec)
+				if !ok {
+					specs = append(specs, spec)
+					continue
+				}
+				obj := c.info.Defs[ts.Name]
+				if name := c.placeholders[obj]; name != "" {
+					cs := constraintSpecs[name]
+					if cs == nil {
+						removed[ts] = true
+						continue
+					}
+					removed[ts.Type] = true
+					cs.Name.NamePos = ts.Name.NamePos
+					placeholder := "reiConstraint" + name
+					c.interfaces[placeholder] = cs.Type.(*ast.InterfaceType)
+					cs.Type = &ast.Ident{NamePos: ts.Type.Pos(), Name: placeholder}
+					c.constraintDoc(d, ts, cs, name)
+					specs = append(specs, cs)
+					continue
+				}
+				ts.TypeParams = typeParamList(obj, ts.Name.End())
+				specs = append(specs, ts)
+			}
+			if len(specs) == 0 {
+				removed[d] = true
+				continue
+			}
+			d.Specs = specs
+		}
+		decls = append(decls, decl)
+	}
+	c.file.Decls = decls
+	c.removeComments(removed)
+	return nil
+}
+
+// constraintDoc replaces the doc comment of a generic type
+// with the doc comment of the constraint that replaces it.
+func (c *genericsConverter) constraintDoc(d *ast.GenDecl, ts, cs *ast.TypeSpec, name string) {
+	text := fmt.Sprintf("// %v is the constraint of %v, inferred from its uses.", cs.Name.Name, name)
+	doc := ts.Doc
+	if doc == nil && !d.Lparen.IsValid() {
+		doc = d.Doc
+	}
+	if doc == nil {
+		doc = &ast.CommentGroup{}
+		c.file.Comments = append(c.file.Comments, doc)
+	}
+	slash := d.Pos() - 1
+	if d.Lparen.IsValid() {
+		slash = ts.Pos() - 1
+		cs.Doc = doc
+	} else {
+		d.Doc = doc
+	}
+	if len(doc.List) > 0 {
+		slash = doc.List[len(doc.List)-1].Slash
+	}
+	doc.List = []*ast.Comment{{Slash: slash, Text: text}}
+}
+
+// removeComments removes the rei directives, and the comments of removed declarations.
+func (c *genericsConverter) removeComments(removed map[ast.Node]bool) {
+	var comments []*ast.CommentGroup
+	for _, cg := range c.file.Comments {
+		inRemoved := false
+		for n := range removed {
+			if cg.Pos() >= n.Pos() && cg.End() <= n.End() {
+				inRemoved = true
+			}
+			if d, ok := n.(*ast.FuncDecl); ok && d.Doc == cg {
+				inRemoved = true
+			}
+			if d, ok := n.(*ast.GenDecl); ok && d.Doc == cg {
+				inRemoved = true
+			}
+			if ts, ok := n.(*ast.TypeSpec); ok && ts.Doc == cg {
+				inRemoved = true
+			}
+		}
+		if inRemoved {
+			continue
+		}
+		var list []*ast.Comment
+		for _, comment := range cg.List {
+			if !isDirective(comment) {
+				list = append(list, comment)
+			}
+		}
+		if len(list) == 0 {
+			continue
+		}
+		cg.List = list
+		comments = append(comments, cg)
+	}
+	sort.Slice(comments, func(i, j int) bool {
+		return comments[i].Pos() < comments[j].Pos()
+	})
+	c.file.Comments = comments
+	for _, decl := range c.file.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if d.Doc != nil && len(d.Doc.List) == 0 {
+				d.Doc = nil
+			}
+		case *ast.GenDecl:
+			if d.Doc != nil && len(d.Doc.List) == 0 {
+				d.Doc = nil
+			}
+		}
+	}
+}
+
+// toGenerics converts a rei template into Go code with type parameters.
+// The generic types are the template's declared parameters that are types,
+// or Type if it doesn't declare its parameters, unless they're given in params.
+func toGenerics(in io.Reader, inFilename string, params []string, out io.Writer, outFilename string) error {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, inFilename, in, parser.ParseComments)
+	if err != nil {
+		return errors.Wrap(err, "parsing file failed")
+	}
+	declared, err := parseParams(fset, file)
+	if err != nil {
+		return errors.Wrap(err, "parsing parameters failed")
+	}
+	c := &genericsConverter{
+		fset:         fset,
+		file:         file,
+		info:         checkTemplate(fset, file),
+		placeholders: make(map[types.Object]string),
+		specs:        make(map[string]*ast.TypeSpec),
+		decls:        make(map[types.Object]ast.Node),
+		deps:         make(map[types.Object]map[string]bool),
+		constraints:  make(map[string]*inferredConstraint),
+		interfaces:   make(map[string]*ast.InterfaceType),
+	}
+	for _, decl := range file.Decls {
+		if d, ok := decl.(*ast.GenDecl); ok && d.Tok == token.TYPE {
+			for _, spec := range d.Specs {
+				ts := spec.(*ast.TypeSpec)
+				c.specs[ts.Name.Name] = ts
+			}
+		}
+	}
+	if len(params) == 0 {
+		for _, p := range declared {
+			if c.specs[p.Name] != nil {
+				params = append(params, p.Name)
+			}
+		}
+	}
+	if len(params) == 0 {
+		params = []string{"Type"}
+	}
+	for _, name := range params {
+		ts := c.specs[name]
+		if ts == nil {
+			return &mappingError{
+				msg: fmt.Sprintf("generic type %v is not declared in %v", name, inFilename),
+			}
+		}
+		c.placeholders[c.info.Defs[ts.Name]] = name
+	}
+	for name := range c.specs {
+		if c.placeholders[c.info.Defs[c.specs[name].Name]] == "" {
+			delete(c.specs, name)
+		}
+	}
+	c.params = params
+
+	if err := c.collectDecls(); err != nil {
+		return err
+	}
+	if err := c.inferConstraints(declared); err != nil {
+		return err
+	}
+	if err := c.convert(); err != nil {
+		return err
+	}
+
+	buff := &bytes.Buffer{}
+	err = printer.Fprint(buff, fset, file)
+	if err != nil {
+		return errors.Wrap(err, "writing file failed")
+	}
+	src := buff.Bytes()
+	for placeholder, iface := range c.interfaces {
+		ifaceBuff := &bytes.Buffer{}
+		if err := printer.Fprint(ifaceBuff, token.NewFileSet(), iface); err != nil {
+			return errors.Wrap(err, "writing file failed")
+		}
+		src = bytes.Replace(src, []byte(placeholder), ifaceBuff.Bytes(), 1)
+	}
+	outBytes, err := imports.Process(outFilename, src, nil)
+	if err != nil {
+		return errors.Wrap(err, "Formatting file failed")
+	}
+	_, err = out.Write(outBytes)
+	return errors.Wrap(err, "writing file failed")
+}
+
+func toGenericsMain(args []string) {
+	flags := flag.NewFlagSet(myName+" to-generics", flag.ExitOnError)
+	out := flags.String("out", "", "file to save output to instead of stdout")
+	flags.Usage = usage
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		usage()
+		os.Exit(exitcodeInvalidArgs)
+	}
+	in := flags.Arg(0)
+
+	src, err := ioutil.ReadFile(in)
+	if err != nil {
+		fatal(exitcodeSourceFileInvalid, err)
+	}
+	outFilename := "stdout"
+	if *out != "" {
+		outFilename = *out
+	}
+	buffer := &bytes.Buffer{}
+	err = toGenerics(bytes.NewReader(src), in, flags.Args()[1:], buffer, outFilename)
+	if _, ok := errors.Cause(err).(*mappingError); ok {
+		fatal(exitcodeMappingMismatch, err)
+	}
+	if err != nil {
+		fatal(exitcodeGenFailed, err)
+	}
+	if *out == "" {
+		os.Stdout.Write(buffer.Bytes())
+		return
+	}
+	if err := os.MkdirAll(path.Dir(*out), 0755); err != nil {
+		fatal(exitcodeDestFileFailed, err)
+	}
+	if err := ioutil.WriteFile(*out, buffer.Bytes(), 0644); err != nil {
+		fatal(exitcodeDestFileFailed, err)
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToGenerics(t *testing.T) {
+	assert := assert.New(t)
+	testCases := []struct {
+		src      string
+		params   []string
+		expected string
+	}{
+		{
+			src: `package set
+
+import "fmt"
+
+// Type is the element type.
+//rei:constraint comparable
+type Type int
+
+// Less compares two elements.
+func (t Type) Less(o Type) bool { return t < o }
+
+// Set is a set of elements.
+type Set map[Type]struct{}
+
+// Add adds v to the set.
+func (s Set) Add(v Type) {
+	s[v] = struct{}{}
+}
+
+// Min returns the smallest element.
+func (s Set) Min() Type {
+	var m Type
+	first := true
+	for v := range s {
+		if first || v.Less(m) {
+			m = v
+		}
+		first = false
+	}
+	return m
+}
+
+// NewSet creates a set.
+func NewSet(vs ...Type) Set {
+	s := make(Set)
+	for _, v := range vs {
+		s.Add(v)
+	}
+	return s
+}
+
+// Empty returns an empty set.
+func Empty() Set {
+	return NewSet()
+}
+
+// Print prints the set.
+func Print(s Set) {
+	fmt.Println(len(s), Empty())
+}
+`,
+			expected: `package set
+
+import "fmt"
+
+// TypeConstraint is the constraint of Type, inferred from its uses.
+type TypeConstraint[Type any] interface {
+	comparable
+	Less(o Type) bool
+}
+
+// Set is a set of elements.
+type Set[Type TypeConstraint[Type]] map[Type]struct{}
+
+// Add adds v to the set.
+func (s Set[Type]) Add(v Type) {
+	s[v] = struct{}{}
+}
+
+// Min returns the smallest element.
+func (s Set[Type]) Min() Type {
+	var m Type
+	first := true
+	for v := range s {
+		if first || v.Less(m) {
+			m = v
+		}
+		first = false
+	}
+	return m
+}
+
+// NewSet creates a set.
+func NewSet[Type TypeConstraint[Type]](vs ...Type) Set[Type] {
+	s := make(Set[Type])
+	for _, v := range vs {
+		s.Add(v)
+	}
+	return s
+}
+
+// Empty returns an empty set.
+func Empty[Type TypeConstraint[Type]]() Set[Type] {
+	return NewSet[Type]()
+}
+
+// Print prints the set.
+func Print[Type TypeConstraint[Type]](s Set[Type]) {
+	fmt.Println(len(s), Empty[Type]())
+}
+`,
+		},
+		{
+			src: `//rei:param Key
+//rei:param Value
+
+package cache
+
+// Key is the key type.
+type Key string
+
+// Value is the value type.
+type Value interface{}
+
+// Cache caches values.
+type Cache struct {
+	items map[Key]Value
+	order []Key
+}
+
+// NewCache creates a cache.
+func NewCache() *Cache {
+	return &Cache{items: make(map[Key]Value)}
+}
+
+// Get returns the value of a key.
+func (c *Cache) Get(k Key) (Value, bool) {
+	v, ok := c.items[k]
+	return v, ok
+}
+
+// Keys returns the keys of the cache.
+func Keys(c *Cache) []Key {
+	return c.order
+}
+`,
+			expected: `package cache
+
+// Cache caches values.
+type Cache[Key comparable, Value any] struct {
+	items map[Key]Value
+	order []Key
+}
+
+// NewCache creates a cache.
+func NewCache[Key comparable, Value any]() *Cache[Key, Value] {
+	return &Cache[Key, Value]{items: make(map[Key]Value)}
+}
+
+// Get returns the value of a key.
+func (c *Cache[Key, Value]) Get(k Key) (Value, bool) {
+	v, ok := c.items[k]
+	return v, ok
+}
+
+// Keys returns the keys of the cache.
+func Keys[Key comparable, Value any](c *Cache[Key, Value]) []Key {
+	return c.order
+}
+`,
+		},
+		{
+			src: `package stats
+
+type (
+	// Elem is a number.
+	Elem float64
+
+	// Pair holds two elements.
+	Pair struct {
+		A, B Elem
+	}
+)
+
+// Sum adds the elements.
+func Sum(xs []Elem) Elem {
+	var s Elem
+	for _, x := range xs {
+		s += x
+	}
+	return s
+}
+
+// Max returns the larger element of a pair.
+func (p Pair) Max() Elem {
+	if p.A > p.B {
+		return p.A
+	}
+	return p.B
+}
+
+// Total sums pairs.
+func Total(ps []Pair) Elem {
+	xs := make([]Elem, 0, len(ps))
+	for _, p := range ps {
+		xs = append(xs, p.Max())
+	}
+	return Sum(xs)
+}
+
+// Half halves an element.
+func Half(x Elem) Elem {
+	return x / 2
+}
+`,
+			params: []string{"Elem"},
+			expected: `package stats
+
+type (
+	// ElemConstraint is the constraint of Elem, inferred from its uses.
+	ElemConstraint interface {
+		~int | ~int8 | ~int16 | ~int32 | ~int64 | ~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr | ~float32 | ~float64
+	}
+
+	// Pair holds two elements.
+	Pair[Elem ElemConstraint] struct {
+		A, B Elem
+	}
+)
+
+// Sum adds the elements.
+func Sum[Elem ElemConstraint](xs []Elem) Elem {
+	var s Elem
+	for _, x := range xs {
+		s += x
+	}
+	return s
+}
+
+// Max returns the larger element of a pair.
+func (p Pair[Elem]) Max() Elem {
+	if p.A > p.B {
+		return p.A
+	}
+	return p.B
+}
+
+// Total sums pairs.
+func Total[Elem ElemConstraint](ps []Pair[Elem]) Elem {
+	xs := make([]Elem, 0, len(ps))
+	for _, p := range ps {
+		xs = append(xs, p.Max())
+	}
+	return Sum(xs)
+}
+
+// Half halves an element.
+func Half[Elem ElemConstraint](x Elem) Elem {
+	return x / 2
+}
+`,
+		},
+	}
+	for i, tc := range testCases {
+		tc := tc
+		t.Run(fmt.Sprintf("case %v", i), func(t *testing.T) {
+			out := &bytes.Buffer{}
+			err := toGenerics(bytes.NewBufferString(tc.src), "template.go", tc.params, out, "out.go")
+			if !assert.NoError(err) {
+				return
+			}
+			assert.Equal(tc.expected, out.String())
+
+			// The output must type check.
+			fset := token.NewFileSet()
+			file, err := parser.ParseFile(fset, "out.go", out.Bytes(), 0)
+			if !assert.NoError(err) {
+				return
+			}
+			conf := types.Config{Importer: importer.ForCompiler(fset, "source", nil)}
+			_, err = conf.Check(file.Name.Name, fset, []*ast.File{file}, nil)
+			assert.NoError(err)
+		})
+	}
+}
+
+func TestToGenericsErrors(t *testing.T) {
+	assert := assert.New(t)
+	testCases := []struct {
+		name     string
+		src      string
+		params   []string
+		err      string
+		mismatch bool
+	}{
+		{
+			name:     "missing generic type",
+			src:      "package x\n\ntype Type int\n",
+			params:   []string{"Elem"},
+			err:      "generic type Elem is not declared in template.go",
+			mismatch: true,
+		},
+		{
+			name: "generic variable",
+			src:  "package x\n\ntype Type int\n\nvar zero Type\n",
+			err:  "zero depends on Type, Go has no generic variables or constants",
+		},
+		{
+			name: "field",
+			src:  "package x\n\ntype Type struct{ ID int }\n\nfunc ID(t Type) int { return t.ID }\n",
+			err:  "field ID of Type cannot be used through a type parameter",
+		},
+		{
+			name: "composite literal",
+			src:  "package x\n\ntype Type struct{}\n\nfunc New() Type { return Type{} }\n",
+			err:  "composite literal of Type cannot be converted to a type parameter",
+		},
+		{
+			name: "nil comparison",
+			src:  "package x\n\ntype Type interface{ Close() error }\n\nfunc IsNil(x Type) bool { return x == nil }\n",
+			err:  "comparison of Type with nil cannot be converted to a type parameter",
+		},
+		{
+			name: "pointer receiver method",
+			src:  "package x\n\ntype Type struct{ n int }\n\nfunc (t *Type) Reset() { t.n = 0 }\n\nfunc ResetAll(xs []*Type) {\n\tfor _, x := range xs {\n\t\tx.Reset()\n\t}\n}\n",
+			err:  "method Reset of Type is called through a pointer, it cannot be converted to a type parameter",
+		},
+		{
+			name: "struct constraint",
+			src:  "package x\n\n//rei:constraint struct with field ID int\ntype Type struct{ ID int }\n",
+			err:  `constraint "struct with field ID int" of Type cannot be converted to a type parameter constraint`,
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			err := toGenerics(bytes.NewBufferString(tc.src), "template.go", tc.params, out, "out.go")
+			if assert.Error(err) {
+				assert.Contains(err.Error(), tc.err)
+				_, mismatch := errors.Cause(err).(*mappingError)
+				assert.Equal(tc.mismatch, mismatch)
+			}
+			assert.Empty(out.String())
+		})
+	}
+}
@@ -2,6 +2,12 @@ package main
 
 import (
 	"fmt"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"path"
+	"sort"
+	"strconv"
 	"strings"
 	"unicode"
 )
@@ -13,6 +19,70 @@ type Type struct {
 	Name    string
 	Aliased bool
 	Pointer bool
+	// Qualified is set if the names generated from the type are prefixed
+	// with its package's name, e.g. NewModelsUserDAO for models.User.
+	Qualified bool
+	// Fields maps the field and method names of the generic type
+	// to the names used by the concrete type.
+	Fields map[string]string
+	// Value is the constant expression of a value parameter.
+	// Name is derived from it and used in renaming.
+	Value string
+	// Package is set if the mapping replaces a package imported by the template.
+	// Name is the package's name.
+	Package bool
+	// Ident is set if the mapping replaces a fragment of identifiers with Name.
+	Ident bool
+	// Wildcard is set if the mapping matches several types of Pkg:
+	// * for every exported type, or a regexp matching their names.
+	// Name is empty.
+	Wildcard string
+	// Adapter is set if the concrete type is wrapped in a generated adapter type,
+	// which implements the mapped methods of Fields by calling the concrete type's methods.
+	Adapter bool
+}
+
+// String returns the type in the type mapping format.
+func (t Type) String() string {
+	if t.Value != "" {
+		return "const:" + t.Value
+	}
+	if t.Package {
+		if t.Aliased {
+			return fmt.Sprintf("(%q)%v", t.Pkg, t.PkgName)
+		}
+		return t.Pkg
+	}
+	s := t.Name
+	if t.Wildcard == "*" {
+		s = "*"
+	} else if t.Wildcard != "" {
+		s = "/" + t.Wildcard + "/"
+	}
+	if t.Aliased {
+		s = fmt.Sprintf("(%q)%v.%v", t.Pkg, t.PkgName, s)
+	} else if t.Pkg != "" {
+		s = t.Pkg + "." + s
+	}
+	if t.Pointer {
+		s = "*" + s
+	}
+	if len(t.Fields) > 0 {
+		names := make([]string, 0, len(t.Fields))
+		for name := range t.Fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fields := make([]string, len(names))
+		for i, name := range names {
+			fields[i] = name + ":" + t.Fields[name]
+		}
+		s += "{" + strings.Join(fields, ",") + "}"
+	}
+	if t.Adapter {
+		s = "adapt:" + s
+	}
+	return s
 }
 
 func isIdentifier(s string) (bool, int) {
@@ -32,7 +102,16 @@ func isIdentifier(s string) (bool, int) {
 	return true, -1
 }
 
+// literalTypes are the type literals accepted as concrete types.
+var literalTypes = map[string]bool{
+	"struct{}":    true,
+	"interface{}": true,
+}
+
 func validateType(t Type) (Type, error) {
+	if literalTypes[t.Name] && t.Pkg == "" {
+		return t, nil
+	}
 	if ok, idx := isIdentifier(t.Name); !ok {
 		return t, fmt.Errorf("invalid type: %v (at %v)", t.Name, idx)
 	}
@@ -42,15 +121,230 @@ func validateType(t Type) (Type, error) {
 	return t, nil
 }
 
+// parseFields parses the field mapping of a type, e.g. ID:UserID,Name:FullName.
+func parseFields(s string) (map[string]string, error) {
+	fields := make(map[string]string)
+	for _, field := range strings.Split(s, ",") {
+		parts := strings.SplitN(field, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid field mapping %v, expected Field:ConcreteField", field)
+		}
+		for _, name := range parts {
+			if ok, _ := isIdentifier(name); !ok {
+				return nil, fmt.Errorf("invalid field mapping %v, %v is not a valid identifier", field, name)
+			}
+		}
+		if _, ok := fields[parts[0]]; ok {
+			return nil, fmt.Errorf("duplicate field mapping for %v", parts[0])
+		}
+		fields[parts[0]] = parts[1]
+	}
+	return fields, nil
+}
+
+// valueName returns the name of a value used in renaming,
+// made of the letters and digits of the value.
+func valueName(value string) string {
+	if unquoted, err := strconv.Unquote(value); err == nil {
+		value = unquoted
+	}
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, value)
+}
+
+// operatorNames are the names of the operators of constant expressions
+// used in renaming.
+var operatorNames = map[token.Token]string{
+	token.ADD:     "Add",
+	token.SUB:     "Sub",
+	token.MUL:     "Mul",
+	token.QUO:     "Div",
+	token.REM:     "Rem",
+	token.AND:     "And",
+	token.OR:      "Or",
+	token.XOR:     "Xor",
+	token.SHL:     "Shl",
+	token.SHR:     "Shr",
+	token.AND_NOT: "AndNot",
+	token.LAND:    "LAnd",
+	token.LOR:     "LOr",
+	token.EQL:     "Eq",
+	token.NEQ:     "Ne",
+	token.LSS:     "Lt",
+	token.GTR:     "Gt",
+	token.LEQ:     "Le",
+	token.GEQ:     "Ge",
+	token.NOT:     "Not",
+}
+
+// unaryOperatorNames are the names of the unary operators that are also binary operators.
+var unaryOperatorNames = map[token.Token]string{
+	token.ADD: "Pos",
+	token.SUB: "Neg",
+	token.XOR: "Compl",
+}
+
+// constName returns the name of a constant expression used in renaming.
+// Operators are spelled out, so that different values get different names,
+// e.g. Neg1 for -1 and 1Shl10 for 1 << 10. Decimal points are spelled p, e.g. 1p5.
+// Parentheses, selectors and string literals are reduced to their letters and digits.
+func constName(value string) string {
+	fset := token.NewFileSet()
+	file := fset.AddFile("", fset.Base(), len(value))
+	var sc scanner.Scanner
+	sc.Init(file, []byte(value), nil, 0)
+
+	name := ""
+	unary := true
+	for {
+		_, tok, lit := sc.Scan()
+		if tok == token.EOF {
+			break
+		}
+		if op, ok := unaryOperatorNames[tok]; ok && unary {
+			name += op
+		} else if op, ok := operatorNames[tok]; ok {
+			name += op
+		} else if tok == token.FLOAT {
+			name += valueName(strings.NewReplacer(".", "p", "-", "Neg").Replace(lit))
+		} else {
+			name += valueName(lit)
+		}
+		_, isOperator := operatorNames[tok]
+		unary = isOperator || tok == token.LPAREN || tok == token.COMMA
+	}
+	return name
+}
+
+// parseValue parses the value of a value parameter:
+// const:{constant expression} or str:{string}.
+// Strings can be quoted or unquoted.
+func parseValue(s string) (Type, error) {
+	var value string
+	switch {
+	case strings.HasPrefix(s, "const:"):
+		value = strings.TrimPrefix(s, "const:")
+	case strings.HasPrefix(s, "str:"):
+		value = strings.TrimPrefix(s, "str:")
+		if _, err := strconv.Unquote(value); err != nil {
+			value = strconv.Quote(value)
+		}
+	}
+	if _, err := parser.ParseExpr(value); err != nil {
+		return Type{}, fmt.Errorf("invalid value %v: %v", s, err)
+	}
+	return Type{
+		Name:  constName(value),
+		Value: value,
+	}, nil
+}
+
+// ParsePackage parses a package in a package mapping.
+// The following formats are accepted:
+// pkg/pkg/pkg
+// ("pkg/pkg/go-pkg")pkg
+func ParsePackage(s string) (Type, error) {
+	pkgImport := s
+	pkgName := path.Base(s)
+	aliased := false
+	if strings.HasPrefix(s, `("`) {
+		closeIdx := strings.LastIndex(s, `")`)
+		if closeIdx == -1 {
+			return Type{}, fmt.Errorf(`invalid package specification %v: missing closing ")`, s)
+		}
+		pkgImport = s[2:closeIdx]
+		pkgName = s[closeIdx+2:]
+		aliased = true
+	}
+	if pkgImport == "" {
+		return Type{}, fmt.Errorf("invalid package specification %v: empty import path", s)
+	}
+	if ok, idx := isIdentifier(pkgName); !ok {
+		return Type{}, fmt.Errorf("invalid package name: %v (at %v)", pkgName, idx)
+	}
+	return Type{
+		Pkg:     pkgImport,
+		PkgName: pkgName,
+		Name:    pkgName,
+		Aliased: aliased,
+		Package: true,
+	}, nil
+}
+
+// ParseIdent parses the replacement of an identifier fragment in a name mapping.
+func ParseIdent(s string) (Type, error) {
+	if ok, idx := isIdentifier(s); !ok {
+		return Type{}, fmt.Errorf("invalid name: %v (at %v)", s, idx)
+	}
+	return Type{
+		Name:  s,
+		Ident: true,
+	}, nil
+}
+
 // ParseType parses a type string.
 // The following formats are accepted:
 // ConcreteType
+// struct{} or interface{}
 // pkg/pkg/pkg.ConcreteType
 // ("pkg/pkg/go-pkg")pkg.ConcreteType
 // *ConcreteType
 // *pkg/pkg/pkg.ConcreteType
 // *("pkg/pkg/go-pkg")pkg.ConcreteType
+// Any of the above can be followed by a field mapping, e.g.
+// pkg.ConcreteType{ID:ConcreteID,Name:FullName}
+// Values of value parameters are accepted as well, see parseValue,
+// and adapted types, see parseAdapter.
 func ParseType(s string) (Type, error) {
+	if strings.HasPrefix(s, "const:") || strings.HasPrefix(s, "str:") {
+		return parseValue(s)
+	}
+	if strings.HasPrefix(s, "adapt:") {
+		return parseAdapter(s)
+	}
+	if t, ok, err := parseWildcard(s); ok {
+		return t, err
+	}
+	var fields map[string]string
+	if strings.HasSuffix(s, "}") && !literalTypes[strings.TrimPrefix(s, "*")] {
+		openIdx := strings.LastIndex(s, "{")
+		if openIdx == -1 {
+			return Type{}, fmt.Errorf("invalid type specification %v: missing opening {", s)
+		}
+		var err error
+		fields, err = parseFields(s[openIdx+1 : len(s)-1])
+		if err != nil {
+			return Type{}, err
+		}
+		s = s[:openIdx]
+	}
+	t, err := parseType(s)
+	t.Fields = fields
+	return t, err
+}
+
+// parseAdapter parses an adapted type: adapt: followed by a type with a method mapping,
+// e.g. adapt:pkg.ConcreteType{Get:Fetch}.
+func parseAdapter(s string) (Type, error) {
+	t, err := ParseType(strings.TrimPrefix(s, "adapt:"))
+	if err != nil {
+		return t, err
+	}
+	if t.Value != "" || t.Wildcard != "" || t.Adapter || literalTypes[t.Name] {
+		return Type{}, fmt.Errorf("invalid adapter %v: expected a named type", s)
+	}
+	if len(t.Fields) == 0 {
+		return Type{}, fmt.Errorf("invalid adapter %v: missing method mapping", s)
+	}
+	t.Adapter = true
+	return t, nil
+}
+
+func parseType(s string) (Type, error) {
 	Pointer := false
 	if strings.HasPrefix(s, "*") {
 		s = s[1:]
@@ -60,6 +60,41 @@ func TestParseType(t *testing.T) {
 		{"*github.com/user/pkg/subpkg.Concrete", true, Type{Pkg: "github.com/user/pkg/subpkg", PkgName: "subpkg", Name: "Concrete", Pointer: true}},
 		{`*("github.com/user/pkg/go-subpkg")subpkg.Concrete`, true, Type{Pkg: "github.com/user/pkg/go-subpkg", PkgName: "subpkg", Name: "Concrete", Aliased: true, Pointer: true}},
 		{`*("os")goos.File`, true, Type{Pkg: "os", PkgName: "goos", Name: "File", Aliased: true, Pointer: true}},
+
+		{"models.User{ID:UserID}", true, Type{Pkg: "models", PkgName: "models", Name: "User", Fields: map[string]string{"ID": "UserID"}}},
+		{"*User{ID:UserID,Key:Email}", true, Type{Name: "User", Pointer: true, Fields: map[string]string{"ID": "UserID", "Key": "Email"}}},
+		{"User{ID}", false, Type{}},
+		{"User{ID:1D}", false, Type{}},
+		{"User{ID:UserID,ID:OrderID}", false, Type{}},
+		{"UserID:UserID}", false, Type{}},
+
+		{"struct{}", true, Type{Name: "struct{}"}},
+		{"*interface{}", true, Type{Name: "interface{}", Pointer: true}},
+		{"pkg.struct{}", false, Type{}},
+
+		{"github.com/acme/models.*", true, Type{Pkg: "github.com/acme/models", PkgName: "models", Wildcard: "*"}},
+		{"*models./DAO$/", true, Type{Pkg: "models", PkgName: "models", Pointer: true, Wildcard: "DAO$"}},
+		{`("github.com/acme/go-models")models./^User/`, true, Type{Pkg: "github.com/acme/go-models", PkgName: "models", Aliased: true, Wildcard: "^User"}},
+		{"models./(/", false, Type{}},
+		{"models.//", false, Type{}},
+
+		{"adapt:models.Store{Get:Fetch}", true, Type{Pkg: "models", PkgName: "models", Name: "Store", Fields: map[string]string{"Get": "Fetch"}, Adapter: true}},
+		{"adapt:*Store{Get:Fetch,Put:Save}", true, Type{Name: "Store", Pointer: true, Fields: map[string]string{"Get": "Fetch", "Put": "Save"}, Adapter: true}},
+		{"adapt:models.Store", false, Type{}},
+		{"adapt:struct{}", false, Type{}},
+		{"adapt:const:64", false, Type{}},
+
+		{"const:64", true, Type{Name: "64", Value: "64"}},
+		{"const:1 << 10", true, Type{Name: "1Shl10", Value: "1 << 10"}},
+		{"const:-1", true, Type{Name: "Neg1", Value: "-1"}},
+		{"const:1", true, Type{Name: "1", Value: "1"}},
+		{"const:2 - -1", true, Type{Name: "2SubNeg1", Value: "2 - -1"}},
+		{"const:(1 + 2) * ^3", true, Type{Name: "1Add2MulCompl3", Value: "(1 + 2) * ^3"}},
+		{"const:1.5", true, Type{Name: "1p5", Value: "1.5"}},
+		{"const:math.MaxInt64", true, Type{Name: "mathMaxInt64", Value: "math.MaxInt64"}},
+		{`str:"users"`, true, Type{Name: "users", Value: `"users"`}},
+		{"str:user items", true, Type{Name: "useritems", Value: `"user items"`}},
+		{"const:64)", false, Type{}},
 	}
 	for _, tc := range testCases {
 		tc := tc
@@ -72,3 +107,26 @@ func TestParseType(t *testing.T) {
 		})
 	}
 }
+
+func TestTypeString(t *testing.T) {
+	assert := assert.New(t)
+	testCases := []string{
+		"Concrete",
+		"*pkg.Concrete",
+		"github.com/user/pkg/subpkg.Concrete",
+		`("github.com/user/pkg/go-subpkg")subpkg.Concrete`,
+		"models.User{ID:UserID,Key:Email}",
+		"github.com/acme/models.*",
+		"*models./DAO$/",
+		"time./^Nothing$/",
+		`("github.com/acme/go-models")models./^User/`,
+		"adapt:*Store{Get:Fetch,Put:Save}",
+		"const:64",
+	}
+	for _, tc := range testCases {
+		tp, err := ParseType(tc)
+		if assert.NoError(err, tc) {
+			assert.Equal(tc, tp.String(), tc)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/imports"
+
+	"github.com/pkg/errors"
+)
+
+// parseWildcard parses a wildcard type in a type mapping:
+// pkg/pkg/pkg.* matches every exported type of the package,
+// pkg/pkg/pkg./regexp/ the exported types whose name matches the regexp.
+// The package can be aliased and the type can be a pointer like in other types.
+// ok is false if s is not a wildcard.
+func parseWildcard(s string) (t Type, ok bool, err error) {
+	var pkg, pattern string
+	switch {
+	case strings.HasSuffix(s, ".*"):
+		pkg, pattern = strings.TrimSuffix(s, ".*"), "*"
+	case strings.HasSuffix(s, "/") && strings.Contains(s, "./"):
+		idx := strings.Index(s, "./")
+		pkg, pattern = s[:idx], s[idx+2:len(s)-1]
+		if pattern == "" {
+			return Type{}, true, fmt.Errorf("invalid wildcard %v: empty regexp", s)
+		}
+		if _, err := regexp.Compile(pattern); err != nil {
+			return Type{}, true, errors.Wrap(err, fmt.Sprintf("invalid wildcard %v", s))
+		}
+	default:
+		return Type{}, false, nil
+	}
+	// Parse the package with a placeholder type name.
+	t, err = parseType(pkg + ".Wildcard")
+	if err != nil {
+		return Type{}, true, err
+	}
+	if t.Pkg == "" {
+		return Type{}, true, fmt.Errorf("invalid wildcard %v: missing package", s)
+	}
+	t.Name = ""
+	t.Wildcard = pattern
+	return t, true, nil
+}
+
+// matchesName reports whether the wildcard matches the name of a type.
+func (t *Type) matchesName(name string) bool {
+	if t.Wildcard == "*" {
+		return true
+	}
+	return regexp.MustCompile(t.Wildcard).MatchString(name)
+}
+
+// hasWildcard reports whether the type mapping contains a wildcard.
+func hasWildcard(typeMapping map[string]*Type) bool {
+	for _, t := range typeMapping {
+		if t.Wildcard != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// wildcardTypes returns the exported types of the wildcard's package
+// whose name matches the wildcard, and which satisfy the constraints, sorted by name.
+func wildcardTypes(l *typeLoader, wildcard *Type, where []*constraint) ([]*Type, error) {
+	pkg, err := l.load(wildcard.Pkg)
+	if err != nil {
+		return nil, err
+	}
+	var matches []*Type
+	for _, name := range pkg.Scope().Names() {
+		obj, ok := pkg.Scope().Lookup(name).(*types.TypeName)
+		if !ok || !obj.Exported() || !wildcard.matchesName(name) {
+			continue
+		}
+		if named, ok := obj.Type().(*types.Named); ok && named.TypeParams().Len() > 0 {
+			continue
+		}
+		t := *wildcard
+		t.Name = name
+		t.Wildcard = ""
+		typ := obj.Type()
+		if t.Pointer {
+			typ = types.NewPointer(typ)
+		}
+		satisfied := true
+		for _, c := range where {
+			ok, err := c.satisfiedBy(l, typ)
+			if err != nil {
+				return nil, errors.Wrap(err, fmt.Sprintf("checking %q of %v failed", c.text, t))
+			}
+			if !ok {
+				satisfied = false
+				break
+			}
+		}
+		if satisfied {
+			matches = append(matches, &t)
+		}
+	}
+	return matches, nil
+}
+
+// expandWildcards returns a type mapping for every combination of
+// the types matching the wildcards of the type mapping.
+func expandWildcards(l *typeLoader, typeMapping map[string]*Type, where []*constraint) ([]map[string]*Type, error) {
+	names := make([]string, 0, len(typeMapping))
+	for name := range typeMapping {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	mappings := []map[string]*Type{{}}
+	for _, name := range names {
+		t := typeMapping[name]
+		if t.Wildcard == "" {
+			for _, m := range mappings {
+				m[name] = t
+			}
+			continue
+		}
+		matches, err := wildcardTypes(l, t, where)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("expanding %v=%v failed", name, t))
+		}
+		if len(matches) == 0 {
+			return nil, &mappingError{
+				msg: fmt.Sprintf("no type matches %v=%v", name, t),
+			}
+		}
+		var expanded []map[string]*Type
+		for _, m := range mappings {
+			for _, match := range matches {
+				em := make(map[string]*Type, len(m)+1)
+				for k, v := range m {
+					em[k] = v
+				}
+				em[name] = match
+				expanded = append(expanded, em)
+			}
+		}
+		mappings = expanded
+	}
+	return mappings, nil
+}
+
+// combine merges the generated files of several instantiations into one file
+// named outFilename, merging their imports.
+func combine(outFilename string, outputs [][]byte) ([]byte, error) {
+	fset := token.NewFileSet()
+	var pkgName string
+	var importSpecs []string
+	seen := make(map[string]bool)
+	body := &bytes.Buffer{}
+	for _, src := range outputs {
+		file, err := parser.ParseFile(fset, "", src, parser.ParseComments)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing generated code failed")
+		}
+		pkgName = file.Name.Name
+		for _, imp := range file.Imports {
+			spec := imp.Path.Value
+			if imp.Name != nil {
+				spec = imp.Name.Name + " " + spec
+			}
+			if !seen[spec] {
+				seen[spec] = true
+				importSpecs = append(importSpecs, spec)
+			}
+		}
+		start := file.Name.End()
+		for _, decl := range file.Decls {
+			if d, ok := decl.(*ast.GenDecl); ok && d.Tok == token.IMPORT {
+				start = d.End()
+			}
+		}
+		body.Write(bytes.TrimSpace(src[fset.Position(start).Offset:]))
+		body.WriteString("\n\n")
+	}
+
+	out := &bytes.Buffer{}
+	fmt.Fprintf(out, "// Code generated by rei. DO NOT EDIT.\n\npackage %v\n\n", pkgName)
+	if len(importSpecs) > 0 {
+		sort.Strings(importSpecs)
+		fmt.Fprintf(out, "import (\n%v\n)\n\n", strings.Join(importSpecs, "\n"))
+	}
+	out.Write(body.Bytes())
+	outBytes, err := imports.Process(outFilename, out.Bytes(), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "Formatting file failed")
+	}
+	return outBytes, nil
+}
+
+// topLevelNames returns the names declared by generated code at the package level.
+// Methods are named after their receiver type, e.g. UserDAO.Get.
+func topLevelNames(src []byte) ([]string, error) {
+	file, err := parser.ParseFile(token.NewFileSet(), "", src, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing generated code failed")
+	}
+	var names []string
+	add := func(prefix string, id *ast.Ident) {
+		if id != nil && id.Name != "_" && id.Name != "init" {
+			names = append(names, prefix+id.Name)
+		}
+	}
+	for _, decl := range file.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if d.Recv != nil && len(d.Recv.List) > 0 {
+				add(receiverTypeName(d.Recv.List[0].Type)+".", d.Name)
+				continue
+			}
+			add("", d.Name)
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				switch s := spec.(type) {
+				case *ast.TypeSpec:
+					add("", s.Name)
+				case *ast.ValueSpec:
+					for _, name := range s.Names {
+						add("", name)
+					}
+				}
+			}
+		}
+	}
+	return names, nil
+}
+
+// isDirOutput reports whether out is a directory, or ends with a separator.
+func isDirOutput(out string) bool {
+	if strings.HasSuffix(out, "/") || strings.HasSuffix(out, string(filepath.Separator)) {
+		return true
+	}
+	info, err := os.Stat(out)
+	return err == nil && info.IsDir()
+}
+
+// genWildcards generates the template in for every combination of the types
+// matching the wildcards of the type mapping. If out is a directory,
+// each instantiation is generated into its own file named after the types,
+// otherwise they are combined into out, or written to w if out is empty.
+func genWildcards(src []byte, in, out, targetPackageName string, typeMapping map[string]*Type, where []*constraint, w io.Writer, opts genOptions) error {
+	dirOutput := out != "" && isDirOutput(out)
+	if dirOutput {
+		out = filepath.Clean(out)
+		targetPackageName = targetPackage(in, out)
+		opts.Dir = out
+	}
+	mappings, err := expandWildcards(newTypeLoader(opts.Dir), typeMapping, where)
+	if err != nil {
+		return err
+	}
+	usesPackageName := targetPackageName
+	if usesPackageName == "" {
+		usesPackageName, err = packageName(in)
+		if err != nil {
+			return err
+		}
+	}
+	usesDir := opts.Dir
+	seen := make(map[string]string)
+
+	var outputs [][]byte
+	var outFilenames []string
+	// declared maps the top-level names of the instantiations to the instantiation declaring them.
+	declared := make(map[string]string)
+	for _, mapping := range mappings {
+		outFilename := out
+		if dirOutput {
+			outFilename = filepath.Join(out, instanceFilename(in, mapping))
+		} else if outFilename == "" {
+			outFilename = "stdout"
+		}
+		key := instanceKey(in, mapping)
+		buffer := &bytes.Buffer{}
+		err := gen(bytes.NewReader(src), in, targetPackageName, mapping, buffer, outFilename, opts)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("generating %v failed", key))
+		}
+		names, err := topLevelNames(buffer.Bytes())
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("generating %v failed", key))
+		}
+		for _, name := range names {
+			if prev, ok := declared[name]; ok {
+				return &mappingError{
+					msg: fmt.Sprintf("%v is declared by both %v and %v, its name does not depend on the types matching the wildcard", name, prev, key),
+				}
+			}
+			declared[name] = key
+		}
+		outputs = append(outputs, buffer.Bytes())
+		outFilenames = append(outFilenames, outFilename)
+	}
+	for i, mapping := range mappings {
+		if dirOutput {
+			if err := ioutil.WriteFile(outFilenames[i], outputs[i], 0644); err != nil {
+				return err
+			}
+		}
+		if err := generateUses(in, mapping, usesDir, usesPackageName, opts, seen); err != nil {
+			return err
+		}
+	}
+	if dirOutput {
+		return nil
+	}
+
+	outFilename := out
+	if outFilename == "" {
+		outFilename = "stdout"
+	}
+	combined, err := combine(outFilename, outputs)
+	if err != nil {
+		return err
+	}
+	if out == "" {
+		_, err = w.Write(combined)
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(out, combined, 0644)
+}
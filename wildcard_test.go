@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandWildcards(t *testing.T) {
+	assert := assert.New(t)
+	testCases := []struct {
+		mapping  string
+		where    []string
+		expected []string
+	}{
+		{"Type=time./^(Month|Weekday|Time)$/", nil, []string{"Type=time.Month", "Type=time.Time", "Type=time.Weekday"}},
+		{"Type=time./^(Month|Weekday|Time)$/", []string{"ordered"}, []string{"Type=time.Month", "Type=time.Weekday"}},
+		{"Type=*time./^(Month|Time)$/,Value=int", []string{"implements fmt.Stringer"}, []string{
+			"Type=*time.Month,Value=int",
+			"Type=*time.Time,Value=int",
+		}},
+		{"Key=time./^Month$/,Value=time./^(Weekday|Duration)$/", nil, []string{
+			"Key=time.Month,Value=time.Duration",
+			"Key=time.Month,Value=time.Weekday",
+		}},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.mapping, func(t *testing.T) {
+			typeMapping, err := parseMapping(tc.mapping)
+			if !assert.NoError(err) {
+				return
+			}
+			var where []*constraint
+			for _, text := range tc.where {
+				c, err := parseConstraint(text)
+				if !assert.NoError(err) {
+					return
+				}
+				where = append(where, c)
+			}
+			mappings, err := expandWildcards(newTypeLoader(""), typeMapping, where)
+			if !assert.NoError(err) {
+				return
+			}
+			var actual []string
+			for _, m := range mappings {
+				s := ""
+				for _, name := range []string{"Key", "Type", "Value"} {
+					if t, ok := m[name]; ok {
+						if s != "" {
+							s += ","
+						}
+						s += fmt.Sprintf("%v=%v", name, t)
+					}
+				}
+				actual = append(actual, s)
+			}
+			assert.Equal(tc.expected, actual)
+		})
+	}
+
+	typeMapping, err := parseMapping("Type=time./^Nothing$/")
+	if assert.NoError(err) {
+		_, err = expandWildcards(newTypeLoader(""), typeMapping, nil)
+		_, ok := err.(*mappingError)
+		assert.True(ok, fmt.Sprint(err))
+		assert.Contains(fmt.Sprint(err), "Type=time./^Nothing$/")
+	}
+}
+
+func TestGenWildcardsDuplicates(t *testing.T) {
+	assert := assert.New(t)
+	src := `package main
+
+type Type int
+
+func PrintType(v Type) {
+	println(v)
+}
+
+func Print(v Type) {
+	println(v)
+}
+`
+	typeMapping, err := parseMapping("Type=time./^(Month|Weekday)$/")
+	if !assert.NoError(err) {
+		return
+	}
+	out := &bytes.Buffer{}
+	err = genWildcards([]byte(src), "in.go", "", "main", typeMapping, nil, out, genOptions{Dir: "."})
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "Print is declared by both in.go Type=time.Month and in.go Type=time.Weekday")
+		_, ok := errors.Cause(err).(*mappingError)
+		assert.True(ok, fmt.Sprint(err))
+	}
+	assert.Empty(out.String())
+}
+
+func TestCombine(t *testing.T) {
+	assert := assert.New(t)
+	outputs := [][]byte{
+		[]byte(`// Code generated by rei. DO NOT EDIT.
+
+package daos
+
+import (
+	"fmt"
+
+	"github.com/acme/models"
+)
+
+// UserDAO is a data access object for User
+type UserDAO struct{}
+
+func (dao *UserDAO) Print(m models.User) {
+	fmt.Println(m)
+}
+`),
+		[]byte(`// Code generated by rei. DO NOT EDIT.
+
+package daos
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/acme/models"
+)
+
+type OrderDAO struct{}
+
+func (dao *OrderDAO) Print(m models.Order) {
+	fmt.Println(strings.ToUpper(fmt.Sprint(m)))
+}
+`),
+	}
+	combined, err := combine("daos.go", outputs)
+	if assert.NoError(err) {
+		assert.Equal(`// Code generated by rei. DO NOT EDIT.
+
+package daos
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/acme/models"
+)
+
+// UserDAO is a data access object for User
+type UserDAO struct{}
+
+func (dao *UserDAO) Print(m models.User) {
+	fmt.Println(m)
+}
+
+type OrderDAO struct{}
+
+func (dao *OrderDAO) Print(m models.Order) {
+	fmt.Println(strings.ToUpper(fmt.Sprint(m)))
+}
+`, string(combined))
+	}
+}